@@ -0,0 +1,26 @@
+package fourtosix
+
+import (
+	"encoding/json"
+	"io"
+	"time"
+)
+
+// AuditRecord describes a rejected connection, for security audit trails.
+type AuditRecord struct {
+	Time     time.Time    `json:"time"`
+	Handler  string       `json:"handler,omitempty"`
+	Client   string       `json:"client"`
+	Hostname string       `json:"hostname,omitempty"`
+	Reason   RejectReason `json:"reason"`
+}
+
+// WriteAuditRecord writes rec to w as a single line of JSON.
+func WriteAuditRecord(w io.Writer, rec AuditRecord) error {
+	b, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(append(b, '\n'))
+	return err
+}
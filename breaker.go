@@ -0,0 +1,83 @@
+package fourtosix
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// ErrCircuitOpen is returned in place of dialing a backend whose circuit breaker has tripped.
+var ErrCircuitOpen = errors.New("circuit breaker open for backend")
+
+// CircuitBreaker tracks consecutive dial failures by backend address, and stops dials to a backend
+// which has failed Threshold times in a row until Cooldown has passed. Then a single probe dial is allowed through:
+// if it succeeds the breaker closes again, and if it fails the breaker stays open for another Cooldown.
+// It is safe for concurrent use.
+type CircuitBreaker struct {
+	Threshold int
+	Cooldown  time.Duration
+
+	mu       sync.Mutex
+	backends map[string]*breakerState
+}
+
+type breakerState struct {
+	failures  int
+	openUntil time.Time
+}
+
+// Validate checks that cb has a positive Threshold and a non-negative Cooldown.
+func (cb *CircuitBreaker) Validate() error {
+	if cb.Threshold <= 0 {
+		return fmt.Errorf("circuit breaker threshold of %d must be positive", cb.Threshold)
+	}
+	if cb.Cooldown < 0 {
+		return fmt.Errorf("circuit breaker cooldown of %v must not be negative", cb.Cooldown)
+	}
+	return nil
+}
+
+// Allow reports whether a dial to addr should be attempted. Callers which are allowed through must report the
+// result with Success or Failure.
+func (cb *CircuitBreaker) Allow(addr string) bool {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	st, ok := cb.backends[addr]
+	if !ok || st.failures < cb.Threshold {
+		return true
+	}
+	now := time.Now()
+	if now.Before(st.openUntil) {
+		return false
+	}
+	// Let this dial probe the backend, and hold everyone else back until it reports. If its result never arrives,
+	// another probe is allowed once a further Cooldown has passed.
+	st.openUntil = now.Add(cb.Cooldown)
+	return true
+}
+
+// Success records a successful dial to addr, resetting its failure count.
+func (cb *CircuitBreaker) Success(addr string) {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	delete(cb.backends, addr)
+}
+
+// Failure records a failed dial to addr, tripping the breaker if it has now failed Threshold times in a row.
+func (cb *CircuitBreaker) Failure(addr string) {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	if cb.backends == nil {
+		cb.backends = make(map[string]*breakerState)
+	}
+	st, ok := cb.backends[addr]
+	if !ok {
+		st = &breakerState{}
+		cb.backends[addr] = st
+	}
+	st.failures++
+	if st.failures >= cb.Threshold {
+		st.openUntil = time.Now().Add(cb.Cooldown)
+	}
+}
@@ -0,0 +1,78 @@
+package fourtosix
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCircuitBreakerTrips(t *testing.T) {
+	cb := &CircuitBreaker{Threshold: 2, Cooldown: time.Hour}
+	const addr = "backend.example:443"
+	cb.Failure(addr)
+	if !cb.Allow(addr) {
+		t.Fatal("breaker tripped before reaching Threshold")
+	}
+	cb.Failure(addr)
+	if cb.Allow(addr) {
+		t.Fatal("breaker allowed a dial after Threshold failures")
+	}
+	cb.Success("other.example:443")
+	if cb.Allow(addr) {
+		t.Error("success for another backend reset the breaker")
+	}
+}
+
+func TestCircuitBreakerSingleProbe(t *testing.T) {
+	cb := &CircuitBreaker{Threshold: 1, Cooldown: 20 * time.Millisecond}
+	const addr = "backend.example:443"
+	cb.Failure(addr)
+	time.Sleep(cb.Cooldown)
+
+	if !cb.Allow(addr) {
+		t.Fatal("breaker didn't allow a probe after Cooldown")
+	}
+	if cb.Allow(addr) {
+		t.Fatal("breaker allowed a second dial while the probe was outstanding")
+	}
+	cb.Failure(addr)
+	if cb.Allow(addr) {
+		t.Fatal("breaker allowed a dial straight after the probe failed")
+	}
+
+	time.Sleep(cb.Cooldown)
+	if !cb.Allow(addr) {
+		t.Fatal("breaker didn't allow another probe after Cooldown")
+	}
+	cb.Success(addr)
+	for i := 0; i < 3; i++ {
+		if !cb.Allow(addr) {
+			t.Fatal("breaker still open after the probe succeeded")
+		}
+	}
+}
+
+func TestCircuitBreakerLostProbe(t *testing.T) {
+	cb := &CircuitBreaker{Threshold: 1, Cooldown: 20 * time.Millisecond}
+	const addr = "backend.example:443"
+	cb.Failure(addr)
+	time.Sleep(cb.Cooldown)
+	if !cb.Allow(addr) {
+		t.Fatal("breaker didn't allow a probe after Cooldown")
+	}
+	// The probe never reports back.
+	time.Sleep(cb.Cooldown)
+	if !cb.Allow(addr) {
+		t.Error("breaker never allowed another probe after the first was lost")
+	}
+}
+
+func TestCircuitBreakerValidate(t *testing.T) {
+	for _, cb := range []*CircuitBreaker{{Threshold: 0}, {Threshold: -1}, {Threshold: 1, Cooldown: -time.Second}} {
+		if err := cb.Validate(); err == nil {
+			t.Errorf("Validate accepted %+v", cb)
+		}
+	}
+	if err := (&CircuitBreaker{Threshold: 3, Cooldown: time.Minute}).Validate(); err != nil {
+		t.Errorf("Validate: %v", err)
+	}
+}
@@ -2,6 +2,7 @@ package main
 
 import (
 	"flag"
+	"fmt"
 	"log"
 	"net"
 	"strings"
@@ -14,40 +15,96 @@ import (
 var (
 	tlsListenPort   = flag.String("tls-listen", ":443", "port to listen on for TLS connections; don't listen if empty")
 	tlsPermitSuffix = flag.String("tls-permit-suffix", "", "comma-separated list of suffixes we will permit proxying for")
+	tlsSubnet       = flag.String("tls-v4-subnet", "", "like -v4-subnet, but only for TLS connections; if blank, -v4-subnet is used")
 
 	httpListenPort   = flag.String("http-listen", ":80", "port to listen on for HTTP connections; don't listen if empty")
 	httpPermitSuffix = flag.String("http-permit-suffix", "", "comma-separated list of suffixes we will permit proxying for")
+	httpSubnet       = flag.String("http-v4-subnet", "", "like -v4-subnet, but only for HTTP connections; if blank, -v4-subnet is used")
 
-	fourToSixSubnet = flag.String("v4-subnet", "", "CIDR of subnet to send requests from (e.g. 64:ff96::/96) - this is the IPv6 subnet that will appear in logs for proxied IPs. If left blank, will use default IPv6 address (not recommended!)")
+	reusePort = flag.Bool("reuseport", false, "set SO_REUSEPORT on listening sockets, so several processes can share a port (Linux only)")
+
+	sourceStrategy  = flag.String("source-strategy", string(fourtosix.SourceHashClient), "how to choose between several -v4-subnet subnets: hash-client, round-robin or random")
+	fourToSixSubnet = flag.String("v4-subnet", "", "comma-separated CIDRs of subnets to send requests from (e.g. 64:ff96::/96) - these are the IPv6 subnets that will appear in logs for proxied IPs. If left blank, will use default IPv6 address (not recommended!)")
 )
 
-func main() {
-	flag.Parse()
+func listen(addr string) (net.Listener, error) {
+	if *reusePort {
+		return fourtosix.ListenReusePort("tcp", addr)
+	}
+	return net.Listen("tcp", addr)
+}
 
-	var makeDialer func(net.Conn, fourtosix.Context) fourtosix.Dialer
-	if *fourToSixSubnet != "" {
-		log.Printf("using subnet %q for outbound IPv6 connections", *fourToSixSubnet)
-		var err error
-		if makeDialer, err = fourtosix.DialUnderSubnet(*fourToSixSubnet); err != nil {
-			log.Fatalf("create dialer factory: %v", err)
-		}
+// makeDialerFor returns a MakeDialer function which sends requests from subnets, a comma-separated list, or from
+// -v4-subnet if that is blank, choosing between them with the source strategy named strategy. If both are blank,
+// it returns nil, so the default host address is used. tag names the protocol in log lines.
+func makeDialerFor(tag, subnets, strategy string) (func(net.Conn, fourtosix.Context) fourtosix.Dialer, error) {
+	st, err := fourtosix.ParseSourceStrategy(strategy)
+	if err != nil {
+		return nil, err
+	}
+	if subnets == "" {
+		subnets = *fourToSixSubnet
+	}
+	if subnets == "" {
+		log.Printf("[%s] [WARNING] using default host IPv6 address for outbound IPv6!", tag)
+		return nil, nil
+	}
+	log.Printf("[%s] using subnets %q for outbound IPv6 connections", tag, subnets)
+	sd, err := fourtosix.NewSubnetDialer(strings.Split(subnets, ",")...)
+	if err != nil {
+		return nil, fmt.Errorf("[%s] create dialer factory: %v", tag, err)
+	}
+	sd.Strategy = st
+	return sd.MakeDialer, nil
+}
+
+// newTLSHandler returns a tls.Handler configured by the -tls-* flags.
+func newTLSHandler() (*tls.Handler, error) {
+	var permittedSuffixes []string
+	if *tlsPermitSuffix != "" {
+		permittedSuffixes = strings.Split(*tlsPermitSuffix, ",")
+		log.Printf("[TLS] permitting connections to hostnames ending with %s", permittedSuffixes)
+	} else {
+		log.Printf("[TLS] permitting connections to all hostnames")
+	}
+	makeDialer, err := makeDialerFor("TLS", *tlsSubnet, *sourceStrategy)
+	if err != nil {
+		return nil, err
+	}
+	return &tls.Handler{
+		MakeDialer:          makeDialer,
+		AllowedHostSuffixes: permittedSuffixes,
+	}, nil
+}
+
+// newHTTPHandler returns an http.Handler configured by the -http-* flags.
+func newHTTPHandler() (*http.Handler, error) {
+	var permittedSuffixes []string
+	if *httpPermitSuffix != "" {
+		permittedSuffixes = strings.Split(*httpPermitSuffix, ",")
+		log.Printf("[HTTP] permitting connections to hostnames ending with %s", permittedSuffixes)
 	} else {
-		log.Println("[WARNING] using default host IPv6 address for outbound IPv6!")
+		log.Printf("[HTTP] permitting connections to all hostnames")
+	}
+	makeDialer, err := makeDialerFor("HTTP", *httpSubnet, *sourceStrategy)
+	if err != nil {
+		return nil, err
 	}
+	return &http.Handler{
+		MakeDialer:          makeDialer,
+		AllowedHostSuffixes: permittedSuffixes,
+	}, nil
+}
+
+func main() {
+	flag.Parse()
 
 	if *tlsListenPort != "" {
-		var permittedSuffixes []string
-		if *tlsPermitSuffix != "" {
-			permittedSuffixes = strings.Split(*tlsPermitSuffix, ",")
-			log.Printf("[TLS] permitting connections to hostnames ending with %s", permittedSuffixes)
-		} else {
-			log.Printf("[TLS] permitting connections to all hostnames")
-		}
-		h := &tls.Handler{
-			MakeDialer:          makeDialer,
-			AllowedHostSuffixes: permittedSuffixes,
+		h, err := newTLSHandler()
+		if err != nil {
+			log.Fatal(err)
 		}
-		l, err := net.Listen("tcp", *tlsListenPort)
+		l, err := listen(*tlsListenPort)
 		if err != nil {
 			log.Fatal(err)
 		}
@@ -56,18 +113,11 @@ func main() {
 	}
 
 	if *httpListenPort != "" {
-		var permittedSuffixes []string
-		if *httpPermitSuffix != "" {
-			permittedSuffixes = strings.Split(*httpPermitSuffix, ",")
-			log.Printf("[HTTP] permitting connections to hostnames ending with %s", permittedSuffixes)
-		} else {
-			log.Printf("[HTTP] permitting connections to all hostnames")
-		}
-		h := &http.Handler{
-			MakeDialer:          makeDialer,
-			AllowedHostSuffixes: permittedSuffixes,
+		h, err := newHTTPHandler()
+		if err != nil {
+			log.Fatal(err)
 		}
-		l, err := net.Listen("tcp", *httpListenPort)
+		l, err := listen(*httpListenPort)
 		if err != nil {
 			log.Fatal(err)
 		}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"github.com/lukegb/fourtosix"
+	"github.com/lukegb/fourtosix/internal/fakeconn"
+)
+
+func TestMakeDialerFor(t *testing.T) {
+	defer func(old string) { *fourToSixSubnet = old }(*fourToSixSubnet)
+	*fourToSixSubnet = ""
+
+	for _, subnets := range []string{"2001:db8::/96", "2001:db8:1::/96,2001:db8:2::/64", "2001:db8:1::/96, 2001:db8:2::/64"} {
+		if md, err := makeDialerFor("TEST", subnets, "hash-client"); err != nil || md == nil {
+			t.Errorf("makeDialerFor(%q) = %v, %v; want a MakeDialer", subnets, md != nil, err)
+		}
+	}
+	for _, subnets := range []string{"2001:db8::/97", "192.0.2.0/24", "2001:db8::/96,bogus", "2001:db8::/96,"} {
+		if _, err := makeDialerFor("TEST", subnets, "hash-client"); err == nil {
+			t.Errorf("makeDialerFor(%q) succeeded, want an error", subnets)
+		}
+	}
+
+	if md, err := makeDialerFor("TEST", "", "hash-client"); err != nil || md != nil {
+		t.Errorf("makeDialerFor with no subnets = %v, %v; want nil, so the host address is used", md != nil, err)
+	}
+	*fourToSixSubnet = "2001:db8::/96"
+	if md, err := makeDialerFor("TEST", "", "hash-client"); err != nil || md == nil {
+		t.Errorf("makeDialerFor falling back to -v4-subnet = %v, %v; want a MakeDialer", md != nil, err)
+	}
+}
+
+func TestMakeDialerForStrategy(t *testing.T) {
+	for _, strategy := range []string{"hash-client", "round-robin", "random"} {
+		if _, err := makeDialerFor("TEST", "2001:db8::/96", strategy); err != nil {
+			t.Errorf("makeDialerFor with -source-strategy=%s: %v", strategy, err)
+		}
+	}
+	for _, subnets := range []string{"2001:db8::/96", ""} {
+		if _, err := makeDialerFor("TEST", subnets, "round-robbin"); err == nil {
+			t.Errorf("makeDialerFor(%q) with an unknown -source-strategy succeeded, want an error", subnets)
+		}
+	}
+}
+
+// dialsFromLoopback reports whether makeDialer, for a client at 0.0.0.1, connects to l from ::1, as it does when
+// its subnet is ::/96, rather than failing to bind an address in an unrouted subnet.
+func dialsFromLoopback(t *testing.T, makeDialer func(net.Conn, fourtosix.Context) fourtosix.Dialer, l net.Listener) bool {
+	t.Helper()
+	client := fakeconn.New(&net.TCPAddr{IP: net.IPv4(0, 0, 0, 1), Port: 1234}, nil)
+	conn, err := makeDialer(client, nil).DialContext(context.Background(), "tcp6", l.Addr().String())
+	if err != nil {
+		return false
+	}
+	conn.Close()
+	return true
+}
+
+func TestHandlersUseOwnSubnetFlags(t *testing.T) {
+	l, err := net.Listen("tcp6", "[::1]:0")
+	if err != nil {
+		t.Skipf("no IPv6 loopback: %v", err)
+	}
+	defer l.Close()
+	defer func(v4, tls, http string) { *fourToSixSubnet, *tlsSubnet, *httpSubnet = v4, tls, http }(*fourToSixSubnet, *tlsSubnet, *httpSubnet)
+
+	// 2001:db8::/32 is reserved for documentation, so binding within it fails.
+	*fourToSixSubnet = "2001:db8:1234::/96"
+	for _, tc := range []struct {
+		tlsSubnet, httpSubnet     string
+		tlsLoopback, httpLoopback bool
+	}{
+		{"::/96", "", true, false},
+		{"", "::/96", false, true},
+		{"", "", false, false},
+	} {
+		*tlsSubnet, *httpSubnet = tc.tlsSubnet, tc.httpSubnet
+		th, err := newTLSHandler()
+		if err != nil {
+			t.Fatalf("newTLSHandler: %v", err)
+		}
+		hh, err := newHTTPHandler()
+		if err != nil {
+			t.Fatalf("newHTTPHandler: %v", err)
+		}
+		if got := dialsFromLoopback(t, th.MakeDialer, l); got != tc.tlsLoopback {
+			t.Errorf("-tls-v4-subnet=%q -http-v4-subnet=%q: TLS dialer uses ::/96 = %v, want %v", tc.tlsSubnet, tc.httpSubnet, got, tc.tlsLoopback)
+		}
+		if got := dialsFromLoopback(t, hh.MakeDialer, l); got != tc.httpLoopback {
+			t.Errorf("-tls-v4-subnet=%q -http-v4-subnet=%q: HTTP dialer uses ::/96 = %v, want %v", tc.tlsSubnet, tc.httpSubnet, got, tc.httpLoopback)
+		}
+	}
+}
@@ -0,0 +1,43 @@
+package fourtosix
+
+import "sync"
+
+// ConnCounter counts concurrent connections by key, such as a hostname or client address, so that they can be capped.
+// The zero value is ready to use.
+type ConnCounter struct {
+	mu     sync.Mutex
+	counts map[string]int
+}
+
+// Acquire records a new connection for key, returning false without recording it if max is positive and
+// key already has max connections. Every successful Acquire must be paired with a Release.
+func (c *ConnCounter) Acquire(key string, max int) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if max > 0 && c.counts[key] >= max {
+		return false
+	}
+	if c.counts == nil {
+		c.counts = make(map[string]int)
+	}
+	c.counts[key]++
+	return true
+}
+
+// Release records that a connection for key has finished.
+func (c *ConnCounter) Release(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.counts[key] <= 1 {
+		delete(c.counts, key)
+		return
+	}
+	c.counts[key]--
+}
+
+// Count returns the number of connections currently recorded for key.
+func (c *ConnCounter) Count(key string) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.counts[key]
+}
@@ -0,0 +1,35 @@
+package fourtosix
+
+import (
+	"context"
+	"net"
+)
+
+type handlerNameKey struct{}
+
+// WithHandlerName returns a copy of ctx carrying the name of the handler serving a connection.
+func WithHandlerName(ctx context.Context, name string) context.Context {
+	return context.WithValue(ctx, handlerNameKey{}, name)
+}
+
+// HandlerName returns the name of the handler serving the connection ctx belongs to, as set by WithHandlerName.
+// Dialers can use it to tell apart connections from differently-named handlers.
+func HandlerName(ctx context.Context) string {
+	name, _ := ctx.Value(handlerNameKey{}).(string)
+	return name
+}
+
+// ConnContext is passed to a handler's MakeDialer as its fourtosix.Context, and to the resulting Dialer's DialContext,
+// so that a dialer can see both what the client asked for and when to give up.
+type ConnContext struct {
+	context.Context
+
+	// Hostname is the hostname the client asked for, if any.
+	Hostname string
+
+	// OriginalDestination is where the connection was going before it was redirected to us, in TransparentMode.
+	OriginalDestination *net.TCPAddr
+
+	// Details holds protocol-specific information, such as the *tls.ClientHello for TLS connections.
+	Details interface{}
+}
@@ -2,8 +2,16 @@ package fourtosix
 
 import (
 	"context"
+	"crypto/rand"
+	"errors"
 	"fmt"
+	"hash/fnv"
+	"log"
+	mathrand "math/rand"
 	"net"
+	"strings"
+	"sync/atomic"
+	"syscall"
 	"time"
 )
 
@@ -24,29 +32,254 @@ type Dialer interface {
 
 type Context interface{}
 
+// SubnetDialer makes Dialers which connect from Subnet with the client's IPv4 address in the last
+// 32 bits.
+type SubnetDialer struct {
+	// Subnet is the prefix outbound connections are made from. It must be at most a /96.
+	Subnet *net.IPNet
+
+	// Subnets, if set, replace Subnet, with Strategy choosing between them. Each must be a /96 or
+	// shorter.
+	Subnets []*net.IPNet
+
+	// Strategy chooses between Subnets for each connection. If empty, SourceHashClient is used.
+	Strategy SourceStrategy
+
+	// VarySource randomises the bits between Subnet and the embedded IPv4 address for each
+	// connection, so one client's connections don't share a source. It does nothing for a /96.
+	VarySource bool
+
+	// BindRetries is the number of extra attempts made when the source address can't be bound.
+	// Retries always vary the source address where Subnet allows.
+	BindRetries int
+
+	// BindRetryBackoff, if positive, is the base delay before a bind retry. Each retry waits a
+	// random time up to BindRetryBackoff, doubled for every previous retry.
+	BindRetryBackoff time.Duration
+
+	// OnBindFailure, if set, is called each time a source address can't be bound, such as when the
+	// subnet isn't routed to this host. Other dial failures aren't reported.
+	OnBindFailure func(source net.IP, err error)
+
+	// TrafficClass, if non-zero, is the IPv6 traffic class (DSCP and ECN) for outbound connections.
+	// It is only supported on Linux; elsewhere, dials fail if it is set.
+	TrafficClass int
+
+	next uint32
+}
+
+// SourceStrategy is a way of choosing which of several subnets a connection is made from.
+type SourceStrategy string
+
+const (
+	// SourceHashClient uses the same subnet for each client, chosen by a hash of its address.
+	SourceHashClient SourceStrategy = "hash-client"
+	// SourceRoundRobin uses each subnet in turn.
+	SourceRoundRobin SourceStrategy = "round-robin"
+	// SourceRandom picks a subnet at random for each connection.
+	SourceRandom SourceStrategy = "random"
+)
+
+// ParseSourceStrategy returns the SourceStrategy named s, or an error if there isn't one.
+func ParseSourceStrategy(s string) (SourceStrategy, error) {
+	switch st := SourceStrategy(s); st {
+	case SourceHashClient, SourceRoundRobin, SourceRandom:
+		return st, nil
+	}
+	return "", fmt.Errorf("unknown source strategy %q; want %s, %s or %s", s, SourceHashClient, SourceRoundRobin, SourceRandom)
+}
+
+// NewSubnetDialer parses and validates subnets, returning a SubnetDialer which uses them.
+func NewSubnetDialer(subnets ...string) (*SubnetDialer, error) {
+	if len(subnets) == 0 {
+		return nil, errors.New("no subnets given")
+	}
+	sd := &SubnetDialer{}
+	for _, subnet := range subnets {
+		_, localNet, err := net.ParseCIDR(strings.TrimSpace(subnet))
+		if err != nil {
+			return nil, err
+		}
+		if err := checkFourInSixPrefix(localNet); err != nil {
+			return nil, err
+		}
+		sd.Subnets = append(sd.Subnets, localNet)
+	}
+	sd.Subnet = sd.Subnets[0]
+	if len(sd.Subnets) == 1 {
+		sd.Subnets = nil
+	}
+	return sd, nil
+}
+
+// checkFourInSixPrefix returns an error if prefix can't hold an IPv4 address in its last 32 bits.
+func checkFourInSixPrefix(prefix *net.IPNet) error {
+	if prefix.IP.To4() != nil {
+		return fmt.Errorf("subnet %s is not an IPv6 subnet", prefix.String())
+	}
+	if ones, _ := prefix.Mask.Size(); ones > subnetMaskFourInSix {
+		return fmt.Errorf("subnet mask %s is too small; must be at most %d bits to fit IPv4 addresses", prefix.String(), subnetMaskFourInSix)
+	} else if ones == 0 {
+		return fmt.Errorf("subnet mask %s is faulty", prefix.String())
+	}
+	return nil
+}
+
+// SynthesizeSource returns the source address for clientIPv4 under prefix: prefix with
+// clientIPv4 in its last 32 bits.
+func SynthesizeSource(prefix *net.IPNet, clientIPv4 net.IP) (net.IP, error) {
+	return embedIPv4(prefix, clientIPv4)
+}
+
+// embedIPv4 returns prefix with the IPv4 address v4 in its last 32 bits.
+func embedIPv4(prefix *net.IPNet, v4 net.IP) (net.IP, error) {
+	if err := checkFourInSixPrefix(prefix); err != nil {
+		return nil, err
+	}
+	b := v4.To4()
+	if b == nil {
+		return nil, fmt.Errorf("address %s is not an IPv4 address", v4)
+	}
+	ip := make(net.IP, net.IPv6len)
+	copy(ip, prefix.IP.To16())
+	copy(ip[net.IPv6len-net.IPv4len:], b)
+	return ip, nil
+}
+
+// ExtractEmbeddedIPv4 returns the IPv4 address SynthesizeSource embedded in src, which must be
+// within prefix. Bits filled in by VarySource are ignored.
+//
+// The address is always in the last 32 bits. This matches RFC 6052 only for a /96; shorter RFC
+// 6052 prefixes place it straight after the prefix.
+func ExtractEmbeddedIPv4(prefix *net.IPNet, src net.IP) (net.IP, error) {
+	if err := checkFourInSixPrefix(prefix); err != nil {
+		return nil, err
+	}
+	if src.To4() != nil || !prefix.Contains(src) {
+		return nil, fmt.Errorf("address %s is not within %s", src, prefix)
+	}
+	return net.IPv4(src[12], src[13], src[14], src[15]).To4(), nil
+}
+
+// DialUnderSubnet returns a MakeDialer function for a SubnetDialer using subnet,
+// which may be a comma-separated list of subnets.
 func DialUnderSubnet(subnet string) (func(net.Conn, Context) Dialer, error) {
-	localNet, localMask, err := net.ParseCIDR(subnet)
+	sd, err := NewSubnetDialer(strings.Split(subnet, ",")...)
 	if err != nil {
 		return nil, err
 	}
-	if ones, _ := localMask.Mask.Size(); ones > subnetMaskFourInSix {
-		return nil, fmt.Errorf("subnet mask %s is too small; must be at most %d bits to fit IPv4 addresses", localMask.String(), subnetMaskFourInSix)
-	} else if ones == 0 {
-		return nil, fmt.Errorf("subnet mask %s is faulty", localMask.String())
+	return sd.MakeDialer, nil
+}
+
+// subnetFor returns the subnet to make outbound connections for clientIP from.
+func (sd *SubnetDialer) subnetFor(clientIP net.IP) *net.IPNet {
+	if len(sd.Subnets) == 0 {
+		return sd.Subnet
+	}
+	var i uint32
+	switch sd.Strategy {
+	case SourceRoundRobin:
+		i = atomic.AddUint32(&sd.next, 1) - 1
+	case SourceRandom:
+		i = mathrand.Uint32()
+	default:
+		h := fnv.New32a()
+		h.Write(clientIP.To16())
+		i = h.Sum32()
 	}
+	return sd.Subnets[i%uint32(len(sd.Subnets))]
+}
 
-	return func(conn net.Conn, ctx Context) Dialer {
-		localIP := make(net.IP, len(localNet))
-		copy(localIP, localNet)
-		remoteIP := conn.RemoteAddr()
-		copy(localIP[13:], remoteIP.(*net.TCPAddr).IP.To4())
+// sourceFor returns the address to make outbound connections for clientIP from.
+func (sd *SubnetDialer) sourceFor(clientIP net.IP, vary bool) (net.IP, error) {
+	subnet := sd.subnetFor(clientIP)
+	localIP, err := SynthesizeSource(subnet, clientIP)
+	if err != nil {
+		return nil, err
+	}
+	if vary {
+		var noise [net.IPv6len - net.IPv4len]byte
+		rand.Read(noise[:])
+		for i, n := range noise {
+			localIP[i] |= n &^ subnet.Mask[i]
+		}
+	}
+	return localIP, nil
+}
 
-		return &net.Dialer{
+// MakeDialer returns a Dialer for proxying conn, which must have come from an IPv4 TCP client.
+func (sd *SubnetDialer) MakeDialer(conn net.Conn, ctx Context) Dialer {
+	d := &subnetDialer{sd: sd}
+	if remote, ok := conn.RemoteAddr().(*net.TCPAddr); ok {
+		// Otherwise, dials fail since there's no client address to embed.
+		d.clientIP = remote.IP
+	}
+	return d
+}
+
+type subnetDialer struct {
+	sd       *SubnetDialer
+	clientIP net.IP
+}
+
+func isBindError(err error) bool {
+	return errors.Is(err, syscall.EADDRINUSE) || errors.Is(err, syscall.EADDRNOTAVAIL)
+}
+
+func (d *subnetDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	var localIP net.IP
+	var err error
+	for attempt := 0; attempt <= d.sd.BindRetries; attempt++ {
+		if attempt > 0 && d.sd.BindRetryBackoff > 0 {
+			if werr := sleepContext(ctx, jitteredBackoff(d.sd.BindRetryBackoff, attempt)); werr != nil {
+				return nil, werr
+			}
+		}
+		localIP, err = d.sd.sourceFor(d.clientIP, d.sd.VarySource || attempt > 0)
+		if err != nil {
+			return nil, err
+		}
+		nd := &net.Dialer{
 			Timeout: dialTimeout,
 			LocalAddr: &net.TCPAddr{
 				IP:   localIP,
 				Port: 0,
 			},
 		}
-	}, nil
+		if d.sd.TrafficClass != 0 {
+			nd.Control = setTrafficClass(d.sd.TrafficClass)
+		}
+		var conn net.Conn
+		conn, err = nd.DialContext(ctx, network, address)
+		if err == nil || !isBindError(err) {
+			return conn, err
+		}
+		log.Printf("[%s] binding source %s: %v", d.clientIP, localIP, err)
+		if d.sd.OnBindFailure != nil {
+			d.sd.OnBindFailure(localIP, err)
+		}
+	}
+	return nil, err
+}
+
+// jitteredBackoff returns a random delay of up to base doubled for each retry before this one.
+func jitteredBackoff(base time.Duration, retry int) time.Duration {
+	max := base << uint(retry-1)
+	if max <= 0 {
+		// overflowed
+		max = base
+	}
+	return time.Duration(mathrand.Int63n(int64(max)) + 1)
+}
+
+// sleepContext waits for d, returning early with ctx's error if it is cancelled first.
+func sleepContext(ctx context.Context, d time.Duration) error {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
 }
@@ -0,0 +1,319 @@
+package fourtosix
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+func mustParseCIDR(t *testing.T, s string) *net.IPNet {
+	t.Helper()
+	_, n, err := net.ParseCIDR(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return n
+}
+
+func TestSynthesizeSource(t *testing.T) {
+	for _, tc := range []struct {
+		prefix, client, want string
+	}{
+		{"2001:db8::/96", "192.0.2.1", "2001:db8::c000:201"},
+		{"64:ff9b::/96", "10.0.0.1", "64:ff9b::a00:1"},
+		{"2001:db8:1234:5678::/64", "198.51.100.7", "2001:db8:1234:5678::c633:6407"},
+		{"2001:db8:ff00::/40", "203.0.113.255", "2001:db8:ff00::cb00:71ff"},
+	} {
+		client := net.ParseIP(tc.client)
+		got, err := SynthesizeSource(mustParseCIDR(t, tc.prefix), client)
+		if err != nil {
+			t.Errorf("SynthesizeSource(%s, %s): %v", tc.prefix, tc.client, err)
+			continue
+		}
+		if !got.Equal(net.ParseIP(tc.want)) {
+			t.Errorf("SynthesizeSource(%s, %s) = %s, want %s", tc.prefix, tc.client, got, tc.want)
+		}
+		if !got[12:].Equal(client.To4()) {
+			t.Errorf("SynthesizeSource(%s, %s) = %s, whose last 32 bits aren't the client's address", tc.prefix, tc.client, got)
+		}
+	}
+
+	for _, tc := range []struct {
+		prefix, client string
+	}{
+		{"192.0.2.0/24", "192.0.2.1"},
+		{"2001:db8::/112", "192.0.2.1"},
+		{"2001:db8::/96", "2001:db8::1"},
+	} {
+		if got, err := SynthesizeSource(mustParseCIDR(t, tc.prefix), net.ParseIP(tc.client)); err == nil {
+			t.Errorf("SynthesizeSource(%s, %s) = %s, want an error", tc.prefix, tc.client, got)
+		}
+	}
+}
+
+func TestSubnetDialerVarySource(t *testing.T) {
+	sd, err := NewSubnetDialer("2001:db8:1234:5678::/64")
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := net.ParseIP("192.0.2.1")
+	fixed, err := sd.sourceFor(client, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := net.ParseIP("2001:db8:1234:5678::c000:201"); !fixed.Equal(want) {
+		t.Errorf("sourceFor without VarySource = %s, want %s", fixed, want)
+	}
+
+	seen := make(map[string]bool)
+	for i := 0; i < 20; i++ {
+		src, err := sd.sourceFor(client, true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !sd.Subnet.Contains(src) {
+			t.Errorf("varied source %s is outside %s", src, sd.Subnet)
+		}
+		if !src[12:].Equal(client.To4()) {
+			t.Errorf("varied source %s doesn't end with the client's address", src)
+		}
+		seen[src.String()] = true
+	}
+	// 32 random bits make a repeat in 20 tries vanishingly unlikely.
+	if len(seen) != 20 {
+		t.Errorf("20 varied sources gave only %d distinct addresses", len(seen))
+	}
+
+	// A /96 has no spare bits to vary.
+	sd, err = NewSubnetDialer("2001:db8::/96")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if src, err := sd.sourceFor(client, true); err != nil || !src.Equal(net.ParseIP("2001:db8::c000:201")) {
+		t.Errorf("sourceFor under a /96 with VarySource = %s, %v; want 2001:db8::c000:201", src, err)
+	}
+}
+
+func TestSubnetDialerStrategies(t *testing.T) {
+	subnets := []string{"2001:db8:1::/96", "2001:db8:2::/96", "2001:db8:3::/96"}
+	sd, err := NewSubnetDialer(subnets...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clients := []net.IP{net.ParseIP("192.0.2.1"), net.ParseIP("192.0.2.2"), net.ParseIP("198.51.100.7")}
+
+	// By default, each client sticks to one subnet.
+	for _, client := range clients {
+		first := sd.subnetFor(client)
+		for i := 0; i < 5; i++ {
+			if got := sd.subnetFor(client); got != first {
+				t.Errorf("hash-client: %s moved from %s to %s", client, first, got)
+			}
+		}
+	}
+
+	sd.Strategy = SourceRoundRobin
+	for i := 0; i < 2*len(subnets); i++ {
+		if got, want := sd.subnetFor(clients[0]).String(), subnets[i%len(subnets)]; got != want {
+			t.Errorf("round-robin: connection %d from %s, want %s", i, got, want)
+		}
+	}
+
+	sd.Strategy = SourceRandom
+	used := make(map[string]bool)
+	for i := 0; i < 100; i++ {
+		used[sd.subnetFor(clients[0]).String()] = true
+	}
+	if len(used) != len(subnets) {
+		t.Errorf("random: 100 connections used only %d of %d subnets", len(used), len(subnets))
+	}
+}
+
+// remoteConn is a net.Conn which reports remote as its RemoteAddr.
+type remoteConn struct {
+	net.Conn
+	remote net.Addr
+}
+
+func (c remoteConn) RemoteAddr() net.Addr { return c.remote }
+
+// listenLoopback6 returns a listener on the IPv6 loopback address, skipping the test if there isn't one.
+func listenLoopback6(t *testing.T) net.Listener {
+	t.Helper()
+	l, err := net.Listen("tcp6", "[::1]:0")
+	if err != nil {
+		t.Skipf("no IPv6 loopback: %v", err)
+	}
+	t.Cleanup(func() { l.Close() })
+	return l
+}
+
+// unroutedSubnet is reserved for documentation, so it won't be routed to this host and binding within it fails.
+const unroutedSubnet = "2001:db8:1234::/96"
+
+func TestSubnetDialerBindFailure(t *testing.T) {
+	l := listenLoopback6(t)
+	sd, err := NewSubnetDialer(unroutedSubnet)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client := remoteConn{remote: &net.TCPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 1234}}
+	for _, retries := range []int{0, 2} {
+		sd.BindRetries = retries
+		conn, err := sd.MakeDialer(client, nil).DialContext(context.Background(), "tcp6", l.Addr().String())
+		if err == nil {
+			conn.Close()
+			t.Fatalf("BindRetries=%d: dial from unrouted subnet succeeded", retries)
+		}
+		if conn != nil {
+			t.Errorf("BindRetries=%d: got non-nil conn alongside error %v", retries, err)
+		}
+		if !isBindError(err) {
+			t.Errorf("BindRetries=%d: got error %v, want a bind error", retries, err)
+		}
+	}
+}
+
+func TestSubnetDialerBindRetry(t *testing.T) {
+	l := listenLoopback6(t)
+	// With round-robin, the retry comes from ::/96, which embeds 0.0.0.1 as the bindable ::1.
+	sd, err := NewSubnetDialer(unroutedSubnet, "::/96")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sd.Strategy = SourceRoundRobin
+	sd.BindRetries = 1
+
+	client := remoteConn{remote: &net.TCPAddr{IP: net.IPv4(0, 0, 0, 1), Port: 1234}}
+	conn, err := sd.MakeDialer(client, nil).DialContext(context.Background(), "tcp6", l.Addr().String())
+	if err != nil {
+		t.Fatalf("DialContext: %v", err)
+	}
+	defer conn.Close()
+	if got := conn.LocalAddr().(*net.TCPAddr).IP; !got.Equal(net.IPv6loopback) {
+		t.Errorf("retried dial came from %s, want ::1", got)
+	}
+}
+
+func TestSubnetDialerOnBindFailure(t *testing.T) {
+	l := listenLoopback6(t)
+	sd, err := NewSubnetDialer(unroutedSubnet, "::/96")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sd.Strategy = SourceRoundRobin
+	sd.BindRetries = 1
+	var sources []net.IP
+	sd.OnBindFailure = func(source net.IP, err error) {
+		if !isBindError(err) {
+			t.Errorf("OnBindFailure called with %v, want a bind error", err)
+		}
+		sources = append(sources, source)
+	}
+
+	client := remoteConn{remote: &net.TCPAddr{IP: net.IPv4(0, 0, 0, 1), Port: 1234}}
+	conn, err := sd.MakeDialer(client, nil).DialContext(context.Background(), "tcp6", l.Addr().String())
+	if err != nil {
+		t.Fatalf("DialContext: %v", err)
+	}
+	conn.Close()
+	if len(sources) != 1 || !sources[0].Equal(net.ParseIP("2001:db8:1234::1")) {
+		t.Errorf("OnBindFailure called with sources %v, want [2001:db8:1234::1]", sources)
+	}
+
+	// Nothing listens on a closed listener's port, so a dial from ::1 binds but is refused.
+	addr := l.Addr().String()
+	l.Close()
+	sd.Subnets = nil
+	sd.Subnet = mustParseCIDR(t, "::/96")
+	sources = nil
+	if conn, err := sd.MakeDialer(client, nil).DialContext(context.Background(), "tcp6", addr); err == nil {
+		conn.Close()
+		t.Fatal("dial to closed port succeeded")
+	}
+	if len(sources) != 0 {
+		t.Errorf("OnBindFailure called with sources %v for a refused connection, want none", sources)
+	}
+}
+
+func TestSubnetDialerBindRetryBackoff(t *testing.T) {
+	l := listenLoopback6(t)
+	sd, err := NewSubnetDialer(unroutedSubnet, "2001:db8:5678::/96", "::/96")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sd.Strategy = SourceRoundRobin
+	sd.BindRetries = 2
+	sd.BindRetryBackoff = 10 * time.Millisecond
+	failures := 0
+	sd.OnBindFailure = func(net.IP, error) { failures++ }
+
+	client := remoteConn{remote: &net.TCPAddr{IP: net.IPv4(0, 0, 0, 1), Port: 1234}}
+	conn, err := sd.MakeDialer(client, nil).DialContext(context.Background(), "tcp6", l.Addr().String())
+	if err != nil {
+		t.Fatalf("DialContext: %v", err)
+	}
+	conn.Close()
+	if failures != 2 {
+		t.Errorf("%d bind failures before the third subnet, want 2", failures)
+	}
+
+	// A context which ends during the backoff cuts it short.
+	sd.BindRetryBackoff = time.Hour
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if _, err := sd.MakeDialer(client, nil).DialContext(ctx, "tcp6", l.Addr().String()); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("DialContext during a long backoff = %v, want %v", err, context.DeadlineExceeded)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("DialContext returned %v after its context ended", elapsed-50*time.Millisecond)
+	}
+}
+
+func TestJitteredBackoff(t *testing.T) {
+	const base = 10 * time.Millisecond
+	for retry := 1; retry <= 5; retry++ {
+		max := base << uint(retry-1)
+		for i := 0; i < 100; i++ {
+			if d := jitteredBackoff(base, retry); d <= 0 || d > max {
+				t.Fatalf("jitteredBackoff(%v, %d) = %v, want within (0, %v]", base, retry, d, max)
+			}
+		}
+	}
+	// Shifting far enough overflows, which falls back to base rather than a negative delay.
+	if d := jitteredBackoff(base, 100); d <= 0 || d > base {
+		t.Errorf("jitteredBackoff(%v, 100) = %v, want within (0, %v]", base, d, base)
+	}
+}
+
+func TestExtractEmbeddedIPv4(t *testing.T) {
+	client := net.ParseIP("192.0.2.33")
+	for _, prefix := range []string{
+		"2001:db8::/32",
+		"2001:db8:100::/40",
+		"2001:db8:122::/48",
+		"2001:db8:122:300::/56",
+		"2001:db8:122:344::/64",
+		"64:ff9b::/96",
+	} {
+		p := mustParseCIDR(t, prefix)
+		src, err := SynthesizeSource(p, client)
+		if err != nil {
+			t.Fatalf("SynthesizeSource(%s, %s): %v", prefix, client, err)
+		}
+		got, err := ExtractEmbeddedIPv4(p, src)
+		if err != nil {
+			t.Errorf("ExtractEmbeddedIPv4(%s, %s): %v", prefix, src, err)
+		} else if !got.Equal(client) {
+			t.Errorf("ExtractEmbeddedIPv4(%s, %s) = %s, want %s", prefix, src, got, client)
+		}
+	}
+
+	if got, err := ExtractEmbeddedIPv4(mustParseCIDR(t, "2001:db8:1::/48"), net.ParseIP("2001:db8:2::c000:221")); err == nil {
+		t.Errorf("ExtractEmbeddedIPv4 of an address outside the prefix = %s, want an error", got)
+	}
+}
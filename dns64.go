@@ -0,0 +1,77 @@
+package fourtosix
+
+import (
+	"context"
+	"fmt"
+	"net"
+)
+
+// Resolver looks up the addresses of a host. *net.Resolver implements it.
+type Resolver interface {
+	LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error)
+}
+
+// DNS64Dialer is a Dialer which reaches IPv4-only hosts over IPv6, by embedding their IPv4 address in Prefix
+// as a DNS64 resolver would. Traffic to Prefix must be routed through a NAT64 gateway.
+// Hosts with an IPv6 address are dialed directly.
+type DNS64Dialer struct {
+	// Prefix is the NAT64 prefix, such as the well-known 64:ff9b::/96.
+	Prefix *net.IPNet
+
+	// Resolver is used to look up backend hostnames. If nil, net.DefaultResolver is used.
+	Resolver Resolver
+
+	// Dialer is used to make the connection once the target has been chosen. If nil, DefaultDialer is used.
+	Dialer Dialer
+}
+
+// target returns the IPv6 address to use to reach host.
+func (d *DNS64Dialer) target(ctx context.Context, host string) (net.IP, error) {
+	if ip := net.ParseIP(host); ip != nil {
+		if ip.To4() != nil {
+			return embedIPv4(d.Prefix, ip)
+		}
+		return ip, nil
+	}
+
+	resolver := d.Resolver
+	if resolver == nil {
+		resolver = net.DefaultResolver
+	}
+	addrs, err := resolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	var v4 net.IP
+	for _, addr := range addrs {
+		if addr.IP.To4() == nil {
+			return addr.IP, nil
+		} else if v4 == nil {
+			v4 = addr.IP
+		}
+	}
+	if v4 == nil {
+		return nil, fmt.Errorf("no addresses found for %s", host)
+	}
+	return embedIPv4(d.Prefix, v4)
+}
+
+func (d *DNS64Dialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	if err := checkFourInSixPrefix(d.Prefix); err != nil {
+		return nil, err
+	}
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+	ip, err := d.target(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+
+	dialer := d.Dialer
+	if dialer == nil {
+		dialer = DefaultDialer
+	}
+	return dialer.DialContext(ctx, network, net.JoinHostPort(ip.String(), port))
+}
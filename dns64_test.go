@@ -0,0 +1,64 @@
+package fourtosix
+
+import (
+	"context"
+	"net"
+	"testing"
+)
+
+// staticResolver resolves hostnames from a fixed map.
+type staticResolver map[string][]string
+
+func (r staticResolver) LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error) {
+	var addrs []net.IPAddr
+	for _, a := range r[host] {
+		addrs = append(addrs, net.IPAddr{IP: net.ParseIP(a)})
+	}
+	return addrs, nil
+}
+
+// addressRecorder is a Dialer which records the addresses it is asked to dial, and fails every dial.
+type addressRecorder struct {
+	dialed []string
+}
+
+func (d *addressRecorder) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	d.dialed = append(d.dialed, address)
+	return nil, &net.OpError{Op: "dial", Net: network}
+}
+
+func TestDNS64Dialer(t *testing.T) {
+	resolver := staticResolver{
+		"v4only.example": {"192.0.2.1", "192.0.2.2"},
+		"dual.example":   {"192.0.2.1", "2001:db8::1"},
+	}
+	for _, tc := range []struct {
+		address, want string
+	}{
+		{"192.0.2.33:443", "[64:ff9b::c000:221]:443"},
+		{"[2001:db8::2]:443", "[2001:db8::2]:443"},
+		{"v4only.example:443", "[64:ff9b::c000:201]:443"},
+		{"dual.example:443", "[2001:db8::1]:443"},
+	} {
+		rec := &addressRecorder{}
+		d := &DNS64Dialer{Prefix: mustParseCIDR(t, "64:ff9b::/96"), Resolver: resolver, Dialer: rec}
+		d.DialContext(context.Background(), "tcp", tc.address)
+		if len(rec.dialed) != 1 || rec.dialed[0] != tc.want {
+			t.Errorf("dialing %s dialed %q, want [%s]", tc.address, rec.dialed, tc.want)
+		}
+	}
+
+	for _, tc := range []struct {
+		prefix, address string
+	}{
+		{"64:ff9b::/96", "unknown.example:443"},
+		{"64:ff9b::/112", "192.0.2.33:443"},
+		{"64:ff9b::/96", "192.0.2.33"},
+	} {
+		rec := &addressRecorder{}
+		d := &DNS64Dialer{Prefix: mustParseCIDR(t, tc.prefix), Resolver: resolver, Dialer: rec}
+		if _, err := d.DialContext(context.Background(), "tcp", tc.address); err == nil || len(rec.dialed) != 0 {
+			t.Errorf("DNS64Dialer under %s dialing %s: dialed %q with error %v, want no dial", tc.prefix, tc.address, rec.dialed, err)
+		}
+	}
+}
@@ -0,0 +1,77 @@
+package fourtosix
+
+import (
+	"net"
+	"sync"
+)
+
+// ConnEventType identifies the stage of a connection a ConnEvent describes.
+type ConnEventType int
+
+const (
+	// ConnAccepted is emitted when a handler starts serving a connection.
+	ConnAccepted ConnEventType = iota
+	// ConnParsedHostname is emitted once the hostname the client wants has been read.
+	ConnParsedHostname
+	// ConnDialed is emitted when a backend connection has been established.
+	ConnDialed
+	// ConnDialFailed is emitted when no backend could be connected to.
+	ConnDialFailed
+	// ConnClosed is emitted when a connection which was accepted finishes, however it ended. If it was proxied,
+	// the event carries the number of bytes relayed each way.
+	ConnClosed
+	// ConnRejected is emitted when a connection is turned away, with the Reason, ahead of its ConnClosed.
+	ConnRejected
+)
+
+// ConnEvent describes progress made by a single connection.
+type ConnEvent struct {
+	Type   ConnEventType
+	Client net.Addr
+
+	// Hostname is set from ConnParsedHostname onwards, and for ConnRejected if the hostname was known.
+	Hostname string
+	// Backend is the address connected to, for ConnDialed and ConnClosed, or that couldn't be, for ConnDialFailed.
+	Backend string
+	// Err is why the dial failed, for ConnDialFailed.
+	Err error
+	// Reason is why the connection was turned away, for ConnRejected.
+	Reason RejectReason
+
+	// BytesToBackend and BytesToClient are set for ConnClosed, if the connection was proxied.
+	BytesToBackend, BytesToClient int64
+}
+
+const eventBufferSize = 256
+
+// EventStream delivers ConnEvents to a subscriber. The zero value is ready to use, and discards events
+// until Events is first called.
+type EventStream struct {
+	mu sync.Mutex
+	ch chan ConnEvent
+}
+
+// Events returns the channel events are delivered on. The channel is buffered; events emitted while it is full are dropped,
+// so that a slow subscriber never holds up connections.
+func (s *EventStream) Events() <-chan ConnEvent {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.ch == nil {
+		s.ch = make(chan ConnEvent, eventBufferSize)
+	}
+	return s.ch
+}
+
+// Emit delivers ev to the subscriber, if there is one and it has room.
+func (s *EventStream) Emit(ev ConnEvent) {
+	s.mu.Lock()
+	ch := s.ch
+	s.mu.Unlock()
+	if ch == nil {
+		return
+	}
+	select {
+	case ch <- ev:
+	default:
+	}
+}
@@ -0,0 +1,72 @@
+package fourtosix
+
+import (
+	"net"
+	"strings"
+
+	"golang.org/x/net/idna"
+)
+
+const (
+	maxHostnameLength = 253
+	maxLabelLength    = 63
+)
+
+// ValidHostname reports whether name is plausible as a DNS hostname: at most 253 bytes long,
+// made of non-empty labels of at most 63 letters, digits, hyphens or underscores, with at most one trailing dot.
+func ValidHostname(name string) bool {
+	name = strings.TrimSuffix(name, ".")
+	if name == "" || len(name) > maxHostnameLength {
+		return false
+	}
+	for _, label := range strings.Split(name, ".") {
+		if label == "" || len(label) > maxLabelLength {
+			return false
+		}
+		if label[0] == '-' || label[len(label)-1] == '-' {
+			return false
+		}
+		for i := 0; i < len(label); i++ {
+			c := label[i]
+			switch {
+			case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9', c == '-', c == '_':
+			default:
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// NormalizeHostname lowercases name, strips a single trailing dot, and converts any internationalised labels
+// to their ASCII (punycode) form, so that equivalent spellings of a name compare equal.
+// IP literals are only lowercased.
+func NormalizeHostname(name string) (string, error) {
+	name = strings.TrimSuffix(strings.ToLower(name), ".")
+	if net.ParseIP(strings.Trim(name, "[]")) != nil {
+		// idna would reject the colons and brackets of IPv6 literals.
+		return name, nil
+	}
+	labels := strings.Split(name, ".")
+	for i, label := range labels {
+		if strings.Contains(label, "_") && isASCII(label) {
+			// ValidHostname allows underscores, as in _acme-challenge, but idna.Lookup's STD3 rules don't.
+			continue
+		}
+		l, err := idna.Lookup.ToASCII(label)
+		if err != nil {
+			return "", err
+		}
+		labels[i] = l
+	}
+	return strings.Join(labels, "."), nil
+}
+
+func isASCII(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] >= 0x80 {
+			return false
+		}
+	}
+	return true
+}
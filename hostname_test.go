@@ -0,0 +1,87 @@
+package fourtosix
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestValidHostname(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		want bool
+	}{
+		{"example.com", true},
+		{"example.com.", true},
+		{"_acme-challenge.example.com", true},
+		{"xn--bcher-kva.de", true},
+		{strings.Repeat("a", 63) + ".example", true},
+		{strings.Repeat("a.", 126) + "a", true},
+		{"", false},
+		{".", false},
+		{"example..com", false},
+		{"example.com..", false},
+		{"-example.com", false},
+		{"example-.com", false},
+		{"exa mple.com", false},
+		{"example.com:443", false},
+		{strings.Repeat("a", 64) + ".example", false},
+		{strings.Repeat("a.", 127) + "a", false},
+	} {
+		if got := ValidHostname(tc.name); got != tc.want {
+			t.Errorf("ValidHostname(%q) = %v, want %v", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestNormalizeHostname(t *testing.T) {
+	for _, tc := range []struct {
+		name, want string
+	}{
+		{"Example.COM.", "example.com"},
+		{"bücher.de", "xn--bcher-kva.de"},
+		{"BÜCHER.de", "xn--bcher-kva.de"},
+		{"xn--bcher-kva.de", "xn--bcher-kva.de"},
+		{"ＥＸＡＭＰＬＥ.com", "example.com"},
+		{"_acme-challenge.Example.com", "_acme-challenge.example.com"},
+		{"192.0.2.1", "192.0.2.1"},
+		{"[2001:DB8::1]", "[2001:db8::1]"},
+	} {
+		got, err := NormalizeHostname(tc.name)
+		if err != nil {
+			t.Errorf("NormalizeHostname(%q): %v", tc.name, err)
+		} else if got != tc.want {
+			t.Errorf("NormalizeHostname(%q) = %q, want %q", tc.name, got, tc.want)
+		}
+	}
+
+	for _, name := range []string{"exa mple.com", "xn--zz.com", "bü_cher.de"} {
+		if got, err := NormalizeHostname(name); err == nil {
+			t.Errorf("NormalizeHostname(%q) = %q, want an error", name, got)
+		}
+	}
+}
+
+func TestAllowedHostSuffixesInternationalised(t *testing.T) {
+	for _, tc := range []struct {
+		suffix, hostname string
+	}{
+		{".bücher.de", "www.bücher.de"},
+		{".bücher.de", "www.xn--bcher-kva.de"},
+		{".xn--bcher-kva.de", "www.bücher.de"},
+		{".BÜCHER.de", "WWW.Bücher.DE."},
+	} {
+		r := Routing{AllowedHostSuffixes: []string{tc.suffix}}
+		hostname, err := NormalizeHostname(tc.hostname)
+		if err != nil {
+			t.Fatalf("NormalizeHostname(%q): %v", tc.hostname, err)
+		}
+		if !r.Allowed(hostname) {
+			t.Errorf("suffix %q doesn't allow %q, normalized to %q", tc.suffix, tc.hostname, hostname)
+		}
+	}
+
+	r := Routing{AllowedHostSuffixes: []string{".bücher.de"}}
+	if hostname, _ := NormalizeHostname("www.bucher.de"); r.Allowed(hostname) {
+		t.Errorf("suffix .bücher.de allows %q", hostname)
+	}
+}
@@ -0,0 +1,116 @@
+package http
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+
+	"golang.org/x/net/http2/hpack"
+)
+
+const (
+	h2cPreface     = "PRI * HTTP/2.0\r\n\r\nSM\r\n\r\n"
+	h2cRequestLine = "PRI * HTTP/2.0"
+
+	h2FrameHeaders      = 0x1
+	h2FrameContinuation = 0x9
+
+	h2FlagEndHeaders = 0x4
+	h2FlagPadded     = 0x8
+	h2FlagPriority   = 0x20
+
+	// h2cMaxFrames is the number of frames, such as SETTINGS, we'll skip over looking for the first HEADERS frame.
+	h2cMaxFrames = 8
+)
+
+// readRequestHead reads the head of the first request from r, which may be either HTTP/1.x or
+// HTTP/2 with prior knowledge (h2c). For h2c, the request line is always "PRI * HTTP/2.0".
+func readRequestHead(r *bufio.Reader, maxLines, maxBytes int) (requestLine, host string, sawAllHeaders bool, err error) {
+	if !isH2CPreface(r) {
+		return hostHeader(r, maxLines, maxBytes)
+	}
+	host, err = h2cAuthority(r, maxBytes)
+	return h2cRequestLine, host, err == nil, err
+}
+
+// isH2CPreface reports whether r starts with the HTTP/2 connection preface. It only waits for as many bytes
+// as it takes to tell, so short HTTP/1.x requests aren't held up.
+func isH2CPreface(r *bufio.Reader) bool {
+	for i := 1; i <= len(h2cPreface); i++ {
+		b, err := r.Peek(i)
+		if err != nil || b[i-1] != h2cPreface[i-1] {
+			return false
+		}
+	}
+	return true
+}
+
+// h2cAuthority reads the preface and frames up to the end of the first request's header block from r,
+// returning the request's :authority, or its host header if it has no :authority, or "" if it has neither.
+func h2cAuthority(r io.Reader, maxBytes int) (string, error) {
+	if _, err := io.ReadFull(r, make([]byte, len(h2cPreface))); err != nil {
+		return "", err
+	}
+
+	var block []byte
+	for frames := 0; ; frames++ {
+		if frames >= h2cMaxFrames {
+			return "", fmt.Errorf("no complete HEADERS within %d frames", h2cMaxFrames)
+		}
+		head := make([]byte, 9)
+		if _, err := io.ReadFull(r, head); err != nil {
+			return "", fmt.Errorf("reading frame header: %w", err)
+		}
+		length := int(head[0])<<16 | int(head[1])<<8 | int(head[2])
+		frameType, flags := head[3], head[4]
+		if len(block)+length > maxBytes {
+			return "", fmt.Errorf("%w: frame of %d bytes", errHeadersTooLong, length)
+		}
+		payload := make([]byte, length)
+		if _, err := io.ReadFull(r, payload); err != nil {
+			return "", fmt.Errorf("reading %d byte frame: %w", length, err)
+		}
+
+		switch {
+		case frameType == h2FrameHeaders && block == nil:
+			if flags&h2FlagPadded != 0 {
+				if len(payload) < 1 || int(payload[0]) > len(payload)-1 {
+					return "", fmt.Errorf("HEADERS padding exceeds frame")
+				}
+				payload = payload[1 : len(payload)-int(payload[0])]
+			}
+			if flags&h2FlagPriority != 0 {
+				if len(payload) < 5 {
+					return "", fmt.Errorf("HEADERS too short for priority")
+				}
+				payload = payload[5:]
+			}
+			block = append([]byte{}, payload...)
+		case frameType == h2FrameContinuation && block != nil:
+			block = append(block, payload...)
+		case block != nil:
+			return "", fmt.Errorf("frame type %d interrupted header block", frameType)
+		default:
+			// SETTINGS, WINDOW_UPDATE etc. ahead of the request
+			continue
+		}
+		if flags&h2FlagEndHeaders != 0 {
+			break
+		}
+	}
+
+	fields, err := hpack.NewDecoder(4096, nil).DecodeFull(block)
+	if err != nil {
+		return "", fmt.Errorf("decoding header block: %w", err)
+	}
+	var host string
+	for _, f := range fields {
+		switch f.Name {
+		case ":authority":
+			return f.Value, nil
+		case "host":
+			host = f.Value
+		}
+	}
+	return host, nil
+}
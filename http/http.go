@@ -3,10 +3,11 @@ package http
 import (
 	"bufio"
 	"context"
+	"errors"
 	"fmt"
 	"io"
-	"log"
 	"net"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
@@ -15,37 +16,229 @@ import (
 )
 
 const (
-	bufferBytes                = 1024
 	hostHeaderPrefix           = "Host: "
+	commonLogTimeFormat        = "02/Jan/2006:15:04:05 -0700"
+	responseWriteTimeout       = 1 * time.Second
 	badRequestResponse         = "HTTP/1.0 400 Bad Request\r\nContent-Type: text/plain\r\n\r\nBad Request\r\n"
+	badGatewayResponse         = "HTTP/1.0 502 Bad Gateway\r\nContent-Type: text/plain\r\n\r\nBad Gateway\r\n"
 	serviceUnavailableResponse = "HTTP/1.0 503 Service Unavailable\r\nContent-Type: text/plain\r\n\r\nService Unavailable\r\n"
+	gatewayTimeoutResponse     = "HTTP/1.0 504 Gateway Timeout\r\nContent-Type: text/plain\r\n\r\nGateway Timeout\r\n"
+	headersTooLargeResponse    = "HTTP/1.0 431 Request Header Fields Too Large\r\nContent-Type: text/plain\r\n\r\nRequest Header Fields Too Large\r\n"
+
+	defaultMaxHeaderLines = 100
+	defaultMaxHeaderBytes = 8 << 10
 )
 
 // Handler handles incoming HTTP requests and routes them to a backend based on their HTTP Host header.
 type Handler struct {
+	// Name, if set, identifies this handler in its log lines and, through fourtosix.HandlerName, in the context
+	// passed to DialContext. To tell handlers apart in metrics, give each its own Metrics.
+	Name string
+
 	MakeDialer          func(net.Conn, fourtosix.Context) fourtosix.Dialer
 	HostnameIsAllowed   func(hostname string) bool
 	AllowedHostSuffixes []string
+
+	// DefaultBackend, if set, is the address (host:port) that requests are sent to if they have no Host header,
+	// or their Host is not allowed. If unset, such requests are rejected.
+	DefaultBackend string
+
+	// Middleware wraps the handling of each connection accepted by Serve, with the first entry outermost.
+	// It is not applied to direct calls to ServeConn.
+	Middleware []fourtosix.Middleware
+
+	// OnAccept, if set, is called with each connection before anything is read from it.
+	// The connection it returns is used in place of the original; if it returns an error, the connection is closed.
+	OnAccept func(net.Conn) (net.Conn, error)
+
+	// AuditLog, if set, receives a line of JSON (see fourtosix.AuditRecord) for each rejected connection.
+	AuditLog io.Writer
+
+	// Metrics, if set, is notified about rejected connections and backend responses.
+	Metrics fourtosix.Metrics
+
+	// SilentDrop closes connections with no Host header or a disallowed one without sending a response,
+	// so as not to confirm to scanners that anything is listening.
+	SilentDrop bool
+
+	// ResetOnReject closes rejected connections with a TCP RST rather than a FIN. Any error response is still sent
+	// first unless SilentDrop is also set, but the client may not receive it.
+	ResetOnReject bool
+
+	// RedirectHosts maps hostnames, in lower case and without a trailing dot, to a redirect sent to requests for them
+	// instead of proxying the request.
+	RedirectHosts map[string]Redirect
+
+	// RedirectToHTTPS answers every request which has a Host header with a permanent redirect to the same path
+	// over HTTPS, rather than proxying it. RedirectHosts takes precedence.
+	RedirectToHTTPS bool
+
+	// StrictRouting only allows hostnames matching AllowedHostSuffixes or for which BackendsForHost returns something,
+	// so that an empty allowlist denies everything rather than allowing everything. It has no effect if
+	// HostnameIsAllowed is set.
+	StrictRouting bool
+
+	// MaxConnectionsPerClientIP, if positive, limits the number of concurrent connections from any one client address.
+	MaxConnectionsPerClientIP int
+
+	// PerClientByteQuota, if set, limits the total bytes relayed for each client address over its window.
+	// Connections are closed once their client exceeds it, and new ones are rejected until the window resets.
+	PerClientByteQuota *fourtosix.ByteQuota
+
+	// MaxConnectionsPerHost, if positive, limits the number of concurrent connections to any one backend.
+	MaxConnectionsPerHost int
+
+	// NextHop, if set, is the address (host:port) every connection is sent to, regardless of its hostname,
+	// except those sent to DefaultBackend. The original bytes are still replayed, so the backend sees the client's
+	// requested hostname.
+	NextHop string
+
+	// BackendsForHost, if set, returns the addresses (host:port) to try in order for a hostname, until one accepts
+	// the connection. If it returns nothing, the usual backend is used. It isn't consulted for DefaultBackend.
+	BackendsForHost func(hostname string) []string
+
+	// CircuitBreaker, if set, stops dials to backends which have been failing repeatedly.
+	CircuitBreaker *fourtosix.CircuitBreaker
+
+	// AfterDial, if set, is called with each newly established backend connection, and returns the connection
+	// to relay to in its place, which may wrap the original. If it returns an error, the client's connection is closed.
+	AfterDial func(ctx fourtosix.Context, rconn net.Conn) (net.Conn, error)
+
+	// PreferIPv6 resolves backend hostnames before dialing, and connects to their IPv6 addresses
+	// in preference to IPv4, which is only used if a backend has no IPv6 addresses.
+	PreferIPv6 bool
+
+	// ConnectionPool, if set, supplies backend connections in place of MakeDialer, which is then not used.
+	ConnectionPool *fourtosix.ConnectionPool
+
+	// NoDelay, if set, is passed to SetNoDelay on both sides of each proxied TCP connection. Go already disables
+	// Nagle's algorithm on every TCP connection, so this is only useful set to false, to coalesce small writes.
+	// If nil, Go's default is kept.
+	NoDelay *bool
+
+	// TrustProxyProtocol causes a PROXY protocol header to be read from the start of each connection,
+	// and the client address it carries to be used in place of the connection's own remote address.
+	TrustProxyProtocol bool
+
+	// TrustedProxies limits TrustProxyProtocol to connections from peers in these networks.
+	// Connections from other peers are handled as if they had no PROXY header.
+	// It must be non-empty if TrustProxyProtocol is set; to trust every peer, list 0.0.0.0/0 and ::/0.
+	TrustedProxies []net.IPNet
+
+	// StartupRampDuration, if set, limits the rate at which Serve accepts connections when it starts,
+	// gradually lifting the limit over this period.
+	StartupRampDuration time.Duration
+
+	// TransparentMode sends each connection to the destination it had before being redirected to us by netfilter,
+	// without looking at its contents at all. The dialer is given the original destination in its fourtosix.ConnContext.
+	// This is only supported on Linux.
+	TransparentMode bool
+
+	// HandshakeProgressTimeout, if set, is how long a client may go without sending anything while we wait for
+	// the start of its connection. Each read pushes the timeout back, up to the usual absolute limit of 5 seconds.
+	HandshakeProgressTimeout time.Duration
+
+	// EstablishTimeout, if positive, limits the total time from accepting a connection to connecting to its backend,
+	// covering both reading the request headers and dialing. Connections which take longer are abandoned.
+	EstablishTimeout time.Duration
+
+	// MaxConcurrentHandshakes, if positive, limits the number of connections whose request headers are being read
+	// and parsed at once. Further connections wait for a turn until their handshake deadline passes.
+	// Connections which have been established don't count towards the limit.
+	MaxConcurrentHandshakes int
+
+	// IdleTimeout, if positive, closes proxied connections once no data has passed in either direction for this long.
+	IdleTimeout time.Duration
+
+	// RelayBufferSize, if positive, sets the size of the buffers used to copy data once a connection is established.
+	RelayBufferSize int
+
+	// AccessLog, if set, receives a line in Common Log Format for each proxied connection, describing its first
+	// request; later requests on the same connection aren't logged. The status is taken from the backend's
+	// response, and is left as "-" for HTTP/2, whose responses have no status line to read.
+	AccessLog io.Writer
+
+	// MaxHeaderLines limits the number of header lines read while looking for the end of the headers.
+	// Requests with more are rejected. If zero, 100 is used.
+	MaxHeaderLines int
+
+	// MaxHeaderBytes limits the total size of the request line and headers. Requests with more are rejected.
+	// If zero, 8KiB is used.
+	MaxHeaderBytes int
+
+	srv         fourtosix.Server
+	hostConns   fourtosix.ConnCounter
+	clientConns fourtosix.ConnCounter
+	handshakes  fourtosix.Semaphore
+
+	accessLogMu sync.Mutex
 }
 
-func hostHeader(r io.Reader) (host string, sawAllHeaders bool, err error) {
+// options returns the handler's configuration in the form fourtosix.Server takes it.
+func (h *Handler) options() *fourtosix.HandlerOptions {
+	return &fourtosix.HandlerOptions{
+		Name:                h.Name,
+		Middleware:          h.Middleware,
+		StartupRampDuration: h.StartupRampDuration,
+		ResetOnReject:       h.ResetOnReject,
+		Metrics:             h.Metrics,
+		AuditLog:            h.AuditLog,
+		MakeDialer:          h.MakeDialer,
+		ConnectionPool:      h.ConnectionPool,
+		PreferIPv6:          h.PreferIPv6,
+		CircuitBreaker:      h.CircuitBreaker,
+		NoDelay:             h.NoDelay,
+		TrustProxyProtocol:  h.TrustProxyProtocol,
+		TrustedProxies:      h.TrustedProxies,
+		IdleTimeout:         h.IdleTimeout,
+		RelayBufferSize:     h.RelayBufferSize,
+		PerClientByteQuota:  h.PerClientByteQuota,
+	}
+}
+
+// routing returns the handler's routing configuration.
+func (h *Handler) routing() *fourtosix.Routing {
+	return &fourtosix.Routing{
+		HostnameIsAllowed:   h.HostnameIsAllowed,
+		AllowedHostSuffixes: h.AllowedHostSuffixes,
+		StrictRouting:       h.StrictRouting,
+		DefaultBackend:      h.DefaultBackend,
+		NextHop:             h.NextHop,
+		BackendsForHost:     h.BackendsForHost,
+	}
+}
+
+var (
+	errTooManyHeaders = errors.New("too many header lines")
+	errHeadersTooLong = errors.New("headers too long")
+)
+
+func hostHeader(r io.Reader, maxLines, maxBytes int) (requestLine, host string, sawAllHeaders bool, err error) {
 	bs := bufio.NewScanner(r)
 
-	// Cap scanner buffer to 1024 bytes, which should be enough for anyone(?)
-	bs.Buffer(nil, bufferBytes)
+	// No single line can be longer than all the headers together.
+	bs.Buffer(nil, maxBytes)
 
 	if !bs.Scan() {
-		return "", false, fmt.Errorf("failed to read initial line: %v", bs.Err())
+		return "", "", false, fmt.Errorf("failed to read initial line: %w", bs.Err())
 	}
+	requestLine = bs.Text()
+	total := len(requestLine) + 2
 
 	// Read headers.
-	for bs.Scan() {
+	for lines := 0; bs.Scan(); lines++ {
 		ln := bs.Text()
 		if ln == "" {
 			// Marker for end of headers.
 			sawAllHeaders = true
 			break
 		}
+		if lines >= maxLines {
+			return "", "", false, fmt.Errorf("%w: more than %d", errTooManyHeaders, maxLines)
+		}
+		if total += len(ln) + 2; total > maxBytes {
+			return "", "", false, fmt.Errorf("%w: more than %d bytes", errHeadersTooLong, maxBytes)
+		}
 
 		if !strings.HasPrefix(ln, hostHeaderPrefix) {
 			// Not interested in non-Host headers.
@@ -54,109 +247,333 @@ func hostHeader(r io.Reader) (host string, sawAllHeaders bool, err error) {
 
 		if host != "" {
 			// Multiple Host headers?!?
-			return "", false, fmt.Errorf("saw multiple Host headers")
+			return "", "", false, fmt.Errorf("saw multiple Host headers")
 		}
 
 		host = strings.TrimPrefix(ln, hostHeaderPrefix)
 	}
 
-	return host, sawAllHeaders, bs.Err()
+	return requestLine, host, sawAllHeaders, bs.Err()
 }
 
-func (h *Handler) handle(conn net.Conn) {
+// ServeConn proxies a single accepted connection, returning once it has been closed.
+// It is safe to call concurrently, and can be used to drive the handler without a net.Listener.
+// The returned error describes why the connection was rejected, if it was.
+func (h *Handler) ServeConn(conn net.Conn) error {
 	defer conn.Close()
-	conn.SetDeadline(time.Now().Add(5 * time.Second))
-	log.Printf("[%s] got connection", conn.RemoteAddr())
+	if h.OnAccept != nil {
+		wrapped, err := h.OnAccept(conn)
+		if err != nil {
+			return fmt.Errorf("OnAccept: %v", err)
+		}
+		conn = wrapped
+		defer conn.Close()
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	conn.SetDeadline(deadline)
+	conn, err := h.srv.StripProxyHeader(h.options(), conn)
+	if err != nil {
+		return err
+	}
+	start := time.Now()
+	h.logf("[%s] got connection", conn.RemoteAddr())
+	ctx, done := h.srv.Accept(h.Name, conn)
+	defer done()
 
-	ctx, cancel := context.WithCancel(context.Background())
-	defer cancel()
+	clientIP := conn.RemoteAddr().String()
+	if host, _, err := net.SplitHostPort(clientIP); err == nil {
+		clientIP = host
+	}
+	if !h.clientConns.Acquire(clientIP, h.MaxConnectionsPerClientIP) {
+		writeResponse(conn, serviceUnavailableResponse)
+		h.rejected(conn, "", fourtosix.RejectOverCapacity)
+		return fmt.Errorf("blocked: too many connections from %s", clientIP)
+	}
+	defer h.clientConns.Release(clientIP)
 
-	mr := &fourtosix.MemorizingReader{Reader: conn}
+	if h.PerClientByteQuota != nil && h.PerClientByteQuota.Exceeded(clientIP) {
+		writeResponse(conn, serviceUnavailableResponse)
+		h.rejected(conn, "", fourtosix.RejectOverCapacity)
+		return fmt.Errorf("blocked: %s has exceeded its byte quota", clientIP)
+	}
+
+	establishCtx, cancelEstablish := fourtosix.EstablishContext(ctx, start, h.EstablishTimeout)
+	defer cancelEstablish()
 
-	host, sawAllHeaders, err := hostHeader(mr)
+	if h.TransparentMode {
+		dst, err := fourtosix.OriginalDestination(conn)
+		if err != nil {
+			h.rejected(conn, "", fourtosix.RejectNoHostname)
+			return fmt.Errorf("transparent mode: %v", err)
+		}
+		return h.proxy(&fourtosix.ConnContext{Context: ctx, OriginalDestination: dst}, conn, dst.String(), []string{dst.String()}, nil, start, "")
+	}
+
+	waitCtx, cancelWait := context.WithDeadline(establishCtx, deadline)
+	releaseHandshake, err := h.handshakes.Acquire(waitCtx, h.MaxConcurrentHandshakes)
+	cancelWait()
 	if err != nil {
-		log.Printf("[%s] error reading headers: %v", conn.RemoteAddr(), err)
-		fmt.Fprintf(conn, badRequestResponse)
-		return
+		if establishCtx.Err() != nil {
+			return fmt.Errorf("reading headers interrupted: %v", establishCtx.Err())
+		}
+		writeResponse(conn, serviceUnavailableResponse)
+		h.rejected(conn, "", fourtosix.RejectOverCapacity)
+		return fmt.Errorf("blocked: too many handshakes in progress")
+	}
+
+	mr := &fourtosix.MemorizingReader{Reader: fourtosix.NewProgressReader(conn, h.HandshakeProgressTimeout, deadline)}
+
+	maxHeaderLines := h.MaxHeaderLines
+	if maxHeaderLines == 0 {
+		maxHeaderLines = defaultMaxHeaderLines
+	}
+	maxHeaderBytes := h.MaxHeaderBytes
+	if maxHeaderBytes == 0 {
+		maxHeaderBytes = defaultMaxHeaderBytes
+	}
+	// Shutdown closes the connection to abort reading headers which are still arriving.
+	stop := context.AfterFunc(establishCtx, func() { conn.Close() })
+	requestLine, host, sawAllHeaders, err := readRequestHead(bufio.NewReader(mr), maxHeaderLines, maxHeaderBytes)
+	stop()
+	releaseHandshake()
+	if err != nil && establishCtx.Err() != nil {
+		return fmt.Errorf("reading headers interrupted: %v", establishCtx.Err())
+	}
+	if err != nil {
+		if errors.Is(err, errTooManyHeaders) || errors.Is(err, errHeadersTooLong) || errors.Is(err, bufio.ErrTooLong) {
+			writeResponse(conn, headersTooLargeResponse)
+			h.rejected(conn, host, fourtosix.RejectOversized)
+		} else {
+			writeResponse(conn, badRequestResponse)
+			h.rejected(conn, host, fourtosix.RejectMalformed)
+		}
+		return fmt.Errorf("error reading headers: %v", err)
 	}
 
 	if !sawAllHeaders {
-		log.Printf("[%s] failed to read all headers", conn.RemoteAddr())
-		fmt.Fprintf(conn, badRequestResponse)
-		return
+		writeResponse(conn, badRequestResponse)
+		h.rejected(conn, host, fourtosix.RejectMalformed)
+		return fmt.Errorf("failed to read all headers")
 	}
-	if host == "" {
-		log.Printf("[%s] never saw a Host header", conn.RemoteAddr())
-		fmt.Fprintf(conn, badRequestResponse)
-		return
+	if host != "" {
+		// The port, if any, is ignored; we only ever connect to port 80.
+		if hostname, _, err := net.SplitHostPort(host); err == nil {
+			host = hostname
+		}
+		if host, err = fourtosix.NormalizeHostname(host); err != nil {
+			writeResponse(conn, badRequestResponse)
+			h.rejected(conn, host, fourtosix.RejectMalformed)
+			return fmt.Errorf("Host could not be normalized: %v", err)
+		}
+		if !fourtosix.ValidHostname(host) {
+			writeResponse(conn, badRequestResponse)
+			h.rejected(conn, host, fourtosix.RejectMalformed)
+			return fmt.Errorf("Host %q is not a valid hostname", host)
+		}
+	}
+	h.srv.Emit(fourtosix.ConnEvent{Type: fourtosix.ConnParsedHostname, Client: conn.RemoteAddr(), Hostname: host})
+
+	if r, ok := h.RedirectHosts[host]; ok && host != "" {
+		h.redirect(conn, start, requestLine, strings.TrimSuffix(r.URL, "/")+requestPath(requestLine), r.Permanent)
+		return nil
+	}
+	if h.RedirectToHTTPS && host != "" {
+		h.redirect(conn, start, requestLine, "https://"+host+requestPath(requestLine), true)
+		return nil
 	}
 
-	if h.HostnameIsAllowed != nil && !h.HostnameIsAllowed(host) {
-		log.Printf("[%s] connect %s blocked: hostname not allowed", conn.RemoteAddr(), hostHeader)
-		fmt.Fprintf(conn, badRequestResponse)
-		return
+	usingDefault := false
+	raddr := net.JoinHostPort(host, "80")
+	if host == "" {
+		if h.DefaultBackend == "" {
+			if !h.SilentDrop {
+				writeResponse(conn, badRequestResponse)
+			}
+			h.rejected(conn, host, fourtosix.RejectNoHostname)
+			return fmt.Errorf("never saw a Host header")
+		}
+		h.logf("[%s] never saw a Host header, using default backend", conn.RemoteAddr())
+		raddr = h.DefaultBackend
+		usingDefault = true
+	} else if !h.routing().Allowed(host) {
+		if h.DefaultBackend == "" {
+			if !h.SilentDrop {
+				writeResponse(conn, badRequestResponse)
+			}
+			h.rejected(conn, host, fourtosix.RejectHostnameNotAllowed)
+			return fmt.Errorf("connect %s blocked: hostname not allowed", host)
+		}
+		h.logf("[%s] hostname %s not allowed, using default backend", conn.RemoteAddr(), host)
+		raddr = h.DefaultBackend
+		usingDefault = true
 	}
 
-	var dialer fourtosix.Dialer
-	if h.MakeDialer != nil {
-		dialer = h.MakeDialer(conn, hostHeader)
-	} else {
-		dialer = fourtosix.DefaultDialer
+	backends := h.routing().Backends(host, raddr, usingDefault)
+
+	return h.proxy(&fourtosix.ConnContext{Context: ctx, Hostname: host}, conn, raddr, backends, mr.Buffer(), start, requestLine)
+}
+
+// proxy connects to the first of backends which accepts a connection and the bytes already read from conn,
+// then relays data in both directions until both sides are done. raddr is the backend the client asked for,
+// which is used for logging and per-host limits; ctx is passed to MakeDialer. start is when conn was accepted,
+// which EstablishTimeout is measured from.
+func (h *Handler) proxy(ctx *fourtosix.ConnContext, conn net.Conn, raddr string, backends []string, replay []byte, start time.Time, requestLine string) error {
+	if !h.hostConns.Acquire(raddr, h.MaxConnectionsPerHost) {
+		writeResponse(conn, serviceUnavailableResponse)
+		h.rejected(conn, ctx.Hostname, fourtosix.RejectOverCapacity)
+		return fmt.Errorf("connect %s blocked: too many connections", raddr)
 	}
+	defer h.hostConns.Release(raddr)
 
-	rconn, err := dialer.DialContext(ctx, "tcp", net.JoinHostPort(host, "80"))
-	if err != nil {
-		log.Printf("[%s] connect %s: %v", conn.RemoteAddr(), host, err)
-		fmt.Fprintf(conn, serviceUnavailableResponse)
-		return
+	// The dial is made under a copy of ctx which also expires at the end of EstablishTimeout.
+	establishCtx, cancelEstablish := fourtosix.EstablishContext(ctx.Context, start, h.EstablishTimeout)
+	defer cancelEstablish()
+	dctx := *ctx
+	dctx.Context = establishCtx
+
+	opts := h.options()
+	rconn, daddr, err := h.srv.Connect(&dctx, opts, conn, raddr, backends, replay)
+	if errors.Is(err, fourtosix.ErrReplayFailed) {
+		writeResponse(conn, badGatewayResponse)
+		h.rejected(conn, ctx.Hostname, fourtosix.RejectReplayFailed)
+		return fmt.Errorf("connect %s: %v", raddr, err)
+	} else if err != nil {
+		writeResponse(conn, dialErrorResponse(err))
+		h.rejected(conn, ctx.Hostname, fourtosix.RejectDialFailed)
+		return fmt.Errorf("connect %s: %v", raddr, err)
 	}
 	defer rconn.Close()
-	log.Printf("[%s] connected to %s", conn.RemoteAddr(), host)
-	if _, err := rconn.Write(mr.Buffer()); err != nil {
-		log.Printf("[%s] send catchup to rconn %s: %v", conn.RemoteAddr(), host, err)
-		fmt.Fprintf(conn, serviceUnavailableResponse)
-		return
+	dialedAt := time.Now()
+
+	if h.AfterDial != nil {
+		wrapped, err := h.AfterDial(ctx, rconn)
+		if err != nil {
+			writeResponse(conn, badGatewayResponse)
+			h.rejected(conn, ctx.Hostname, fourtosix.RejectDialFailed)
+			return fmt.Errorf("AfterDial for %s: %v", raddr, err)
+		}
+		rconn = wrapped
+		defer rconn.Close()
 	}
 
-	// unset deadline
-	var zero time.Time
-	conn.SetDeadline(zero)
+	var sc *statusConn
+	if (h.AccessLog != nil || h.Metrics != nil) && requestLine != h2cRequestLine {
+		sc = &statusConn{Conn: rconn}
+		rconn = sc
+	}
 
-	log.Printf("[%s] gluing connections together", conn.RemoteAddr())
-	var wg sync.WaitGroup
-	wg.Add(2)
-	go func() {
-		io.Copy(conn, rconn)
-		wg.Done()
-	}()
-	go func() {
-		io.Copy(rconn, conn)
-		wg.Done()
-	}()
+	_, toClient := h.srv.Relay(ctx, opts, conn, rconn, daddr, dialedAt)
+	status := 0
+	if sc != nil {
+		status = sc.Status()
+		if status == 0 {
+			h.logf("[%s] backend %s sent no valid status line", conn.RemoteAddr(), raddr)
+		}
+		if h.Metrics != nil {
+			h.Metrics.BackendResponded(status)
+		}
+	}
+	if h.AccessLog != nil {
+		h.logAccess(conn, start, requestLine, status, toClient)
+	}
+	return nil
+}
 
-	wg.Wait()
-	log.Printf("[%s] closing connection", conn.RemoteAddr())
+// redirect sends a redirect to location in response to requestLine, and logs it.
+func (h *Handler) redirect(conn net.Conn, start time.Time, requestLine, location string, permanent bool) {
+	status := writeRedirect(conn, location, permanent)
+	h.logf("[%s] redirected to %s", conn.RemoteAddr(), location)
+	if h.AccessLog != nil {
+		h.logAccess(conn, start, requestLine, status, 0)
+	}
 }
 
-func (h *Handler) checkHostname(hostname string) bool {
-	for _, s := range h.AllowedHostSuffixes {
-		if strings.HasSuffix(hostname, s) {
-			return true
-		}
+// dialErrorResponse picks the response to send when we couldn't connect to a backend:
+// 503 if we didn't try because the backend is known to be failing, 504 if the attempt timed out,
+// and 502 for anything else, such as the connection being refused or the name not resolving.
+func dialErrorResponse(err error) string {
+	if errors.Is(err, fourtosix.ErrCircuitOpen) {
+		return serviceUnavailableResponse
 	}
-	return false
+	var netErr net.Error
+	if errors.Is(err, context.DeadlineExceeded) || (errors.As(err, &netErr) && netErr.Timeout()) {
+		return gatewayTimeoutResponse
+	}
+	return badGatewayResponse
 }
 
-func (h *Handler) Serve(c net.Listener) error {
-	if h.HostnameIsAllowed == nil && h.AllowedHostSuffixes != nil {
-		h.HostnameIsAllowed = h.checkHostname
+// writeResponse sends a canned response to conn, giving up if it can't be sent within responseWriteTimeout.
+func writeResponse(conn net.Conn, response string) error {
+	conn.SetWriteDeadline(time.Now().Add(responseWriteTimeout))
+	_, err := io.WriteString(conn, response)
+	return err
+}
+
+func (h *Handler) logAccess(conn net.Conn, start time.Time, requestLine string, status int, size int64) {
+	client := conn.RemoteAddr().String()
+	if host, _, err := net.SplitHostPort(client); err == nil {
+		client = host
+	}
+	statusStr := "-"
+	if status != 0 {
+		statusStr = strconv.Itoa(status)
 	}
 
-	for {
-		conn, err := c.Accept()
-		if err != nil {
-			return fmt.Errorf("failed to accept: %v", err)
+	h.accessLogMu.Lock()
+	defer h.accessLogMu.Unlock()
+	fmt.Fprintf(h.AccessLog, "%s - - [%s] %q %s %d\n", client, start.Format(commonLogTimeFormat), requestLine, statusStr, size)
+}
+
+// logf logs a message, prefixed with the handler's Name if it has one.
+func (h *Handler) logf(format string, args ...interface{}) {
+	fourtosix.Logf(h.Name, format, args...)
+}
+
+func (h *Handler) rejected(conn net.Conn, hostname string, reason fourtosix.RejectReason) {
+	h.srv.Rejected(h.options(), conn, hostname, reason)
+}
+
+// Validate checks the handler's configuration for mistakes which would otherwise only show up as connections fail.
+// Serve calls it before accepting any connections.
+func (h *Handler) Validate() error {
+	for hostname, r := range h.RedirectHosts {
+		if r.URL == "" {
+			return fmt.Errorf("RedirectHosts[%q] has no URL", hostname)
 		}
-		go h.handle(conn)
 	}
+	if err := h.options().Validate(); err != nil {
+		return err
+	}
+	return h.routing().Validate()
+}
+
+// Serve accepts connections from c and proxies them, until c fails or the handler is shut down.
+// After Shutdown or Drain, Serve returns fourtosix.ErrHandlerClosed.
+func (h *Handler) Serve(c net.Listener) error {
+	if err := h.Validate(); err != nil {
+		return fmt.Errorf("invalid configuration: %v", err)
+	}
+	return h.srv.Serve(c, h.options(), h.ServeConn)
+}
+
+// ListenAndServe listens on the given network address and then calls Serve to handle its connections.
+func (h *Handler) ListenAndServe(network, addr string) error {
+	return fourtosix.ListenAndServe(network, addr, h.Serve)
+}
+
+// Shutdown stops all Serve calls from accepting new connections, and forcibly closes any in-flight connections.
+func (h *Handler) Shutdown() error {
+	return h.srv.Shutdown()
+}
+
+// Drain stops all Serve calls from accepting new connections, but lets in-flight connections run to completion.
+// Shutdown may still be called afterwards to close them.
+func (h *Handler) Drain() error {
+	return h.srv.Drain()
+}
+
+// Events returns a channel on which events are delivered as connections progress.
+// Events are dropped if the channel is full; until Events is first called, none are delivered.
+func (h *Handler) Events() <-chan fourtosix.ConnEvent {
+	return h.srv.Events()
 }
@@ -0,0 +1,575 @@
+package http
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"reflect"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/lukegb/fourtosix"
+	"github.com/lukegb/fourtosix/internal/fakeconn"
+	"golang.org/x/net/http2/hpack"
+)
+
+const request = "GET /path HTTP/1.1\r\nHost: example.com\r\nUser-Agent: test\r\n\r\n"
+
+// expectThenRespond returns a fakeconn Backend which checks that it receives want, then sends a 204 response.
+func expectThenRespond(t *testing.T, want string) func(net.Conn, string) {
+	return func(conn net.Conn, _ string) {
+		got := make([]byte, len(want))
+		if _, err := io.ReadFull(conn, got); err != nil {
+			t.Errorf("backend reading request: %v", err)
+			return
+		}
+		if string(got) != want {
+			t.Errorf("backend got %q, want the client's request %q", got, want)
+		}
+		conn.Write([]byte("HTTP/1.1 204 No Content\r\n\r\n"))
+	}
+}
+
+// serveRequest has h serve a connection which sends req, returning ServeConn's error.
+func serveRequest(h *Handler, req string) error {
+	conn := fakeconn.New(fakeconn.ClientAddr, []byte(req))
+	conn.CloseInput()
+	return h.ServeConn(conn)
+}
+
+func TestServeConnProxies(t *testing.T) {
+	d := &fakeconn.Dialer{Backend: func(conn net.Conn, _ string) {
+		got := make([]byte, len(request))
+		if _, err := io.ReadFull(conn, got); err != nil {
+			t.Errorf("backend reading request: %v", err)
+			return
+		}
+		if string(got) != request {
+			t.Errorf("backend got %q, want the client's request %q", got, request)
+		}
+		conn.Write([]byte("HTTP/1.1 204 No Content\r\n\r\n"))
+	}}
+	h := &Handler{MakeDialer: d.MakeDialer}
+
+	conn := fakeconn.New(fakeconn.ClientAddr, []byte(request))
+	conn.CloseInput()
+	if err := h.ServeConn(conn); err != nil {
+		t.Fatalf("ServeConn: %v", err)
+	}
+	if dialed := d.Dialed(); len(dialed) != 1 || dialed[0] != "example.com:80" {
+		t.Errorf("dialed %q, want [example.com:80]", dialed)
+	}
+	if got := string(conn.Written()); got != "HTTP/1.1 204 No Content\r\n\r\n" {
+		t.Errorf("client got %q, want the backend's response", got)
+	}
+}
+
+func TestServeConnForwardsDataReadAhead(t *testing.T) {
+	const post = "POST /upload HTTP/1.1\r\nHost: example.com\r\nContent-Length: 100\r\n\r\n"
+	all := post + strings.Repeat("x", 100)
+	d := &fakeconn.Dialer{Backend: func(conn net.Conn, _ string) {
+		got := make([]byte, len(all))
+		if _, err := io.ReadFull(conn, got); err != nil {
+			t.Errorf("backend reading request: %v", err)
+		} else if string(got) != all {
+			t.Errorf("backend got %q, want the request and its body %q", got, all)
+		}
+	}}
+	h := &Handler{MakeDialer: d.MakeDialer}
+
+	// The headers and body arrive together, so they are read in one go.
+	conn := fakeconn.New(fakeconn.ClientAddr, []byte(all))
+	conn.CloseInput()
+	if err := h.ServeConn(conn); err != nil {
+		t.Fatalf("ServeConn: %v", err)
+	}
+}
+
+func TestServeConnBlockedHostname(t *testing.T) {
+	d := &fakeconn.Dialer{}
+	h := &Handler{MakeDialer: d.MakeDialer, AllowedHostSuffixes: []string{".example.org"}}
+
+	conn := fakeconn.New(fakeconn.ClientAddr, []byte(request))
+	conn.CloseInput()
+	if err := h.ServeConn(conn); err == nil {
+		t.Fatal("ServeConn proxied a hostname which isn't allowed")
+	}
+	if dialed := d.Dialed(); len(dialed) != 0 {
+		t.Errorf("dialed %q for a blocked hostname", dialed)
+	}
+	if got := string(conn.Written()); !strings.HasPrefix(got, "HTTP/1.0 ") {
+		t.Errorf("client got %q, want an error response", got)
+	}
+}
+
+func TestServeConnDialFailure(t *testing.T) {
+	d := &fakeconn.Dialer{Err: errors.New("unreachable")}
+	h := &Handler{MakeDialer: d.MakeDialer}
+
+	conn := fakeconn.New(fakeconn.ClientAddr, []byte(request))
+	conn.CloseInput()
+	if err := h.ServeConn(conn); err == nil {
+		t.Fatal("ServeConn succeeded with an unreachable backend")
+	}
+	if got := string(conn.Written()); got != badGatewayResponse {
+		t.Errorf("client got %q, want %q", got, badGatewayResponse)
+	}
+}
+
+func TestDialErrorResponse(t *testing.T) {
+	for _, tc := range []struct {
+		err  error
+		want string
+	}{
+		{fmt.Errorf("example.com:80: %w", fourtosix.ErrCircuitOpen), serviceUnavailableResponse},
+		{context.DeadlineExceeded, gatewayTimeoutResponse},
+		{&net.OpError{Op: "dial", Net: "tcp", Err: os.ErrDeadlineExceeded}, gatewayTimeoutResponse},
+		{&net.OpError{Op: "dial", Net: "tcp", Err: syscall.ECONNREFUSED}, badGatewayResponse},
+	} {
+		if got := dialErrorResponse(tc.err); got != tc.want {
+			t.Errorf("dialErrorResponse(%v) = %q, want %q", tc.err, got, tc.want)
+		}
+	}
+}
+
+func TestServeConnUnavailable(t *testing.T) {
+	breaker := &fourtosix.CircuitBreaker{Threshold: 1, Cooldown: time.Hour}
+	breaker.Failure("example.com:80")
+	full := &Handler{MakeDialer: (&fakeconn.Dialer{}).MakeDialer, MaxConnectionsPerHost: 1}
+	full.hostConns.Acquire("example.com:80", 1)
+
+	for _, tc := range []struct {
+		name string
+		h    *Handler
+		want string
+	}{
+		{"circuit open", &Handler{MakeDialer: (&fakeconn.Dialer{}).MakeDialer, CircuitBreaker: breaker}, serviceUnavailableResponse},
+		{"too many connections", full, serviceUnavailableResponse},
+		{"dial timeout", &Handler{MakeDialer: (&fakeconn.Dialer{Err: context.DeadlineExceeded}).MakeDialer}, gatewayTimeoutResponse},
+	} {
+		conn := fakeconn.New(fakeconn.ClientAddr, []byte(request))
+		conn.CloseInput()
+		if err := tc.h.ServeConn(conn); err == nil {
+			t.Errorf("%s: ServeConn succeeded", tc.name)
+		}
+		if got := string(conn.Written()); got != tc.want {
+			t.Errorf("%s: client got %q, want %q", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestServeConnDefaultBackend(t *testing.T) {
+	for _, tc := range []struct {
+		name, req, want string
+	}{
+		{"no Host", "GET / HTTP/1.0\r\n\r\n", "default.example:8080"},
+		{"not allowed", request, "default.example:8080"},
+		{"allowed", "GET / HTTP/1.1\r\nHost: www.example.org\r\n\r\n", "www.example.org:80"},
+	} {
+		d := &fakeconn.Dialer{Backend: expectThenRespond(t, tc.req)}
+		h := &Handler{MakeDialer: d.MakeDialer, AllowedHostSuffixes: []string{".example.org"}, DefaultBackend: "default.example:8080"}
+		if err := serveRequest(h, tc.req); err != nil {
+			t.Errorf("%s: ServeConn: %v", tc.name, err)
+		}
+		if dialed := d.Dialed(); len(dialed) != 1 || dialed[0] != tc.want {
+			t.Errorf("%s: dialed %q, want [%s]", tc.name, dialed, tc.want)
+		}
+	}
+}
+
+func TestServeConnInvalidHost(t *testing.T) {
+	for _, host := range []string{"-example.com", "example..com", strings.Repeat("a", 64) + ".example", "exa mple.com"} {
+		d := &fakeconn.Dialer{}
+		conn := fakeconn.New(fakeconn.ClientAddr, []byte("GET / HTTP/1.1\r\nHost: "+host+"\r\n\r\n"))
+		conn.CloseInput()
+		if err := (&Handler{MakeDialer: d.MakeDialer}).ServeConn(conn); err == nil {
+			t.Errorf("ServeConn proxied invalid Host %q", host)
+		}
+		if dialed := d.Dialed(); len(dialed) != 0 {
+			t.Errorf("dialed %q for invalid Host %q", dialed, host)
+		}
+		if got := string(conn.Written()); got != badRequestResponse {
+			t.Errorf("Host %q: client got %q, want %q", host, got, badRequestResponse)
+		}
+	}
+}
+
+func TestServeConnNormalizesHost(t *testing.T) {
+	const req = "GET / HTTP/1.1\r\nHost: WWW.Example.COM.:8080\r\n\r\n"
+	d := &fakeconn.Dialer{Backend: expectThenRespond(t, req)}
+	h := &Handler{MakeDialer: d.MakeDialer, AllowedHostSuffixes: []string{".example.com"}}
+	if err := serveRequest(h, req); err != nil {
+		t.Fatalf("ServeConn: %v", err)
+	}
+	if dialed := d.Dialed(); len(dialed) != 1 || dialed[0] != "www.example.com:80" {
+		t.Errorf("dialed %q, want [www.example.com:80]", dialed)
+	}
+}
+
+func TestServeConnBackendsForHostFailover(t *testing.T) {
+	d := &fakeconn.Dialer{Backend: expectThenRespond(t, request), Refused: []string{"a.example:80"}}
+	h := &Handler{
+		MakeDialer: d.MakeDialer,
+		BackendsForHost: func(hostname string) []string {
+			return []string{"a.example:80", "b.example:80", "c.example:80"}
+		},
+	}
+	if err := serveRequest(h, request); err != nil {
+		t.Fatalf("ServeConn: %v", err)
+	}
+	if dialed := d.Dialed(); !reflect.DeepEqual(dialed, []string{"a.example:80", "b.example:80"}) {
+		t.Errorf("dialed %q, want [a.example:80 b.example:80]", dialed)
+	}
+}
+
+func TestServeConnStrictRouting(t *testing.T) {
+	backends := func(hostname string) []string {
+		if hostname == "routed.example" {
+			return []string{"backend.example:8080"}
+		}
+		return nil
+	}
+	for _, tc := range []struct {
+		host string
+		want []string
+	}{
+		{"routed.example", []string{"backend.example:8080"}},
+		{"unrouted.example", nil},
+	} {
+		req := "GET / HTTP/1.1\r\nHost: " + tc.host + "\r\n\r\n"
+		d := &fakeconn.Dialer{Backend: expectThenRespond(t, req)}
+		h := &Handler{MakeDialer: d.MakeDialer, StrictRouting: true, BackendsForHost: backends}
+		if err := serveRequest(h, req); (err == nil) != (tc.want != nil) {
+			t.Errorf("%s: ServeConn returned %v", tc.host, err)
+		}
+		if dialed := d.Dialed(); !reflect.DeepEqual(dialed, tc.want) {
+			t.Errorf("%s: dialed %q, want %q", tc.host, dialed, tc.want)
+		}
+	}
+}
+
+func TestWriteResponseGivesUp(t *testing.T) {
+	// Nothing reads from peer, so the write can never complete.
+	conn, peer := net.Pipe()
+	defer conn.Close()
+	defer peer.Close()
+
+	start := time.Now()
+	if err := writeResponse(conn, badGatewayResponse); err == nil {
+		t.Error("writeResponse to a client which never reads succeeded")
+	}
+	if elapsed := time.Since(start); elapsed > responseWriteTimeout+time.Second {
+		t.Errorf("writeResponse blocked for %v, want about %v", elapsed, responseWriteTimeout)
+	}
+}
+
+func TestServeConnRedirect(t *testing.T) {
+	d := &fakeconn.Dialer{}
+	h := &Handler{MakeDialer: d.MakeDialer, RedirectHosts: map[string]Redirect{"example.com": {URL: "https://example.net"}}}
+
+	conn := fakeconn.New(fakeconn.ClientAddr, []byte(request))
+	conn.CloseInput()
+	h.ServeConn(conn)
+	if dialed := d.Dialed(); len(dialed) != 0 {
+		t.Errorf("dialed %q for a redirected hostname", dialed)
+	}
+	if got := string(conn.Written()); !strings.Contains(got, "\r\nLocation: https://example.net/path\r\n") {
+		t.Errorf("client got %q, want a redirect to https://example.net/path", got)
+	}
+}
+
+func TestServeConnRedirectToHTTPS(t *testing.T) {
+	d := &fakeconn.Dialer{}
+	h := &Handler{MakeDialer: d.MakeDialer, RedirectToHTTPS: true}
+
+	conn := fakeconn.New(fakeconn.ClientAddr, []byte("GET /path?q=1 HTTP/1.1\r\nHost: Example.COM:80\r\n\r\n"))
+	conn.CloseInput()
+	if err := h.ServeConn(conn); err != nil {
+		t.Fatalf("ServeConn: %v", err)
+	}
+	if dialed := d.Dialed(); len(dialed) != 0 {
+		t.Errorf("dialed %q with RedirectToHTTPS set", dialed)
+	}
+	if got, want := string(conn.Written()), "HTTP/1.0 301 Moved Permanently\r\nLocation: https://example.com/path?q=1\r\n"; !strings.HasPrefix(got, want) {
+		t.Errorf("client got %q, want a response starting %q", got, want)
+	}
+}
+
+func TestServeConnMaxHeaderLines(t *testing.T) {
+	for _, tc := range []struct {
+		headers int
+		ok      bool
+	}{{3, true}, {4, false}} {
+		req := "GET / HTTP/1.1\r\nHost: example.com\r\n" + strings.Repeat("X-Filler: 1\r\n", tc.headers-1) + "\r\n"
+		d := &fakeconn.Dialer{Backend: expectThenRespond(t, req)}
+		h := &Handler{MakeDialer: d.MakeDialer, MaxHeaderLines: 3}
+		conn := fakeconn.New(fakeconn.ClientAddr, []byte(req))
+		conn.CloseInput()
+		err := h.ServeConn(conn)
+		if tc.ok {
+			if err != nil {
+				t.Errorf("%d header lines: ServeConn: %v", tc.headers, err)
+			}
+			continue
+		}
+		if err == nil {
+			t.Errorf("%d header lines: ServeConn succeeded, want a rejection", tc.headers)
+		}
+		if got := string(conn.Written()); got != headersTooLargeResponse {
+			t.Errorf("%d header lines: client got %q, want %q", tc.headers, got, headersTooLargeResponse)
+		}
+	}
+}
+
+func TestServeConnMaxHeaderBytes(t *testing.T) {
+	withHeader := func(n int) string {
+		return "GET / HTTP/1.1\r\nHost: example.com\r\nCookie: " + strings.Repeat("c", n) + "\r\n\r\n"
+	}
+	for _, tc := range []struct {
+		name           string
+		maxHeaderBytes int
+		req            string
+		ok             bool
+	}{
+		{"7KiB by default", 0, withHeader(7 << 10), true},
+		{"9KiB by default", 0, withHeader(9 << 10), false},
+		{"under MaxHeaderBytes", 1024, withHeader(900), true},
+		{"over MaxHeaderBytes in total", 1024, "GET / HTTP/1.1\r\nHost: example.com\r\n" + strings.Repeat("X-Filler: 1\r\n", 80) + "\r\n", false},
+		{"one line over MaxHeaderBytes", 1024, withHeader(2000), false},
+	} {
+		d := &fakeconn.Dialer{Backend: expectThenRespond(t, tc.req)}
+		h := &Handler{MakeDialer: d.MakeDialer, MaxHeaderBytes: tc.maxHeaderBytes}
+		conn := fakeconn.New(fakeconn.ClientAddr, []byte(tc.req))
+		conn.CloseInput()
+		err := h.ServeConn(conn)
+		if tc.ok {
+			if err != nil {
+				t.Errorf("%s: ServeConn: %v", tc.name, err)
+			}
+			continue
+		}
+		if err == nil {
+			t.Errorf("%s: ServeConn succeeded, want a rejection", tc.name)
+		}
+		if got := string(conn.Written()); got != headersTooLargeResponse {
+			t.Errorf("%s: client got %q, want %q", tc.name, got, headersTooLargeResponse)
+		}
+	}
+}
+
+func TestServeConnEstablishTimeoutSparesBreaker(t *testing.T) {
+	d := &fakeconn.Dialer{Hang: true}
+	cb := &fourtosix.CircuitBreaker{Threshold: 1, Cooldown: time.Hour}
+	h := &Handler{MakeDialer: d.MakeDialer, EstablishTimeout: 50 * time.Millisecond, CircuitBreaker: cb}
+
+	conn := fakeconn.New(fakeconn.ClientAddr, []byte(request))
+	conn.CloseInput()
+	if err := h.ServeConn(conn); err == nil {
+		t.Fatal("ServeConn succeeded with a dial which never completed")
+	}
+	if !cb.Allow("example.com:80") {
+		t.Error("a dial cut short by EstablishTimeout tripped the circuit breaker")
+	}
+}
+
+// h2cRequest returns the start of an HTTP/2 prior-knowledge connection: the preface and a HEADERS frame for
+// a request to authority.
+func h2cRequest(authority string) []byte {
+	var block bytes.Buffer
+	enc := hpack.NewEncoder(&block)
+	for _, f := range []hpack.HeaderField{
+		{Name: ":method", Value: "GET"},
+		{Name: ":scheme", Value: "http"},
+		{Name: ":authority", Value: authority},
+		{Name: ":path", Value: "/"},
+	} {
+		enc.WriteField(f)
+	}
+	n := block.Len()
+	frame := []byte{byte(n >> 16), byte(n >> 8), byte(n), h2FrameHeaders, h2FlagEndHeaders, 0, 0, 0, 1}
+	return append(append([]byte(h2cPreface), frame...), block.Bytes()...)
+}
+
+type recordingMetrics struct {
+	mu        sync.Mutex
+	rejected  []fourtosix.RejectReason
+	responded []int
+}
+
+func (m *recordingMetrics) ConnectionRejected(reason fourtosix.RejectReason) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.rejected = append(m.rejected, reason)
+}
+
+func (m *recordingMetrics) BackendFirstByte(time.Duration) {}
+func (m *recordingMetrics) BackendResponded(status int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.responded = append(m.responded, status)
+}
+
+func TestServeConnReportsRejections(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		h    *Handler
+		req  string
+		want fourtosix.RejectReason
+	}{
+		{"headers cut short", &Handler{}, "GET / HTTP/1.1\r\nHost: example.com\r\n", fourtosix.RejectMalformed},
+		{"no Host", &Handler{}, "GET / HTTP/1.0\r\n\r\n", fourtosix.RejectNoHostname},
+		{"not allowed", &Handler{AllowedHostSuffixes: []string{".example.org"}}, request, fourtosix.RejectHostnameNotAllowed},
+		{"dial failed", &Handler{MakeDialer: (&fakeconn.Dialer{Err: errors.New("unreachable")}).MakeDialer}, request, fourtosix.RejectDialFailed},
+		{"replay failed", &Handler{MakeDialer: (&fakeconn.Dialer{}).MakeDialer}, request, fourtosix.RejectReplayFailed},
+	} {
+		metrics := &recordingMetrics{}
+		tc.h.Metrics = metrics
+		if tc.h.MakeDialer == nil {
+			tc.h.MakeDialer = (&fakeconn.Dialer{}).MakeDialer
+		}
+		if err := serveRequest(tc.h, tc.req); err == nil {
+			t.Errorf("%s: ServeConn succeeded", tc.name)
+		}
+		if !reflect.DeepEqual(metrics.rejected, []fourtosix.RejectReason{tc.want}) {
+			t.Errorf("%s: ConnectionRejected called with %v, want [%v]", tc.name, metrics.rejected, tc.want)
+		}
+	}
+}
+
+func TestServeConnReportsStatus(t *testing.T) {
+	for _, tc := range []struct {
+		response string
+		want     int
+	}{
+		{"HTTP/1.1 404 Not Found\r\nContent-Length: 0\r\n\r\n", 404},
+		{"HTTP/1.0 204 No Content\r\n\r\n", 204},
+		{"SSH-2.0-OpenSSH\r\n", 0},
+	} {
+		d := &fakeconn.Dialer{Backend: func(conn net.Conn, _ string) {
+			io.ReadFull(conn, make([]byte, len(request)))
+			conn.Write([]byte(tc.response))
+		}}
+		metrics := &recordingMetrics{}
+		h := &Handler{MakeDialer: d.MakeDialer, Metrics: metrics}
+		if err := serveRequest(h, request); err != nil {
+			t.Fatalf("ServeConn: %v", err)
+		}
+		if !reflect.DeepEqual(metrics.responded, []int{tc.want}) {
+			t.Errorf("backend response %q: BackendResponded called with %v, want [%d]", tc.response, metrics.responded, tc.want)
+		}
+	}
+}
+
+func TestServeConnH2CSkipsStatus(t *testing.T) {
+	const settings = "\x00\x00\x00\x04\x00\x00\x00\x00\x00"
+	req := h2cRequest("example.com")
+	d := &fakeconn.Dialer{Backend: func(conn net.Conn, _ string) {
+		if _, err := io.ReadFull(conn, make([]byte, len(req))); err != nil {
+			t.Errorf("backend reading request: %v", err)
+			return
+		}
+		conn.Write([]byte(settings))
+	}}
+	var accessLog bytes.Buffer
+	metrics := &recordingMetrics{}
+	h := &Handler{MakeDialer: d.MakeDialer, AccessLog: &accessLog, Metrics: metrics}
+
+	conn := fakeconn.New(fakeconn.ClientAddr, req)
+	conn.CloseInput()
+	if err := h.ServeConn(conn); err != nil {
+		t.Fatalf("ServeConn: %v", err)
+	}
+	if got := string(conn.Written()); got != settings {
+		t.Errorf("client got %q, want the backend's SETTINGS frame", got)
+	}
+	if len(metrics.responded) != 0 {
+		t.Errorf("BackendResponded called with %v for an HTTP/2 connection", metrics.responded)
+	}
+	if got, want := accessLog.String(), `"PRI * HTTP/2.0" - 9`+"\n"; !strings.HasSuffix(got, want) {
+		t.Errorf("access log = %q, want a line ending %q", got, want)
+	}
+}
+
+func TestServeConnH2CRoutesByAuthority(t *testing.T) {
+	req := h2cRequest("WWW.Example.ORG:8080")
+	d := &fakeconn.Dialer{Backend: expectThenRespond(t, string(req))}
+	h := &Handler{MakeDialer: d.MakeDialer, AllowedHostSuffixes: []string{".example.org"}}
+	if err := serveRequest(h, string(req)); err != nil {
+		t.Fatalf("ServeConn: %v", err)
+	}
+	if dialed := d.Dialed(); len(dialed) != 1 || dialed[0] != "www.example.org:80" {
+		t.Errorf("dialed %q, want [www.example.org:80]", dialed)
+	}
+
+	d = &fakeconn.Dialer{}
+	h = &Handler{MakeDialer: d.MakeDialer, AllowedHostSuffixes: []string{".example.org"}}
+	if err := serveRequest(h, string(h2cRequest("example.com"))); err == nil {
+		t.Error("ServeConn proxied an h2c connection whose :authority isn't allowed")
+	}
+	if dialed := d.Dialed(); len(dialed) != 0 {
+		t.Errorf("dialed %q for an :authority which isn't allowed", dialed)
+	}
+}
+
+func TestServeConnRedirectEmitsClosed(t *testing.T) {
+	h := &Handler{RedirectToHTTPS: true}
+	events := h.Events()
+	conn := fakeconn.New(fakeconn.ClientAddr, []byte(request))
+	conn.CloseInput()
+	h.ServeConn(conn)
+
+	var last fourtosix.ConnEvent
+	for len(events) > 0 {
+		last = <-events
+	}
+	if last.Type != fourtosix.ConnClosed {
+		t.Errorf("last event was %v, want ConnClosed", last.Type)
+	}
+}
+
+func TestServeConnBadProxyHeaderEmitsClosed(t *testing.T) {
+	h := &Handler{
+		MakeDialer:         (&fakeconn.Dialer{}).MakeDialer,
+		TrustProxyProtocol: true,
+		TrustedProxies:     []net.IPNet{{IP: fakeconn.ClientAddr.IP, Mask: net.CIDRMask(32, 32)}},
+	}
+	events := h.Events()
+	conn := fakeconn.New(fakeconn.ClientAddr, []byte(request))
+	conn.CloseInput()
+	if err := h.ServeConn(conn); err == nil {
+		t.Fatal("ServeConn without a PROXY header succeeded")
+	}
+
+	var got []fourtosix.ConnEventType
+	for len(events) > 0 {
+		got = append(got, (<-events).Type)
+	}
+	if want := []fourtosix.ConnEventType{fourtosix.ConnAccepted, fourtosix.ConnRejected, fourtosix.ConnClosed}; !reflect.DeepEqual(got, want) {
+		t.Errorf("events %v, want %v", got, want)
+	}
+}
+
+func TestServeConnSilentDrop(t *testing.T) {
+	for _, req := range []string{"GET / HTTP/1.0\r\n\r\n", request} {
+		d := &fakeconn.Dialer{}
+		h := &Handler{MakeDialer: d.MakeDialer, AllowedHostSuffixes: []string{".example.org"}, SilentDrop: true}
+		conn := fakeconn.New(fakeconn.ClientAddr, []byte(req))
+		conn.CloseInput()
+		if err := h.ServeConn(conn); err == nil {
+			t.Errorf("%q: ServeConn succeeded", req)
+		}
+		if got := conn.Written(); len(got) != 0 {
+			t.Errorf("%q: client got %q, want nothing", req, got)
+		}
+		if !conn.Closed() {
+			t.Errorf("%q: connection left open", req)
+		}
+	}
+}
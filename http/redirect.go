@@ -0,0 +1,44 @@
+package http
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"time"
+)
+
+// Redirect describes a redirect sent in place of proxying a request.
+type Redirect struct {
+	// URL is the scheme and authority to redirect to, such as "https://example.com".
+	// The path and query of the original request are appended to it.
+	URL string
+
+	// Permanent selects a 301 Moved Permanently response rather than a 302 Found.
+	Permanent bool
+}
+
+// requestPath returns the path and query from an HTTP request line, or "/" if it doesn't have a usable one.
+func requestPath(requestLine string) string {
+	parts := strings.Split(requestLine, " ")
+	if len(parts) != 3 || !strings.HasPrefix(parts[1], "/") {
+		return "/"
+	}
+	for _, c := range parts[1] {
+		if c < 0x21 || c == 0x7f {
+			return "/"
+		}
+	}
+	return parts[1]
+}
+
+// writeRedirect sends a redirect to location, giving up if it can't be sent within responseWriteTimeout.
+// It returns the status code sent.
+func writeRedirect(conn net.Conn, location string, permanent bool) int {
+	status, reason := 302, "Found"
+	if permanent {
+		status, reason = 301, "Moved Permanently"
+	}
+	conn.SetWriteDeadline(time.Now().Add(responseWriteTimeout))
+	fmt.Fprintf(conn, "HTTP/1.0 %d %s\r\nLocation: %s\r\nContent-Length: 0\r\n\r\n", status, reason, location)
+	return status
+}
@@ -0,0 +1,65 @@
+package http
+
+import (
+	"bytes"
+	"net"
+	"strconv"
+	"sync"
+)
+
+// maxStatusLineBytes bounds how much of the response we'll look at to find the status line.
+const maxStatusLineBytes = 256
+
+// statusConn wraps a backend connection, watching the bytes read from it for an HTTP/1.x status line.
+// The bytes themselves pass through unaltered.
+type statusConn struct {
+	net.Conn
+
+	mu     sync.Mutex
+	line   []byte
+	done   bool
+	status int
+}
+
+func (sc *statusConn) Read(b []byte) (int, error) {
+	n, err := sc.Conn.Read(b)
+
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	if !sc.done && n > 0 {
+		sc.line = append(sc.line, b[:n]...)
+		if i := bytes.IndexByte(sc.line, '\n'); i >= 0 {
+			sc.status = parseStatusLine(sc.line[:i])
+			sc.done = true
+			sc.line = nil
+		} else if len(sc.line) > maxStatusLineBytes {
+			sc.done = true
+			sc.line = nil
+		}
+	}
+	return n, err
+}
+
+// Status returns the status code from the backend's status line, or 0 if none was seen.
+func (sc *statusConn) Status() int {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	return sc.status
+}
+
+// parseStatusLine returns the status code from a line like "HTTP/1.1 200 OK", or 0 if it isn't one.
+func parseStatusLine(line []byte) int {
+	line = bytes.TrimSuffix(line, []byte("\r"))
+	if !bytes.HasPrefix(line, []byte("HTTP/1.")) {
+		return 0
+	}
+	fields := bytes.SplitN(line, []byte(" "), 3)
+	if len(fields) < 2 || len(fields[1]) != 3 {
+		return 0
+	}
+	status, err := strconv.Atoi(string(fields[1]))
+	if err != nil || status < 100 {
+		return 0
+	}
+	return status
+}
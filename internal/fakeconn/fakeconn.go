@@ -0,0 +1,264 @@
+// Package fakeconn provides an in-memory net.Conn with a controllable remote address and
+// deadlines, for exercising the handlers without real sockets.
+package fakeconn
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/lukegb/fourtosix"
+)
+
+// ClientAddr is an address, from a range reserved for documentation, for fake connections to come from.
+var ClientAddr = &net.TCPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 1234}
+
+// Addr is a net.Addr with an arbitrary network and address, for simulating non-TCP peers.
+type Addr struct {
+	Net, Str string
+}
+
+func (a Addr) Network() string { return a.Net }
+func (a Addr) String() string  { return a.Str }
+
+// Conn is an in-memory net.Conn.
+// Reads are served from data supplied with Feed, blocking until more data arrives, CloseInput is called,
+// the connection is closed, or the read deadline passes. Writes are accumulated and available from Written.
+type Conn struct {
+	Local, Remote net.Addr
+
+	mu            sync.Mutex
+	cond          *sync.Cond
+	in, out       bytes.Buffer
+	inputClosed   bool
+	closed        bool
+	writesBlocked bool
+	readDeadline  time.Time
+	writeDeadline time.Time
+	readTimer     *time.Timer
+	writeTimer    *time.Timer
+}
+
+// New returns a Conn with the given remote address, which will yield input to readers.
+func New(remote net.Addr, input []byte) *Conn {
+	c := &Conn{
+		Local:  &net.TCPAddr{IP: net.IPv6loopback, Port: 443},
+		Remote: remote,
+	}
+	c.cond = sync.NewCond(&c.mu)
+	c.in.Write(input)
+	return c
+}
+
+// Feed makes more data available to readers.
+func (c *Conn) Feed(b []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.in.Write(b)
+	c.cond.Broadcast()
+}
+
+// CloseInput causes reads to return io.EOF once all fed data has been consumed.
+func (c *Conn) CloseInput() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.inputClosed = true
+	c.cond.Broadcast()
+}
+
+// BlockWrites makes writes block until the write deadline passes or the connection is closed,
+// as if the peer had stopped reading and the send buffer was full.
+func (c *Conn) BlockWrites(blocked bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.writesBlocked = blocked
+	c.cond.Broadcast()
+}
+
+// Written returns a copy of everything written to the connection so far.
+func (c *Conn) Written() []byte {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]byte(nil), c.out.Bytes()...)
+}
+
+// Closed reports whether Close has been called.
+func (c *Conn) Closed() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.closed
+}
+
+func expired(deadline time.Time) bool {
+	return !deadline.IsZero() && !time.Now().Before(deadline)
+}
+
+func (c *Conn) Read(b []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for {
+		switch {
+		case c.closed:
+			return 0, net.ErrClosed
+		case c.in.Len() > 0:
+			return c.in.Read(b)
+		case c.inputClosed:
+			return 0, io.EOF
+		case expired(c.readDeadline):
+			return 0, os.ErrDeadlineExceeded
+		}
+		c.cond.Wait()
+	}
+}
+
+func (c *Conn) Write(b []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for {
+		switch {
+		case c.closed:
+			return 0, net.ErrClosed
+		case expired(c.writeDeadline):
+			return 0, os.ErrDeadlineExceeded
+		case !c.writesBlocked:
+			return c.out.Write(b)
+		}
+		c.cond.Wait()
+	}
+}
+
+func (c *Conn) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return net.ErrClosed
+	}
+	c.closed = true
+	stopTimer(c.readTimer)
+	stopTimer(c.writeTimer)
+	c.cond.Broadcast()
+	return nil
+}
+
+func (c *Conn) LocalAddr() net.Addr  { return c.Local }
+func (c *Conn) RemoteAddr() net.Addr { return c.Remote }
+
+func stopTimer(t *time.Timer) {
+	if t != nil {
+		t.Stop()
+	}
+}
+
+// wakeAt replaces *timer with one which wakes blocked readers and writers at t, so that they notice the deadline.
+// It must be called with c.mu held.
+func (c *Conn) wakeAt(timer **time.Timer, t time.Time) {
+	c.cond.Broadcast()
+	stopTimer(*timer)
+	*timer = nil
+	if t.IsZero() {
+		return
+	}
+	*timer = time.AfterFunc(time.Until(t), func() {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		c.cond.Broadcast()
+	})
+}
+
+func (c *Conn) SetDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.readDeadline = t
+	c.writeDeadline = t
+	c.wakeAt(&c.readTimer, t)
+	c.wakeAt(&c.writeTimer, t)
+	return nil
+}
+
+func (c *Conn) SetReadDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.readDeadline = t
+	c.wakeAt(&c.readTimer, t)
+	return nil
+}
+
+func (c *Conn) SetWriteDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.writeDeadline = t
+	c.wakeAt(&c.writeTimer, t)
+	return nil
+}
+
+// Dialer connects to an in-memory backend instead of the network, recording the address of each dial.
+// Each connection is one end of a net.Pipe; the other end is passed to Backend, which runs in its own goroutine.
+type Dialer struct {
+	// Backend serves each connection made by the Dialer. If nil, connections are closed straight away.
+	Backend func(conn net.Conn, address string)
+	// Err, if set, is returned from every dial in place of a connection.
+	Err error
+	// Refused lists addresses whose dials fail with ECONNREFUSED, as if nothing were listening there.
+	Refused []string
+	// Hang, if set, makes every dial wait until its context is done, as if the backend weren't answering.
+	Hang bool
+	// Local, if set, is the LocalAddr of each connection, like the source address a real dial binds.
+	Local net.Addr
+
+	mu     sync.Mutex
+	dialed []string
+}
+
+func (d *Dialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	d.mu.Lock()
+	d.dialed = append(d.dialed, address)
+	d.mu.Unlock()
+	if d.Hang {
+		<-ctx.Done()
+		return nil, ctx.Err()
+	}
+	if d.Err != nil {
+		return nil, d.Err
+	}
+	for _, a := range d.Refused {
+		if a == address {
+			return nil, &net.OpError{Op: "dial", Net: network, Err: syscall.ECONNREFUSED}
+		}
+	}
+	client, backend := net.Pipe()
+	go func() {
+		defer backend.Close()
+		if d.Backend != nil {
+			d.Backend(backend, address)
+		}
+	}()
+	if d.Local != nil {
+		return localConn{client, d.Local}, nil
+	}
+	return client, nil
+}
+
+// localConn is a net.Conn with its LocalAddr replaced.
+type localConn struct {
+	net.Conn
+	local net.Addr
+}
+
+func (c localConn) LocalAddr() net.Addr { return c.local }
+
+// MakeDialer returns d whatever the connection, so that it can be used as a handler's MakeDialer.
+func (d *Dialer) MakeDialer(net.Conn, fourtosix.Context) fourtosix.Dialer {
+	return d
+}
+
+// Dialed returns the addresses dialed so far.
+func (d *Dialer) Dialed() []string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return append([]string(nil), d.dialed...)
+}
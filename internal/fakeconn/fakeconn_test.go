@@ -0,0 +1,151 @@
+package fakeconn
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestReadFedData(t *testing.T) {
+	c := New(ClientAddr, []byte("hello"))
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		c.Feed([]byte(" world"))
+		c.CloseInput()
+	}()
+	got, err := io.ReadAll(c)
+	if err != nil {
+		t.Fatalf("ReadAll: %v", err)
+	}
+	if string(got) != "hello world" {
+		t.Errorf("read %q, want %q", got, "hello world")
+	}
+	if c.RemoteAddr() != ClientAddr {
+		t.Errorf("RemoteAddr = %v, want %v", c.RemoteAddr(), ClientAddr)
+	}
+}
+
+func TestWritten(t *testing.T) {
+	c := New(ClientAddr, nil)
+	c.Write([]byte("abc"))
+	c.Write([]byte("def"))
+	if got := string(c.Written()); got != "abcdef" {
+		t.Errorf("Written = %q, want %q", got, "abcdef")
+	}
+}
+
+func TestReadDeadline(t *testing.T) {
+	c := New(ClientAddr, nil)
+	c.SetReadDeadline(time.Now().Add(20 * time.Millisecond))
+	start := time.Now()
+	_, err := c.Read(make([]byte, 1))
+	if !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("Read: got %v, want %v", err, os.ErrDeadlineExceeded)
+	}
+	if d := time.Since(start); d < 20*time.Millisecond {
+		t.Errorf("Read returned after %v, before the deadline", d)
+	}
+
+	// Clearing the deadline makes reads block again.
+	c.SetReadDeadline(time.Time{})
+	c.Feed([]byte("x"))
+	if n, err := c.Read(make([]byte, 1)); n != 1 || err != nil {
+		t.Errorf("Read after clearing deadline = %d, %v", n, err)
+	}
+}
+
+func TestWriteDeadlineWhileBlocked(t *testing.T) {
+	c := New(ClientAddr, nil)
+	c.BlockWrites(true)
+	c.SetWriteDeadline(time.Now().Add(20 * time.Millisecond))
+	if _, err := c.Write([]byte("x")); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("Write: got %v, want %v", err, os.ErrDeadlineExceeded)
+	}
+	if len(c.Written()) != 0 {
+		t.Errorf("blocked write was recorded")
+	}
+}
+
+func TestDeadlineTimersReplaced(t *testing.T) {
+	c := New(ClientAddr, nil)
+	for i := 0; i < 100; i++ {
+		c.SetReadDeadline(time.Now().Add(time.Hour))
+	}
+	c.mu.Lock()
+	active := c.readTimer.Stop()
+	c.mu.Unlock()
+	if !active {
+		t.Errorf("latest read deadline timer is not active")
+	}
+}
+
+func TestCloseUnblocksRead(t *testing.T) {
+	c := New(ClientAddr, nil)
+	done := make(chan error)
+	go func() {
+		_, err := c.Read(make([]byte, 1))
+		done <- err
+	}()
+	time.Sleep(10 * time.Millisecond)
+	c.Close()
+	select {
+	case err := <-done:
+		if !errors.Is(err, net.ErrClosed) {
+			t.Errorf("Read after Close: got %v, want %v", err, net.ErrClosed)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Read still blocked after Close")
+	}
+	if !c.Closed() {
+		t.Error("Closed = false after Close")
+	}
+}
+
+func TestDialer(t *testing.T) {
+	d := &Dialer{Backend: func(conn net.Conn, address string) {
+		conn.Write([]byte(address))
+	}}
+	conn, err := d.DialContext(context.Background(), "tcp", "example.com:443")
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, _ := io.ReadAll(conn)
+	if string(got) != "example.com:443" {
+		t.Errorf("backend wrote %q, want the dialed address", got)
+	}
+	if dialed := d.Dialed(); len(dialed) != 1 || dialed[0] != "example.com:443" {
+		t.Errorf("Dialed = %q", dialed)
+	}
+
+	d.Local = &net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 40000}
+	conn, err = d.DialContext(context.Background(), "tcp", "example.com:443")
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+	if conn.LocalAddr() != d.Local {
+		t.Errorf("LocalAddr = %v, want %v", conn.LocalAddr(), d.Local)
+	}
+
+	d.Refused = []string{"refused.example:443"}
+	if _, err := d.DialContext(context.Background(), "tcp", "refused.example:443"); !errors.Is(err, syscall.ECONNREFUSED) {
+		t.Errorf("dial to a Refused address: got %v, want %v", err, syscall.ECONNREFUSED)
+	}
+
+	d.Err = errors.New("unreachable")
+	if _, err := d.DialContext(context.Background(), "tcp", "example.com:443"); err != d.Err {
+		t.Errorf("dial with Err set: got %v, want %v", err, d.Err)
+	}
+
+	d.Hang = true
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, err := d.DialContext(ctx, "tcp", "example.com:443"); err != context.DeadlineExceeded {
+		t.Errorf("dial with Hang set: got %v, want %v", err, context.DeadlineExceeded)
+	}
+}
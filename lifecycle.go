@@ -0,0 +1,94 @@
+package fourtosix
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+)
+
+// ErrHandlerClosed is returned by a handler's Serve method after it has been shut down.
+var ErrHandlerClosed = errors.New("fourtosix: handler closed")
+
+// Lifecycle tracks the listeners a handler is serving on and the context its connections run under,
+// so that the handler can be shut down. The zero value is ready to use.
+type Lifecycle struct {
+	mu        sync.Mutex
+	ctx       context.Context
+	cancel    context.CancelFunc
+	listeners map[net.Listener]struct{}
+	shutdown  bool
+}
+
+func (l *Lifecycle) init() {
+	if l.ctx == nil {
+		l.ctx, l.cancel = context.WithCancel(context.Background())
+		l.listeners = make(map[net.Listener]struct{})
+	}
+}
+
+// Context returns a context which is cancelled when Shutdown is called.
+func (l *Lifecycle) Context() context.Context {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.init()
+	return l.ctx
+}
+
+// AddListener registers a listener to be closed on Shutdown or Drain.
+// It returns ErrHandlerClosed if either has already been called.
+func (l *Lifecycle) AddListener(ln net.Listener) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.init()
+	if l.shutdown {
+		return ErrHandlerClosed
+	}
+	l.listeners[ln] = struct{}{}
+	return nil
+}
+
+// RemoveListener unregisters a listener previously passed to AddListener.
+func (l *Lifecycle) RemoveListener(ln net.Listener) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	delete(l.listeners, ln)
+}
+
+// ShuttingDown reports whether Shutdown or Drain has been called.
+func (l *Lifecycle) ShuttingDown() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.shutdown
+}
+
+// Drain closes all registered listeners, but leaves in-flight connections running until they finish
+// or Shutdown is called.
+func (l *Lifecycle) Drain() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.init()
+	return l.closeListeners()
+}
+
+// Shutdown closes all registered listeners and cancels the context, which terminates in-flight connections.
+func (l *Lifecycle) Shutdown() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.init()
+	err := l.closeListeners()
+	l.cancel()
+	return err
+}
+
+func (l *Lifecycle) closeListeners() error {
+	l.shutdown = true
+	var firstErr error
+	for ln := range l.listeners {
+		if err := ln.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+		delete(l.listeners, ln)
+	}
+	return firstErr
+}
@@ -2,6 +2,11 @@ package fourtosix
 
 import "io"
 
+// MemorizingReader records everything read through it from Reader.
+//
+// Handlers parse the start of a connection through a MemorizingReader, possibly with more buffering on top,
+// then send Buffer to the backend before relaying directly from the connection. Since Buffer holds every byte
+// taken from the connection, including any read ahead of what the parser needed, nothing the client sent is lost.
 type MemorizingReader struct {
 	Reader io.Reader
 	buf    []byte
@@ -13,6 +18,7 @@ func (mr *MemorizingReader) Read(b []byte) (n int, err error) {
 	return n, err
 }
 
+// Buffer returns all the bytes read so far.
 func (mr *MemorizingReader) Buffer() []byte {
 	return mr.buf
 }
@@ -0,0 +1,40 @@
+package fourtosix
+
+import "time"
+
+// RejectReason categorises why a connection was turned away before being proxied.
+type RejectReason string
+
+const (
+	// RejectMalformed is used when the client sent something we couldn't parse.
+	RejectMalformed RejectReason = "malformed"
+	// RejectOversized is used when the client's handshake or headers exceeded our limits.
+	RejectOversized RejectReason = "oversized"
+	// RejectNoHostname is used when the client didn't tell us where it wanted to go.
+	RejectNoHostname RejectReason = "no_hostname"
+	// RejectHostnameNotAllowed is used when the requested hostname failed the allowlist.
+	RejectHostnameNotAllowed RejectReason = "hostname_not_allowed"
+	// RejectPolicy is used when the connection was refused by some other configured policy.
+	RejectPolicy RejectReason = "policy"
+	// RejectOverCapacity is used when a configured connection limit has been reached.
+	RejectOverCapacity RejectReason = "over_capacity"
+	// RejectDialFailed is used when we couldn't connect to the backend.
+	RejectDialFailed RejectReason = "dial_failed"
+	// RejectReplayFailed is used when the backend accepted the connection but closed it before the client's
+	// handshake or request could be passed on.
+	RejectReplayFailed RejectReason = "replay_failed"
+)
+
+// Metrics receives notifications about the connections a handler processes.
+// Implementations must be safe for concurrent use.
+type Metrics interface {
+	// ConnectionRejected is called each time a connection is rejected.
+	ConnectionRejected(reason RejectReason)
+
+	// BackendResponded is called by the HTTP handler once a proxied HTTP/1.x connection closes, with the status code
+	// from the backend's first response, or 0 if the backend never sent a valid status line.
+	BackendResponded(status int)
+
+	// BackendFirstByte is called with the time between connecting to a backend and receiving its first byte.
+	BackendFirstByte(ttfb time.Duration)
+}
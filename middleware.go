@@ -0,0 +1,18 @@
+package fourtosix
+
+import "net"
+
+// ConnHandler serves a single connection, returning why it was rejected, if it was.
+// Each handler's ServeConn method is a ConnHandler.
+type ConnHandler func(net.Conn) error
+
+// Middleware wraps a ConnHandler to add behaviour around it, such as logging or authorization.
+type Middleware func(ConnHandler) ConnHandler
+
+// Chain wraps h in mw, such that mw[0] is the outermost and sees each connection first.
+func Chain(h ConnHandler, mw ...Middleware) ConnHandler {
+	for i := len(mw) - 1; i >= 0; i-- {
+		h = mw[i](h)
+	}
+	return h
+}
@@ -0,0 +1,71 @@
+//go:build linux
+
+package fourtosix
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"syscall"
+)
+
+// soOriginalDst is SO_ORIGINAL_DST from linux/netfilter_ipv4.h, which shares its value with
+// IP6T_SO_ORIGINAL_DST from linux/netfilter_ipv6/ip6_tables.h.
+const soOriginalDst = 80
+
+// OriginalDestination returns the address conn was originally destined for before it was redirected to us
+// by netfilter (e.g. with an iptables REDIRECT or DNAT rule).
+func OriginalDestination(conn net.Conn) (*net.TCPAddr, error) {
+	tc, ok := conn.(*net.TCPConn)
+	if !ok {
+		return nil, fmt.Errorf("original destination is only available for TCP connections, not %T", conn)
+	}
+	raw, err := tc.SyscallConn()
+	if err != nil {
+		return nil, err
+	}
+
+	isV4 := false
+	if la, ok := tc.LocalAddr().(*net.TCPAddr); ok && la.IP.To4() != nil {
+		isV4 = true
+	}
+
+	var addr *net.TCPAddr
+	var sockErr error
+	err = raw.Control(func(fd uintptr) {
+		if isV4 {
+			// The kernel writes a struct sockaddr_in, which fits in the struct ip_mreq-sized buffer.
+			var mreq *syscall.IPv6Mreq
+			mreq, sockErr = syscall.GetsockoptIPv6Mreq(int(fd), syscall.SOL_IP, soOriginalDst)
+			if sockErr != nil {
+				return
+			}
+			addr = &net.TCPAddr{
+				IP:   net.IPv4(mreq.Multiaddr[4], mreq.Multiaddr[5], mreq.Multiaddr[6], mreq.Multiaddr[7]),
+				Port: int(binary.BigEndian.Uint16(mreq.Multiaddr[2:4])),
+			}
+			return
+		}
+
+		// The kernel writes a struct sockaddr_in6, which is the first field of struct ip6_mtuinfo.
+		var info *syscall.IPv6MTUInfo
+		info, sockErr = syscall.GetsockoptIPv6MTUInfo(int(fd), syscall.SOL_IPV6, soOriginalDst)
+		if sockErr != nil {
+			return
+		}
+		// Port is in network byte order, but was loaded as a native integer.
+		var port [2]byte
+		binary.NativeEndian.PutUint16(port[:], info.Addr.Port)
+		addr = &net.TCPAddr{
+			IP:   append(net.IP(nil), info.Addr.Addr[:]...),
+			Port: int(binary.BigEndian.Uint16(port[:])),
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	if sockErr != nil {
+		return nil, fmt.Errorf("getsockopt SO_ORIGINAL_DST: %w", sockErr)
+	}
+	return addr, nil
+}
@@ -0,0 +1,37 @@
+//go:build linux
+
+package fourtosix
+
+import (
+	"net"
+	"testing"
+)
+
+func TestOriginalDestinationWithoutRedirect(t *testing.T) {
+	conn, peer := net.Pipe()
+	defer conn.Close()
+	defer peer.Close()
+	if dst, err := OriginalDestination(conn); err == nil {
+		t.Errorf("OriginalDestination of a pipe = %v, want an error", dst)
+	}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	c, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	accepted, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer accepted.Close()
+	// The connection wasn't redirected by netfilter, so there is no original destination to report.
+	if dst, err := OriginalDestination(accepted); err == nil {
+		t.Errorf("OriginalDestination of a connection which wasn't redirected = %v, want an error", dst)
+	}
+}
@@ -0,0 +1,14 @@
+//go:build !linux
+
+package fourtosix
+
+import (
+	"errors"
+	"net"
+)
+
+// OriginalDestination returns the address conn was originally destined for before it was redirected to us.
+// It is only supported on Linux.
+func OriginalDestination(conn net.Conn) (*net.TCPAddr, error) {
+	return nil, errors.New("original destination is only supported on Linux")
+}
@@ -0,0 +1,184 @@
+package fourtosix
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"time"
+)
+
+// ConnectionPool is a Dialer which keeps backend connections established in advance, so that a proxied
+// connection can be handed one immediately rather than waiting for a dial. Connections aren't returned to the pool
+// once used, since whatever was relayed over them leaves them in an unknown state; instead, the pool dials
+// replacements in the background. This only suits backends where a fresh connection may sit unused for a while,
+// such as tunnel endpoints. Since connections are dialed before the client is known, the pool can't be used to
+// connect from a per-client source address. It is safe for concurrent use.
+type ConnectionPool struct {
+	// Dialer is used to establish connections. If nil, DefaultDialer is used.
+	Dialer Dialer
+
+	// MaxIdle is the number of connections kept ready for each backend address which has been dialed.
+	// If zero, the pool keeps no connections and every dial goes straight to Dialer.
+	MaxIdle int
+
+	// MaxIdleTime, if positive, is how long a connection may wait in the pool before it is closed and replaced.
+	MaxIdleTime time.Duration
+
+	// HealthCheck, if set, is called on each idle connection before it is handed out; connections for which it
+	// returns an error are closed and skipped. If nil, connections the backend has closed or sent data on are skipped.
+	HealthCheck func(net.Conn) error
+
+	mu      sync.Mutex
+	idle    map[poolKey][]pooledConn
+	filling map[poolKey]bool
+	closed  bool
+}
+
+type poolKey struct {
+	network, address string
+}
+
+type pooledConn struct {
+	net.Conn
+	since time.Time
+}
+
+// errPoolClosed is returned by dials made after Close.
+var errPoolClosed = errors.New("connection pool closed")
+
+// DialContext returns an idle connection to address if a healthy one is available, and dials one otherwise.
+// Either way, the pool is topped back up to MaxIdle connections in the background.
+func (p *ConnectionPool) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	key := poolKey{network, address}
+	for {
+		pc, ok, err := p.take(key)
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			break
+		}
+		if p.MaxIdleTime > 0 && time.Since(pc.since) > p.MaxIdleTime {
+			pc.Close()
+			continue
+		}
+		if err := p.healthCheck(pc.Conn); err != nil {
+			pc.Close()
+			continue
+		}
+		p.refill(key)
+		return pc.Conn, nil
+	}
+	p.refill(key)
+	return p.dialer().DialContext(ctx, network, address)
+}
+
+// take removes the most recently established idle connection for key from the pool, if there is one.
+func (p *ConnectionPool) take(key poolKey) (pooledConn, bool, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.closed {
+		return pooledConn{}, false, errPoolClosed
+	}
+	conns := p.idle[key]
+	if len(conns) == 0 {
+		return pooledConn{}, false, nil
+	}
+	pc := conns[len(conns)-1]
+	p.idle[key] = conns[:len(conns)-1]
+	return pc, true, nil
+}
+
+// refill starts dialing connections for key until MaxIdle are idle, unless that's already under way.
+func (p *ConnectionPool) refill(key poolKey) {
+	if p.MaxIdle <= 0 {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.closed || p.filling[key] {
+		return
+	}
+	if p.filling == nil {
+		p.filling = make(map[poolKey]bool)
+	}
+	p.filling[key] = true
+	go p.fill(key)
+}
+
+func (p *ConnectionPool) fill(key poolKey) {
+	defer func() {
+		p.mu.Lock()
+		delete(p.filling, key)
+		p.mu.Unlock()
+	}()
+	for {
+		p.mu.Lock()
+		full := p.closed || len(p.idle[key]) >= p.MaxIdle
+		p.mu.Unlock()
+		if full {
+			return
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), dialTimeout)
+		conn, err := p.dialer().DialContext(ctx, key.network, key.address)
+		cancel()
+		if err != nil {
+			// The next DialContext will try again.
+			return
+		}
+
+		p.mu.Lock()
+		if p.closed {
+			p.mu.Unlock()
+			conn.Close()
+			return
+		}
+		if p.idle == nil {
+			p.idle = make(map[poolKey][]pooledConn)
+		}
+		p.idle[key] = append(p.idle[key], pooledConn{Conn: conn, since: time.Now()})
+		p.mu.Unlock()
+	}
+}
+
+func (p *ConnectionPool) dialer() Dialer {
+	if p.Dialer != nil {
+		return p.Dialer
+	}
+	return DefaultDialer
+}
+
+func (p *ConnectionPool) healthCheck(conn net.Conn) error {
+	if p.HealthCheck != nil {
+		return p.HealthCheck(conn)
+	}
+	// A read which times out immediately means the backend hasn't closed the connection or sent anything.
+	conn.SetReadDeadline(time.Now())
+	var b [1]byte
+	_, err := conn.Read(b[:])
+	var zero time.Time
+	conn.SetReadDeadline(zero)
+	if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		return nil
+	}
+	if err == nil {
+		return errors.New("unexpected data on idle connection")
+	}
+	return err
+}
+
+// Close closes all idle connections, and stops the pool from making more. Later dials fail.
+func (p *ConnectionPool) Close() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.closed = true
+	for key, conns := range p.idle {
+		for _, pc := range conns {
+			pc.Close()
+		}
+		delete(p.idle, key)
+	}
+	return nil
+}
@@ -0,0 +1,92 @@
+package fourtosix
+
+import (
+	"context"
+	"errors"
+	"net"
+	"os"
+	"sync"
+	"testing"
+	"time"
+)
+
+// pipeDialer dials by creating a net.Pipe, keeping the backend end of each so tests can act as the backend.
+type pipeDialer struct {
+	mu    sync.Mutex
+	conns []net.Conn
+	peers []net.Conn
+}
+
+func (d *pipeDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	conn, peer := net.Pipe()
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.conns = append(d.conns, conn)
+	d.peers = append(d.peers, peer)
+	return conn, nil
+}
+
+// waitForDials waits until d has made n dials, returning the backend ends of their connections.
+func (d *pipeDialer) waitForDials(t *testing.T, n int) []net.Conn {
+	t.Helper()
+	for start := time.Now(); time.Since(start) < time.Second; time.Sleep(time.Millisecond) {
+		d.mu.Lock()
+		peers := append([]net.Conn(nil), d.peers...)
+		d.mu.Unlock()
+		if len(peers) >= n {
+			return peers
+		}
+	}
+	t.Fatalf("pool made fewer than %d dials", n)
+	return nil
+}
+
+func (d *pipeDialer) conn(i int) net.Conn {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.conns[i]
+}
+
+func TestConnectionPool(t *testing.T) {
+	d := &pipeDialer{}
+	p := &ConnectionPool{Dialer: d, MaxIdle: 2}
+	ctx := context.Background()
+
+	// The first dial can't be served from the empty pool, but fills it for next time.
+	conn, err := p.DialContext(ctx, "tcp", "backend.example:443")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	peers := d.waitForDials(t, 3)
+	// Give the last dial time to land in the pool.
+	time.Sleep(10 * time.Millisecond)
+	if conn != d.conn(0) {
+		t.Error("first dial didn't go straight to the Dialer")
+	}
+
+	// The newest idle connection has been closed by the backend, so the older one is handed out instead.
+	peers[2].Close()
+	conn, err = p.DialContext(ctx, "tcp", "backend.example:443")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if conn != d.conn(1) {
+		t.Error("dial wasn't served by the healthy idle connection")
+	}
+
+	// Once topped back up, Close closes the idle connections and fails later dials.
+	peers = d.waitForDials(t, 5)
+	time.Sleep(10 * time.Millisecond)
+	p.Close()
+	for _, peer := range peers[3:] {
+		peer.SetReadDeadline(time.Now().Add(time.Second))
+		if _, err := peer.Read(make([]byte, 1)); err == nil || errors.Is(err, os.ErrDeadlineExceeded) {
+			t.Errorf("idle connection still open after Close: read error %v", err)
+		}
+	}
+	if _, err := p.DialContext(ctx, "tcp", "backend.example:443"); !errors.Is(err, errPoolClosed) {
+		t.Errorf("dial after Close = %v, want %v", err, errPoolClosed)
+	}
+}
@@ -0,0 +1,64 @@
+package fourtosix
+
+import (
+	"context"
+	"fmt"
+	"net"
+)
+
+// PreferIPv6Dialer resolves backend hostnames itself and dials their IPv6 addresses, only falling back to IPv4
+// if a hostname has no IPv6 addresses at all.
+type PreferIPv6Dialer struct {
+	// Resolver is used to look up backend hostnames. If nil, net.DefaultResolver is used.
+	Resolver Resolver
+
+	// Dialer is used to make the connection once an address has been chosen. If nil, DefaultDialer is used.
+	Dialer Dialer
+}
+
+func (d *PreferIPv6Dialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	dialer := d.Dialer
+	if dialer == nil {
+		dialer = DefaultDialer
+	}
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+	if net.ParseIP(host) != nil {
+		return dialer.DialContext(ctx, network, address)
+	}
+
+	resolver := d.Resolver
+	if resolver == nil {
+		resolver = net.DefaultResolver
+	}
+	addrs, err := resolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	var v6, v4 []net.IP
+	for _, addr := range addrs {
+		if addr.IP.To4() == nil {
+			v6 = append(v6, addr.IP)
+		} else {
+			v4 = append(v4, addr.IP)
+		}
+	}
+	candidates := v6
+	if len(candidates) == 0 {
+		candidates = v4
+	}
+	if len(candidates) == 0 {
+		return nil, fmt.Errorf("no addresses found for %s", host)
+	}
+
+	for _, ip := range candidates {
+		var conn net.Conn
+		conn, err = dialer.DialContext(ctx, network, net.JoinHostPort(ip.String(), port))
+		if err == nil {
+			return conn, nil
+		}
+	}
+	return nil, err
+}
@@ -0,0 +1,33 @@
+package fourtosix
+
+import (
+	"context"
+	"reflect"
+	"testing"
+)
+
+func TestPreferIPv6Dialer(t *testing.T) {
+	resolver := staticResolver{
+		"dual.example":   {"192.0.2.1", "2001:db8::1", "192.0.2.2", "2001:db8::2"},
+		"v4only.example": {"192.0.2.1", "192.0.2.2"},
+	}
+	for _, tc := range []struct {
+		address string
+		want    []string
+	}{
+		// Every IPv6 address is tried, in order, before giving up; the IPv4 ones never are.
+		{"dual.example:443", []string{"[2001:db8::1]:443", "[2001:db8::2]:443"}},
+		{"v4only.example:443", []string{"192.0.2.1:443", "192.0.2.2:443"}},
+		{"192.0.2.9:443", []string{"192.0.2.9:443"}},
+		{"unknown.example:443", nil},
+	} {
+		rec := &addressRecorder{}
+		d := &PreferIPv6Dialer{Resolver: resolver, Dialer: rec}
+		if _, err := d.DialContext(context.Background(), "tcp", tc.address); err == nil {
+			t.Errorf("dialing %s succeeded with a Dialer which always fails", tc.address)
+		}
+		if !reflect.DeepEqual(rec.dialed, tc.want) {
+			t.Errorf("dialing %s dialed %q, want %q", tc.address, rec.dialed, tc.want)
+		}
+	}
+}
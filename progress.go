@@ -0,0 +1,44 @@
+package fourtosix
+
+import (
+	"io"
+	"net"
+	"time"
+)
+
+// ProgressReader reads from Conn, pushing its read deadline back to Progress from now whenever data arrives,
+// but never past Deadline. This lets slow clients which are still making progress finish, while still
+// bounding how long they can take overall.
+type ProgressReader struct {
+	Conn     net.Conn
+	Progress time.Duration
+	Deadline time.Time
+}
+
+// NewProgressReader sets conn's read deadline and returns a ProgressReader for it.
+// If progress is zero, the returned reader simply reads from conn with deadline as its read deadline.
+func NewProgressReader(conn net.Conn, progress time.Duration, deadline time.Time) io.Reader {
+	if progress <= 0 {
+		conn.SetReadDeadline(deadline)
+		return conn
+	}
+	pr := &ProgressReader{Conn: conn, Progress: progress, Deadline: deadline}
+	pr.extend()
+	return pr
+}
+
+func (pr *ProgressReader) extend() {
+	d := time.Now().Add(pr.Progress)
+	if d.After(pr.Deadline) {
+		d = pr.Deadline
+	}
+	pr.Conn.SetReadDeadline(d)
+}
+
+func (pr *ProgressReader) Read(b []byte) (int, error) {
+	n, err := pr.Conn.Read(b)
+	if n > 0 {
+		pr.extend()
+	}
+	return n, err
+}
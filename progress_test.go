@@ -0,0 +1,53 @@
+package fourtosix
+
+import (
+	"errors"
+	"net"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestProgressReader(t *testing.T) {
+	conn, peer := net.Pipe()
+	defer conn.Close()
+	defer peer.Close()
+	go func() {
+		// Each byte arrives within the progress timeout, though together they take longer than it.
+		for i := 0; i < 5; i++ {
+			time.Sleep(20 * time.Millisecond)
+			peer.Write([]byte{'x'})
+		}
+	}()
+
+	r := NewProgressReader(conn, 60*time.Millisecond, time.Now().Add(5*time.Second))
+	b := make([]byte, 1)
+	for i := 0; i < 5; i++ {
+		if _, err := r.Read(b); err != nil {
+			t.Fatalf("read %d: %v", i, err)
+		}
+	}
+	start := time.Now()
+	if _, err := r.Read(b); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("read once the client went quiet: got %v, want %v", err, os.ErrDeadlineExceeded)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("read once the client went quiet took %v, want about the 60ms progress timeout", elapsed)
+	}
+}
+
+func TestProgressReaderDeadline(t *testing.T) {
+	conn, peer := net.Pipe()
+	defer conn.Close()
+	defer peer.Close()
+
+	// The absolute deadline comes before the progress timeout would.
+	start := time.Now()
+	r := NewProgressReader(conn, time.Minute, start.Add(50*time.Millisecond))
+	if _, err := r.Read(make([]byte, 1)); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("got %v, want %v", err, os.ErrDeadlineExceeded)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("read took %v, want about the 50ms deadline", elapsed)
+	}
+}
@@ -0,0 +1,163 @@
+package fourtosix
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+)
+
+const (
+	proxyV1Prefix    = "PROXY "
+	proxyV1MaxLength = 107
+	proxyV2Signature = "\r\n\r\n\x00\r\nQUIT\n"
+)
+
+// proxiedConn is a net.Conn which reports the client address from a PROXY protocol header as its RemoteAddr.
+type proxiedConn struct {
+	net.Conn
+	remote net.Addr
+}
+
+func (c *proxiedConn) RemoteAddr() net.Addr {
+	return c.remote
+}
+
+// NetConn returns the underlying connection.
+func (c *proxiedConn) NetConn() net.Conn {
+	return c.Conn
+}
+
+// PeerIsTrusted reports whether peer is a TCP address within one of trusted.
+// An empty trusted list trusts no peers.
+func PeerIsTrusted(trusted []net.IPNet, peer net.Addr) bool {
+	tcpAddr, ok := peer.(*net.TCPAddr)
+	if !ok {
+		return false
+	}
+	for _, n := range trusted {
+		if n.Contains(tcpAddr.IP) {
+			return true
+		}
+	}
+	return false
+}
+
+// ReadProxyHeader reads a PROXY protocol (v1 or v2) header from conn, consuming exactly the bytes of the header.
+// It returns a net.Conn whose RemoteAddr is the source address from the header,
+// or conn itself if the header doesn't carry an address (UNKNOWN or LOCAL).
+func ReadProxyHeader(conn net.Conn) (net.Conn, error) {
+	var first [1]byte
+	if _, err := io.ReadFull(conn, first[:]); err != nil {
+		return nil, err
+	}
+
+	var src net.Addr
+	var err error
+	switch first[0] {
+	case proxyV1Prefix[0]:
+		src, err = readProxyV1(conn)
+	case proxyV2Signature[0]:
+		src, err = readProxyV2(conn)
+	default:
+		err = fmt.Errorf("connection doesn't start with a PROXY header")
+	}
+	if err != nil {
+		return nil, err
+	}
+	if src == nil {
+		return conn, nil
+	}
+	return &proxiedConn{Conn: conn, remote: src}, nil
+}
+
+// readProxyV1 reads the rest of a v1 header, whose first byte has already been read.
+func readProxyV1(r io.Reader) (net.Addr, error) {
+	// Read a byte at a time so we don't consume anything beyond the header.
+	line := []byte{proxyV1Prefix[0]}
+	var b [1]byte
+	for !bytes.HasSuffix(line, []byte("\r\n")) {
+		if len(line) >= proxyV1MaxLength {
+			return nil, fmt.Errorf("PROXY v1 header exceeds %d bytes", proxyV1MaxLength)
+		}
+		if _, err := io.ReadFull(r, b[:]); err != nil {
+			return nil, err
+		}
+		line = append(line, b[0])
+	}
+
+	fields := strings.Split(strings.TrimSuffix(string(line), "\r\n"), " ")
+	if fields[0]+" " != proxyV1Prefix || len(fields) < 2 {
+		return nil, fmt.Errorf("malformed PROXY v1 header %q", line)
+	}
+	switch fields[1] {
+	case "UNKNOWN":
+		return nil, nil
+	case "TCP4", "TCP6":
+	default:
+		return nil, fmt.Errorf("unsupported PROXY v1 protocol %q", fields[1])
+	}
+	if len(fields) != 6 {
+		return nil, fmt.Errorf("malformed PROXY v1 header %q", line)
+	}
+	ip := net.ParseIP(fields[2])
+	port, err := strconv.ParseUint(fields[4], 10, 16)
+	if ip == nil || err != nil {
+		return nil, fmt.Errorf("malformed PROXY v1 source address %q port %q", fields[2], fields[4])
+	}
+	return &net.TCPAddr{IP: ip, Port: int(port)}, nil
+}
+
+// readProxyV2 reads the rest of a v2 header, whose first byte has already been read.
+func readProxyV2(r io.Reader) (net.Addr, error) {
+	var head [16]byte
+	head[0] = proxyV2Signature[0]
+	if _, err := io.ReadFull(r, head[1:]); err != nil {
+		return nil, err
+	}
+	if string(head[:12]) != proxyV2Signature {
+		return nil, fmt.Errorf("malformed PROXY v2 signature")
+	}
+	if head[12]>>4 != 2 {
+		return nil, fmt.Errorf("unsupported PROXY v2 version %d", head[12]>>4)
+	}
+	command := head[12] & 0xf
+	family := head[13]
+	body := make([]byte, binary.BigEndian.Uint16(head[14:]))
+	if _, err := io.ReadFull(r, body); err != nil {
+		return nil, err
+	}
+
+	const (
+		commandLocal = 0
+		commandProxy = 1
+		familyTCP4   = 0x11
+		familyTCP6   = 0x21
+	)
+	switch command {
+	case commandLocal:
+		return nil, nil
+	case commandProxy:
+	default:
+		return nil, fmt.Errorf("unsupported PROXY v2 command %d", command)
+	}
+
+	switch family {
+	case familyTCP4:
+		if len(body) < 12 {
+			return nil, fmt.Errorf("PROXY v2 TCP4 addresses truncated")
+		}
+		return &net.TCPAddr{IP: net.IP(body[0:4]), Port: int(binary.BigEndian.Uint16(body[8:10]))}, nil
+	case familyTCP6:
+		if len(body) < 36 {
+			return nil, fmt.Errorf("PROXY v2 TCP6 addresses truncated")
+		}
+		return &net.TCPAddr{IP: net.IP(body[0:16]), Port: int(binary.BigEndian.Uint16(body[32:34]))}, nil
+	default:
+		// Other families (UDP, UNIX, unspecified) don't give us a usable client address.
+		return nil, nil
+	}
+}
@@ -0,0 +1,99 @@
+package fourtosix
+
+import (
+	"io"
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestPeerIsTrusted(t *testing.T) {
+	_, proxies, _ := net.ParseCIDR("192.0.2.0/24")
+	trusted := []net.IPNet{*proxies}
+	for _, tc := range []struct {
+		trusted []net.IPNet
+		peer    net.Addr
+		want    bool
+	}{
+		{trusted, &net.TCPAddr{IP: net.IPv4(192, 0, 2, 10), Port: 1234}, true},
+		{trusted, &net.TCPAddr{IP: net.IPv4(198, 51, 100, 10), Port: 1234}, false},
+		{trusted, &net.UnixAddr{Name: "/tmp/sock", Net: "unix"}, false},
+		{nil, &net.TCPAddr{IP: net.IPv4(192, 0, 2, 10), Port: 1234}, false},
+	} {
+		if got := PeerIsTrusted(tc.trusted, tc.peer); got != tc.want {
+			t.Errorf("PeerIsTrusted(%v, %v) = %v, want %v", tc.trusted, tc.peer, got, tc.want)
+		}
+	}
+}
+
+// readerConn is a net.Conn which reads from r.
+type readerConn struct {
+	net.Conn
+	r io.Reader
+}
+
+func (c *readerConn) Read(b []byte) (int, error) { return c.r.Read(b) }
+
+func proxyV2Header(command, family byte, body []byte) []byte {
+	h := append([]byte(proxyV2Signature), 0x20|command, family, byte(len(body)>>8), byte(len(body)))
+	return append(h, body...)
+}
+
+func TestReadProxyHeader(t *testing.T) {
+	tcp4Body := []byte{192, 0, 2, 1, 198, 51, 100, 1, 0x04, 0xd2, 0x01, 0xbb}
+	tcp6Body := append(append(append([]byte{}, net.ParseIP("2001:db8::1")...), net.ParseIP("2001:db8::2")...), 0x04, 0xd2, 0x01, 0xbb)
+	withTLV := append(append([]byte{}, tcp4Body...), 0x04, 0, 1, 'x')
+
+	for _, tc := range []struct {
+		name   string
+		header string
+		want   string // the RemoteAddr, or "" for the connection itself
+	}{
+		{"v1 TCP4", "PROXY TCP4 192.0.2.1 198.51.100.1 1234 443\r\n", "192.0.2.1:1234"},
+		{"v1 TCP6", "PROXY TCP6 2001:db8::1 2001:db8::2 1234 443\r\n", "[2001:db8::1]:1234"},
+		{"v1 UNKNOWN", "PROXY UNKNOWN ffff::1 ffff::2 1 2\r\n", ""},
+		{"v2 TCP4", string(proxyV2Header(1, 0x11, tcp4Body)), "192.0.2.1:1234"},
+		{"v2 TCP6", string(proxyV2Header(1, 0x21, tcp6Body)), "[2001:db8::1]:1234"},
+		{"v2 TCP4 with TLVs", string(proxyV2Header(1, 0x11, withTLV)), "192.0.2.1:1234"},
+		{"v2 LOCAL", string(proxyV2Header(0, 0, nil)), ""},
+		{"v2 unknown family", string(proxyV2Header(1, 0x31, []byte("/tmp/sock"))), ""},
+	} {
+		c := &readerConn{r: strings.NewReader(tc.header + "rest")}
+		conn, err := ReadProxyHeader(c)
+		if err != nil {
+			t.Errorf("%s: %v", tc.name, err)
+			continue
+		}
+		if tc.want == "" {
+			if conn != net.Conn(c) {
+				t.Errorf("%s: got RemoteAddr %v, want the connection itself", tc.name, conn.RemoteAddr())
+			}
+		} else if got := conn.RemoteAddr().String(); got != tc.want {
+			t.Errorf("%s: RemoteAddr = %s, want %s", tc.name, got, tc.want)
+		}
+		if rest, _ := io.ReadAll(c.r); string(rest) != "rest" {
+			t.Errorf("%s: left %q unread, want %q", tc.name, rest, "rest")
+		}
+	}
+
+	v2 := proxyV2Header(1, 0x11, tcp4Body)
+	for _, tc := range []struct {
+		name, header string
+	}{
+		{"no header", "GET / HTTP/1.1\r\n"},
+		{"v1 truncated", "PROXY TCP4 192.0.2.1 198.51."},
+		{"v1 unknown protocol", "PROXY UDP4 192.0.2.1 198.51.100.1 1234 443\r\n"},
+		{"v1 missing fields", "PROXY TCP4 192.0.2.1 198.51.100.1 1234\r\n"},
+		{"v1 bad address", "PROXY TCP4 192.0.2.x 198.51.100.1 1234 443\r\n"},
+		{"v1 oversized", "PROXY TCP6 " + strings.Repeat("f", 100) + "\r\n"},
+		{"v2 truncated signature", string(v2[:8])},
+		{"v2 truncated body", string(v2[:len(v2)-4])},
+		{"v2 truncated addresses", string(proxyV2Header(1, 0x21, tcp4Body))},
+		{"v2 bad version", string(append(append([]byte(proxyV2Signature), 0x11), v2[13:]...))},
+		{"v2 unknown command", string(proxyV2Header(2, 0x11, tcp4Body))},
+	} {
+		if _, err := ReadProxyHeader(&readerConn{r: strings.NewReader(tc.header)}); err == nil {
+			t.Errorf("%s: succeeded, want an error", tc.name)
+		}
+	}
+}
@@ -0,0 +1,106 @@
+package fourtosix
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// errQuotaExceeded ends a relay's copy once the client has used its ByteQuota.
+var errQuotaExceeded = errors.New("client byte quota exceeded")
+
+// ByteQuota caps the total number of bytes relayed for each client IP address, in either direction,
+// over a window of time. Once a client has used its quota, its connections are closed until the window resets.
+// It is safe for concurrent use.
+type ByteQuota struct {
+	// Limit is the number of bytes each client may transfer per Window.
+	Limit int64
+	// Window is how long a client's usage is counted for before resetting to zero.
+	Window time.Duration
+
+	mu        sync.Mutex
+	clients   map[string]*quotaState
+	lastSweep time.Time
+}
+
+type quotaState struct {
+	used  int64
+	reset time.Time
+}
+
+// Validate checks that q has a positive Limit and Window.
+func (q *ByteQuota) Validate() error {
+	if q.Limit <= 0 || q.Window <= 0 {
+		return fmt.Errorf("byte quota of %d bytes per %v must have a positive limit and window", q.Limit, q.Window)
+	}
+	return nil
+}
+
+// state returns the usage for key, starting a new window if the last one has ended. q.mu must be held.
+func (q *ByteQuota) state(key string, now time.Time) *quotaState {
+	st, ok := q.clients[key]
+	if !ok || !now.Before(st.reset) {
+		if q.clients == nil {
+			q.clients = make(map[string]*quotaState)
+		}
+		// Forget clients whose windows have ended, so idle clients don't accumulate. Sweeping at most once per
+		// Window still bounds the map to the clients seen in the last two windows.
+		if now.Sub(q.lastSweep) >= q.Window {
+			for k, s := range q.clients {
+				if !now.Before(s.reset) {
+					delete(q.clients, k)
+				}
+			}
+			q.lastSweep = now
+		}
+		st = &quotaState{reset: now.Add(q.Window)}
+		q.clients[key] = st
+	}
+	return st
+}
+
+// Add records n bytes transferred by key, returning false once key has exceeded Limit in the current window.
+func (q *ByteQuota) Add(key string, n int64) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	st := q.state(key, time.Now())
+	st.used += n
+	return st.used <= q.Limit
+}
+
+// Exceeded reports whether key has already used its quota in the current window.
+func (q *ByteQuota) Exceeded(key string) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	st, ok := q.clients[key]
+	return ok && time.Now().Before(st.reset) && st.used > q.Limit
+}
+
+// quotaKey returns the key a connection from addr is counted under: its IP address without the port.
+func quotaKey(addr net.Addr) string {
+	key := addr.String()
+	if host, _, err := net.SplitHostPort(key); err == nil {
+		key = host
+	}
+	return key
+}
+
+// quotaReader charges every read from the underlying reader to key, and calls exceeded once the quota runs out.
+type quotaReader struct {
+	io.Reader
+	quota    *ByteQuota
+	key      string
+	exceeded func()
+}
+
+func (r quotaReader) Read(b []byte) (int, error) {
+	n, err := r.Reader.Read(b)
+	if n > 0 && !r.quota.Add(r.key, int64(n)) {
+		r.exceeded()
+		return 0, errQuotaExceeded
+	}
+	return n, err
+}
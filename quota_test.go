@@ -0,0 +1,49 @@
+package fourtosix
+
+import (
+	"testing"
+	"time"
+)
+
+func TestByteQuota(t *testing.T) {
+	q := &ByteQuota{Limit: 10, Window: time.Hour}
+	if !q.Add("192.0.2.1", 10) {
+		t.Error("Add within the limit returned false")
+	}
+	if q.Exceeded("192.0.2.1") {
+		t.Error("Exceeded at exactly the limit")
+	}
+	if q.Add("192.0.2.1", 1) {
+		t.Error("Add beyond the limit returned true")
+	}
+	if !q.Exceeded("192.0.2.1") {
+		t.Error("Exceeded = false after going over the limit")
+	}
+	if q.Exceeded("192.0.2.2") {
+		t.Error("another client shares the quota")
+	}
+}
+
+func TestByteQuotaSweepsOncePerWindow(t *testing.T) {
+	q := &ByteQuota{Limit: 10, Window: time.Minute}
+	start := time.Now()
+	at := func(d time.Duration) time.Time { return start.Add(d) }
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.state("x", at(0))              // sweeps the empty map
+	q.state("a", at(10*time.Second)) // a's window ends at 70s
+	q.state("y", at(60*time.Second)) // sweeps, but a is still live
+	q.state("z", at(75*time.Second)) // a has expired, but the last sweep was under a Window ago
+	if _, ok := q.clients["a"]; !ok {
+		t.Error("swept before a Window had passed since the last sweep")
+	}
+
+	q.state("w", at(120*time.Second))
+	if _, ok := q.clients["a"]; ok {
+		t.Error("expired client not swept once a Window had passed")
+	}
+	if _, ok := q.clients["z"]; !ok {
+		t.Error("client with a live window was swept")
+	}
+}
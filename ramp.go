@@ -0,0 +1,17 @@
+package fourtosix
+
+import "time"
+
+// startupRampInitialDelay is the pause between accepted connections at the very start of a startup ramp,
+// limiting the accept rate to 10 connections per second.
+const startupRampInitialDelay = 100 * time.Millisecond
+
+// StartupRampDelay returns how long to pause after accepting a connection, elapsed into a startup ramp lasting ramp.
+// The pause shrinks linearly from 100ms to nothing over the course of the ramp, so the accept rate rises
+// gradually rather than the handler taking its full load the moment it starts.
+func StartupRampDelay(elapsed, ramp time.Duration) time.Duration {
+	if elapsed >= ramp {
+		return 0
+	}
+	return time.Duration(float64(startupRampInitialDelay) * (1 - float64(elapsed)/float64(ramp)))
+}
@@ -0,0 +1,24 @@
+package fourtosix
+
+import (
+	"testing"
+	"time"
+)
+
+func TestStartupRampDelay(t *testing.T) {
+	const ramp = 10 * time.Second
+	for _, tc := range []struct {
+		elapsed, ramp, want time.Duration
+	}{
+		{0, ramp, 100 * time.Millisecond},
+		{ramp / 4, ramp, 75 * time.Millisecond},
+		{ramp / 2, ramp, 50 * time.Millisecond},
+		{ramp, ramp, 0},
+		{2 * ramp, ramp, 0},
+		{0, 0, 0},
+	} {
+		if got := StartupRampDelay(tc.elapsed, tc.ramp); got != tc.want {
+			t.Errorf("StartupRampDelay(%v, %v) = %v, want %v", tc.elapsed, tc.ramp, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,160 @@
+package fourtosix
+
+import (
+	"context"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Relay copies data between a client and a backend connection.
+type Relay struct {
+	// BufferSize, if positive, is the copy buffer size. Setting it disables splicing;
+	// if zero, io.Copy splices where it can.
+	BufferSize int
+
+	// OnFirstByte, if set, is called with the time from DialedAt to the backend's first byte.
+	OnFirstByte func(ttfb time.Duration)
+	// DialedAt is when the backend connection was established.
+	DialedAt time.Time
+
+	// IdleTimeout, if positive, closes both connections after this long with no data either way.
+	IdleTimeout time.Duration
+
+	// Quota, if set, is charged for bytes copied either way under the client's IP address;
+	// both connections are closed once it is exceeded.
+	Quota *ByteQuota
+}
+
+// activityReader records the time of each successful read from the underlying reader.
+type activityReader struct {
+	io.Reader
+	last *int64
+}
+
+func (r activityReader) Read(b []byte) (int, error) {
+	n, err := r.Reader.Read(b)
+	if n > 0 {
+		atomic.StoreInt64(r.last, time.Now().UnixNano())
+	}
+	return n, err
+}
+
+// firstByteReader calls fn the first time data is read from the underlying reader.
+type firstByteReader struct {
+	io.Reader
+	fn   func()
+	seen bool
+}
+
+func (r *firstByteReader) Read(b []byte) (int, error) {
+	n, err := r.Reader.Read(b)
+	if n > 0 && !r.seen {
+		r.seen = true
+		r.fn()
+	}
+	return n, err
+}
+
+var (
+	bufferPoolsMu sync.Mutex
+	bufferPools   = make(map[int]*sync.Pool)
+)
+
+func bufferPool(size int) *sync.Pool {
+	bufferPoolsMu.Lock()
+	defer bufferPoolsMu.Unlock()
+	p, ok := bufferPools[size]
+	if !ok {
+		p = &sync.Pool{
+			New: func() interface{} {
+				buf := make([]byte, size)
+				return &buf
+			},
+		}
+		bufferPools[size] = p
+	}
+	return p
+}
+
+func (r Relay) copy(dst io.Writer, src io.Reader) (int64, error) {
+	if r.BufferSize <= 0 {
+		return io.Copy(dst, src)
+	}
+	pool := bufferPool(r.BufferSize)
+	buf := pool.Get().(*[]byte)
+	defer pool.Put(buf)
+	// io.CopyBuffer ignores buf for an io.ReaderFrom or io.WriterTo, which *net.TCPConn is.
+	return io.CopyBuffer(struct{ io.Writer }{dst}, struct{ io.Reader }{src}, *buf)
+}
+
+// Run copies data between client and backend until both directions are done. Both connections are
+// closed early if ctx is cancelled, the relay idles for IdleTimeout, or the client exceeds Quota.
+// It returns the bytes copied to the backend and to the client.
+func (r Relay) Run(ctx context.Context, client, backend net.Conn) (toBackend, toClient int64) {
+	var fromBackend, fromClient io.Reader = backend, client
+	if r.OnFirstByte != nil {
+		fromBackend = &firstByteReader{
+			Reader: fromBackend,
+			fn:     func() { r.OnFirstByte(time.Since(r.DialedAt)) },
+		}
+	}
+
+	last := time.Now().UnixNano()
+	var idle *time.Timer
+	var idleC <-chan time.Time
+	if r.IdleTimeout > 0 {
+		fromBackend = activityReader{Reader: fromBackend, last: &last}
+		fromClient = activityReader{Reader: fromClient, last: &last}
+		idle = time.NewTimer(r.IdleTimeout)
+		defer idle.Stop()
+		idleC = idle.C
+	}
+
+	var quotaC chan struct{}
+	if r.Quota != nil {
+		quotaC = make(chan struct{})
+		var once sync.Once
+		exceeded := func() { once.Do(func() { close(quotaC) }) }
+		key := quotaKey(client.RemoteAddr())
+		fromBackend = quotaReader{Reader: fromBackend, quota: r.Quota, key: key, exceeded: exceeded}
+		fromClient = quotaReader{Reader: fromClient, quota: r.Quota, key: key, exceeded: exceeded}
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		toClient, _ = r.copy(client, fromBackend)
+		wg.Done()
+	}()
+	go func() {
+		toBackend, _ = r.copy(backend, fromClient)
+		wg.Done()
+	}()
+
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+
+	for {
+		select {
+		case <-done:
+			return toBackend, toClient
+		case <-ctx.Done():
+		case <-quotaC:
+		case <-idleC:
+			if remaining := r.IdleTimeout - time.Since(time.Unix(0, atomic.LoadInt64(&last))); remaining > 0 {
+				idle.Reset(remaining)
+				continue
+			}
+		}
+		client.Close()
+		backend.Close()
+		<-done
+		return toBackend, toClient
+	}
+}
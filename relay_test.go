@@ -0,0 +1,157 @@
+package fourtosix
+
+import (
+	"context"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// readerFromWriter is an io.Writer which is also an io.ReaderFrom, like *net.TCPConn.
+type readerFromWriter struct {
+	io.Writer
+	readFrom bool
+}
+
+func (w *readerFromWriter) ReadFrom(r io.Reader) (int64, error) {
+	w.readFrom = true
+	return io.Copy(w.Writer, r)
+}
+
+// sizeRecorder is an io.Reader which records the largest buffer it is asked to fill.
+type sizeRecorder struct {
+	io.Reader
+	max int
+}
+
+func (r *sizeRecorder) Read(b []byte) (int, error) {
+	if len(b) > r.max {
+		r.max = len(b)
+	}
+	return r.Reader.Read(b)
+}
+
+func TestRelayCopyUsesBufferSize(t *testing.T) {
+	const size = 1024
+	dst := &readerFromWriter{Writer: io.Discard}
+	src := &sizeRecorder{Reader: io.LimitReader(zeroReader{}, 1<<20)}
+	n, err := Relay{BufferSize: size}.copy(dst, src)
+	if err != nil || n != 1<<20 {
+		t.Fatalf("copy = %d, %v; want %d, nil", n, err, 1<<20)
+	}
+	if dst.readFrom {
+		t.Error("copy used dst's ReadFrom, bypassing the buffer")
+	}
+	if src.max != size {
+		t.Errorf("largest read was %d bytes, want %d", src.max, size)
+	}
+}
+
+func TestRelayOnFirstByte(t *testing.T) {
+	const delay = 20 * time.Millisecond
+	client, clientPeer := net.Pipe()
+	backend, backendPeer := net.Pipe()
+	go func() {
+		time.Sleep(delay)
+		backendPeer.Write([]byte("first"))
+		backendPeer.Write([]byte("second"))
+		backendPeer.Close()
+	}()
+	go func() {
+		io.ReadFull(clientPeer, make([]byte, len("firstsecond")))
+		clientPeer.Close()
+	}()
+
+	var calls []time.Duration
+	r := Relay{OnFirstByte: func(ttfb time.Duration) { calls = append(calls, ttfb) }, DialedAt: time.Now()}
+	r.Run(context.Background(), client, backend)
+	if len(calls) != 1 {
+		t.Fatalf("OnFirstByte called %d times, want once", len(calls))
+	}
+	if calls[0] < delay {
+		t.Errorf("OnFirstByte called with %v, want at least the backend's %v delay", calls[0], delay)
+	}
+}
+
+func TestRelayIdleTimeout(t *testing.T) {
+	const idle = 50 * time.Millisecond
+	client, clientPeer := net.Pipe()
+	backend, backendPeer := net.Pipe()
+	defer clientPeer.Close()
+	defer backendPeer.Close()
+	go io.Copy(io.Discard, backendPeer)
+	go func() {
+		// Traffic for three times the idle timeout keeps the relay open, then it goes quiet.
+		for i := 0; i < 6; i++ {
+			time.Sleep(idle / 2)
+			clientPeer.Write([]byte{'x'})
+		}
+	}()
+
+	start := time.Now()
+	toBackend, _ := Relay{IdleTimeout: idle}.Run(context.Background(), client, backend)
+	if toBackend != 6 {
+		t.Errorf("relayed %d bytes to the backend before closing, want 6", toBackend)
+	}
+	if elapsed := time.Since(start); elapsed < 3*idle {
+		t.Errorf("relay closed after %v, though traffic was still passing", elapsed)
+	}
+	if _, err := clientPeer.Write([]byte{'x'}); err == nil {
+		t.Error("client connection still open after the relay went idle")
+	}
+}
+
+type zeroReader struct{}
+
+func (zeroReader) Read(b []byte) (int, error) {
+	for i := range b {
+		b[i] = 0
+	}
+	return len(b), nil
+}
+
+// tcpPair returns the two ends of a loopback TCP connection.
+func tcpPair(b *testing.B) (net.Conn, net.Conn) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer l.Close()
+	accepted := make(chan net.Conn)
+	go func() {
+		c, _ := l.Accept()
+		accepted <- c
+	}()
+	c, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		b.Fatal(err)
+	}
+	return c, <-accepted
+}
+
+func benchmarkRelay(b *testing.B, bufferSize int) {
+	const total = 64 << 20
+	b.SetBytes(total)
+	for i := 0; i < b.N; i++ {
+		client, clientPeer := tcpPair(b)
+		backend, backendPeer := tcpPair(b)
+		go func() {
+			io.CopyN(clientPeer, zeroReader{}, total)
+			clientPeer.(*net.TCPConn).CloseWrite()
+		}()
+		go func() {
+			// The relay doesn't pass on the client's half-close, so stop after the expected amount.
+			io.CopyN(io.Discard, backendPeer, total)
+			backendPeer.Close()
+		}()
+		Relay{BufferSize: bufferSize}.Run(context.Background(), client, backend)
+		client.Close()
+		backend.Close()
+		clientPeer.Close()
+	}
+}
+
+func BenchmarkRelayDefault(b *testing.B) { benchmarkRelay(b, 0) }
+func BenchmarkRelay4K(b *testing.B)      { benchmarkRelay(b, 4<<10) }
+func BenchmarkRelay64K(b *testing.B)     { benchmarkRelay(b, 64<<10) }
@@ -0,0 +1,27 @@
+package fourtosix
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+)
+
+// ErrReplayFailed is returned when a backend accepted a connection, but the bytes already read from the client
+// couldn't be sent to it, usually because it closed the connection straight away.
+var ErrReplayFailed = errors.New("backend closed during replay")
+
+// DialAndReplay connects to address using dialer and sends replay to it, returning the connection if both succeed.
+func DialAndReplay(ctx context.Context, dialer Dialer, network, address string, replay []byte) (net.Conn, error) {
+	rconn, err := dialer.DialContext(ctx, network, address)
+	if err != nil {
+		return nil, err
+	}
+	if len(replay) > 0 {
+		if _, err := rconn.Write(replay); err != nil {
+			rconn.Close()
+			return nil, fmt.Errorf("%w: %v", ErrReplayFailed, err)
+		}
+	}
+	return rconn, nil
+}
@@ -0,0 +1,19 @@
+package fourtosix
+
+import "net"
+
+// ResetOnClose arranges for conn to be reset with a TCP RST when it is closed, rather than shut down gracefully
+// with a FIN, by setting SO_LINGER to zero. Wrapping connections which provide a NetConn method, like those
+// returned by ReadProxyHeader, are unwrapped to find the TCP connection. It returns false if there isn't one.
+func ResetOnClose(conn net.Conn) bool {
+	for {
+		if tc, ok := conn.(interface{ SetLinger(int) error }); ok {
+			return tc.SetLinger(0) == nil
+		}
+		wc, ok := conn.(interface{ NetConn() net.Conn })
+		if !ok {
+			return false
+		}
+		conn = wc.NetConn()
+	}
+}
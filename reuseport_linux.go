@@ -0,0 +1,30 @@
+//go:build linux && !mips && !mipsle && !mips64 && !mips64le
+
+package fourtosix
+
+import (
+	"context"
+	"net"
+	"syscall"
+)
+
+// soReusePort is SO_REUSEPORT, which the syscall package doesn't define. It has a different value on MIPS.
+const soReusePort = 0xf
+
+// ListenReusePort listens like net.Listen, but with SO_REUSEPORT set, so that several processes can listen on
+// the same address and have the kernel share connections between them. This is only supported on Linux, on architectures other than MIPS.
+func ListenReusePort(network, address string) (net.Listener, error) {
+	lc := net.ListenConfig{
+		Control: func(network, address string, c syscall.RawConn) error {
+			var serr error
+			err := c.Control(func(fd uintptr) {
+				serr = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, soReusePort, 1)
+			})
+			if err != nil {
+				return err
+			}
+			return serr
+		},
+	}
+	return lc.Listen(context.Background(), network, address)
+}
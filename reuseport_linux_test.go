@@ -0,0 +1,27 @@
+//go:build linux && !mips && !mipsle && !mips64 && !mips64le
+
+package fourtosix
+
+import (
+	"net"
+	"testing"
+)
+
+func TestListenReusePort(t *testing.T) {
+	l1, err := ListenReusePort("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("ListenReusePort: %v", err)
+	}
+	defer l1.Close()
+	l2, err := ListenReusePort("tcp", l1.Addr().String())
+	if err != nil {
+		t.Fatalf("second ListenReusePort on %s: %v", l1.Addr(), err)
+	}
+	l2.Close()
+
+	// Without SO_REUSEPORT, the port is taken.
+	if l, err := net.Listen("tcp", l1.Addr().String()); err == nil {
+		l.Close()
+		t.Errorf("net.Listen on %s, which is already bound, succeeded", l1.Addr())
+	}
+}
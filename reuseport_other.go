@@ -0,0 +1,14 @@
+//go:build !linux || mips || mipsle || mips64 || mips64le
+
+package fourtosix
+
+import (
+	"errors"
+	"net"
+)
+
+// ListenReusePort listens like net.Listen, but with SO_REUSEPORT set, so that several processes can listen on
+// the same address and have the kernel share connections between them. This is only supported on Linux, on architectures other than MIPS.
+func ListenReusePort(network, address string) (net.Listener, error) {
+	return nil, errors.New("SO_REUSEPORT is not supported on this platform")
+}
@@ -0,0 +1,82 @@
+package fourtosix
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Routing decides which hostnames a handler proxies, and which backends their connections are sent to.
+// The TLS and HTTP handlers fill one in from their own fields of the same names.
+type Routing struct {
+	HostnameIsAllowed   func(hostname string) bool
+	AllowedHostSuffixes []string
+	StrictRouting       bool
+	DefaultBackend      string
+	NextHop             string
+	BackendsForHost     func(hostname string) []string
+}
+
+// Validate checks the routing options for mistakes, naming the offending field in the error.
+func (r *Routing) Validate() error {
+	if r.DefaultBackend != "" {
+		if err := ValidateAddress(r.DefaultBackend); err != nil {
+			return fmt.Errorf("DefaultBackend: %v", err)
+		}
+	}
+	if r.NextHop != "" {
+		if err := ValidateAddress(r.NextHop); err != nil {
+			return fmt.Errorf("NextHop: %v", err)
+		}
+	}
+	if r.StrictRouting && r.HostnameIsAllowed == nil && len(r.AllowedHostSuffixes) == 0 && r.BackendsForHost == nil && r.DefaultBackend == "" {
+		return errors.New("StrictRouting is set, but no hostnames are allowed and there's no DefaultBackend")
+	}
+	return nil
+}
+
+// Allowed reports whether connections for hostname, which must already be normalized, may be proxied.
+func (r *Routing) Allowed(hostname string) bool {
+	if r.HostnameIsAllowed != nil {
+		return r.HostnameIsAllowed(hostname)
+	}
+	if r.AllowedHostSuffixes != nil && r.hasAllowedSuffix(hostname) {
+		return true
+	}
+	if r.StrictRouting {
+		return r.BackendsForHost != nil && len(r.BackendsForHost(hostname)) > 0
+	}
+	return r.AllowedHostSuffixes == nil
+}
+
+func (r *Routing) hasAllowedSuffix(hostname string) bool {
+	// TODO(lukegb): maybe use a trie of reversed hostname prefixes
+	for _, s := range r.AllowedHostSuffixes {
+		if ns, err := NormalizeHostname(s); err == nil {
+			s = ns
+		}
+		if strings.HasSuffix(hostname, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// Backends returns the addresses to try, in order, for a connection to hostname whose backend would otherwise be
+// raddr. usingDefault says whether raddr is DefaultBackend, in which case it is used as is, without NextHop or
+// BackendsForHost.
+func (r *Routing) Backends(hostname, raddr string, usingDefault bool) []string {
+	if usingDefault {
+		return []string{raddr}
+	}
+	backends := []string{raddr}
+	if r.NextHop != "" {
+		backends = []string{r.NextHop}
+	}
+	if r.BackendsForHost != nil {
+		if b := r.BackendsForHost(hostname); len(b) > 0 {
+			backends = b
+		}
+	}
+	return backends
+}
@@ -0,0 +1,52 @@
+package fourtosix
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestRoutingAllowed(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		r        Routing
+		hostname string
+		want     bool
+	}{
+		{"no allowlist", Routing{}, "example.com", true},
+		{"suffix match", Routing{AllowedHostSuffixes: []string{".example.com"}}, "www.example.com", true},
+		{"suffix mismatch", Routing{AllowedHostSuffixes: []string{".example.com"}}, "example.net", false},
+		{"suffix normalized", Routing{AllowedHostSuffixes: []string{".Example.COM."}}, "www.example.com", true},
+		{"strict, empty", Routing{StrictRouting: true}, "example.com", false},
+		{"strict, routed", Routing{StrictRouting: true, BackendsForHost: func(string) []string { return []string{"b:443"} }}, "example.com", true},
+		{"callback", Routing{AllowedHostSuffixes: []string{".example.com"}, HostnameIsAllowed: func(string) bool { return false }}, "www.example.com", false},
+	} {
+		if got := tc.r.Allowed(tc.hostname); got != tc.want {
+			t.Errorf("%s: Allowed(%q) = %v, want %v", tc.name, tc.hostname, got, tc.want)
+		}
+	}
+}
+
+func TestRoutingBackends(t *testing.T) {
+	r := Routing{
+		NextHop: "nexthop.example:443",
+		BackendsForHost: func(hostname string) []string {
+			if hostname == "multi.example" {
+				return []string{"a.example:443", "b.example:443"}
+			}
+			return nil
+		},
+	}
+	for _, tc := range []struct {
+		hostname, raddr string
+		usingDefault    bool
+		want            []string
+	}{
+		{"example.com", "example.com:443", false, []string{"nexthop.example:443"}},
+		{"multi.example", "multi.example:443", false, []string{"a.example:443", "b.example:443"}},
+		{"multi.example", "default.example:443", true, []string{"default.example:443"}},
+	} {
+		if got := r.Backends(tc.hostname, tc.raddr, tc.usingDefault); !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("Backends(%q, %q, %v) = %q, want %q", tc.hostname, tc.raddr, tc.usingDefault, got, tc.want)
+		}
+	}
+}
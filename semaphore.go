@@ -0,0 +1,29 @@
+package fourtosix
+
+import (
+	"context"
+	"sync"
+)
+
+// Semaphore limits the number of callers which can hold it at once, making the rest wait their turn.
+// The zero value is ready to use.
+type Semaphore struct {
+	once  sync.Once
+	slots chan struct{}
+}
+
+// Acquire waits until fewer than max callers hold s, or ctx is done, in which case it returns ctx's error.
+// If max isn't positive, it returns immediately. max must be the same on every call.
+// On success, the returned function must be called to release s.
+func (s *Semaphore) Acquire(ctx context.Context, max int) (release func(), err error) {
+	if max <= 0 {
+		return func() {}, nil
+	}
+	s.once.Do(func() { s.slots = make(chan struct{}, max) })
+	select {
+	case s.slots <- struct{}{}:
+		return func() { <-s.slots }, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
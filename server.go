@@ -0,0 +1,315 @@
+package fourtosix
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"runtime/debug"
+	"sync"
+	"time"
+)
+
+// HandlerOptions holds the options common to every handler, filled in from the handler's own
+// fields of the same names.
+type HandlerOptions struct {
+	Name                string
+	Middleware          []Middleware
+	StartupRampDuration time.Duration
+
+	ResetOnReject bool
+	Metrics       Metrics
+	AuditLog      io.Writer
+
+	MakeDialer     func(net.Conn, Context) Dialer
+	ConnectionPool *ConnectionPool
+	PreferIPv6     bool
+	CircuitBreaker *CircuitBreaker
+	// ForceNetwork is the network backends are dialed on. If empty, "tcp" is used.
+	ForceNetwork string
+	NoDelay      *bool
+
+	TrustProxyProtocol bool
+	TrustedProxies     []net.IPNet
+
+	IdleTimeout        time.Duration
+	RelayBufferSize    int
+	PerClientByteQuota *ByteQuota
+}
+
+// Validate checks the options for mistakes, naming the offending field in the error.
+func (o *HandlerOptions) Validate() error {
+	if err := ValidateNetwork(o.ForceNetwork); err != nil {
+		return fmt.Errorf("ForceNetwork: %v", err)
+	}
+	if o.ConnectionPool != nil && o.MakeDialer != nil {
+		return errors.New("ConnectionPool and MakeDialer can't both be set")
+	}
+	if o.CircuitBreaker != nil {
+		if err := o.CircuitBreaker.Validate(); err != nil {
+			return fmt.Errorf("CircuitBreaker: %v", err)
+		}
+	}
+	if o.TrustProxyProtocol && len(o.TrustedProxies) == 0 {
+		return errors.New("TrustProxyProtocol is set, but there are no TrustedProxies")
+	}
+	if o.PerClientByteQuota != nil {
+		if err := o.PerClientByteQuota.Validate(); err != nil {
+			return fmt.Errorf("PerClientByteQuota: %v", err)
+		}
+	}
+	return nil
+}
+
+// Logf logs a message, prefixed with name if it isn't empty.
+func Logf(name, format string, args ...interface{}) {
+	if name == "" {
+		log.Printf(format, args...)
+		return
+	}
+	log.Printf("[%s] "+format, append([]interface{}{name}, args...)...)
+}
+
+// Server is the machinery shared by the handlers: accepting, events, rejecting, dialing, relaying.
+// The zero value is ready to use.
+type Server struct {
+	lifecycle  Lifecycle
+	events     EventStream
+	auditLogMu sync.Mutex
+}
+
+// Serve serves each connection from l in its own goroutine with serve, wrapped in opts.Middleware,
+// until l fails or the server is shut down, when it returns ErrHandlerClosed. Panics close the
+// connection, and accepts are ramped up over opts.StartupRampDuration.
+func (s *Server) Serve(l net.Listener, opts *HandlerOptions, serve ConnHandler) error {
+	if err := s.lifecycle.AddListener(l); err != nil {
+		return err
+	}
+	defer s.lifecycle.RemoveListener(l)
+
+	serve = Chain(serve, opts.Middleware...)
+	start := time.Now()
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if s.lifecycle.ShuttingDown() {
+				return ErrHandlerClosed
+			}
+			return fmt.Errorf("failed to accept: %v", err)
+		}
+		go func() {
+			defer func() {
+				if r := recover(); r != nil {
+					Logf(opts.Name, "[%s] panic serving connection: %v\n%s", conn.RemoteAddr(), r, debug.Stack())
+					conn.Close()
+				}
+			}()
+			if err := serve(conn); err != nil {
+				Logf(opts.Name, "[%s] %v", conn.RemoteAddr(), err)
+			}
+		}()
+
+		if d := StartupRampDelay(time.Since(start), opts.StartupRampDuration); d > 0 {
+			time.Sleep(d)
+		}
+	}
+}
+
+// ListenAndServe listens on network and addr, then calls serve with the listener.
+func ListenAndServe(network, addr string, serve func(net.Listener) error) error {
+	l, err := net.Listen(network, addr)
+	if err != nil {
+		return err
+	}
+	return serve(l)
+}
+
+// Shutdown stops all Serve calls and cancels the contexts returned by Accept, closing in-flight
+// connections.
+func (s *Server) Shutdown() error {
+	return s.lifecycle.Shutdown()
+}
+
+// Drain stops all Serve calls, but lets in-flight connections run to completion.
+func (s *Server) Drain() error {
+	return s.lifecycle.Drain()
+}
+
+// Events returns the channel ConnEvents are delivered on; see EventStream.
+func (s *Server) Events() <-chan ConnEvent {
+	return s.events.Events()
+}
+
+// Emit delivers ev to the subscriber to Events, if there is one.
+func (s *Server) Emit(ev ConnEvent) {
+	s.events.Emit(ev)
+}
+
+type connStatsKey struct{}
+
+// connStats is what Relay learns about a connection, for its ConnClosed event.
+type connStats struct {
+	backend             string
+	toBackend, toClient int64
+}
+
+// Accept emits ConnAccepted for conn and returns a context to serve it under, ended by Shutdown.
+// done must be called when the connection ends: it cancels the context and emits ConnClosed.
+func (s *Server) Accept(name string, conn net.Conn) (ctx context.Context, done func()) {
+	s.events.Emit(ConnEvent{Type: ConnAccepted, Client: conn.RemoteAddr()})
+	stats := &connStats{}
+	ctx, cancel := context.WithCancel(context.WithValue(WithHandlerName(s.lifecycle.Context(), name), connStatsKey{}, stats))
+	return ctx, func() {
+		cancel()
+		s.events.Emit(ConnEvent{
+			Type:           ConnClosed,
+			Client:         conn.RemoteAddr(),
+			Backend:        stats.backend,
+			BytesToBackend: stats.toBackend,
+			BytesToClient:  stats.toClient,
+		})
+	}
+}
+
+// StripProxyHeader reads a PROXY header from conn if opts trusts its peer, returning a connection
+// whose RemoteAddr is the client from the header. A bad header is rejected as malformed, with
+// the usual ConnAccepted and ConnClosed events.
+func (s *Server) StripProxyHeader(opts *HandlerOptions, conn net.Conn) (net.Conn, error) {
+	if !opts.TrustProxyProtocol || !PeerIsTrusted(opts.TrustedProxies, conn.RemoteAddr()) {
+		return conn, nil
+	}
+	pconn, err := ReadProxyHeader(conn)
+	if err != nil {
+		_, done := s.Accept(opts.Name, conn)
+		defer done()
+		s.Rejected(opts, conn, "", RejectMalformed)
+		return nil, fmt.Errorf("read PROXY header: %v", err)
+	}
+	return pconn, nil
+}
+
+// Rejected records that conn, which asked for hostname, was turned away for reason, in
+// opts.Metrics, opts.AuditLog and a ConnRejected event, and applies opts.ResetOnReject.
+func (s *Server) Rejected(opts *HandlerOptions, conn net.Conn, hostname string, reason RejectReason) {
+	s.events.Emit(ConnEvent{Type: ConnRejected, Client: conn.RemoteAddr(), Hostname: hostname, Reason: reason})
+	if opts.ResetOnReject {
+		ResetOnClose(conn)
+	}
+	if opts.Metrics != nil {
+		opts.Metrics.ConnectionRejected(reason)
+	}
+	if opts.AuditLog != nil {
+		s.auditLogMu.Lock()
+		defer s.auditLogMu.Unlock()
+		WriteAuditRecord(opts.AuditLog, AuditRecord{
+			Time:     time.Now(),
+			Handler:  opts.Name,
+			Client:   conn.RemoteAddr().String(),
+			Hostname: hostname,
+			Reason:   reason,
+		})
+	}
+}
+
+// Connect dials the first of backends to accept a connection and replay, on behalf of conn, which
+// asked for raddr, skipping backends whose circuit is open. It returns the connection and its
+// address; if none could be reached, it emits ConnDialFailed and returns the last error.
+func (s *Server) Connect(ctx *ConnContext, opts *HandlerOptions, conn net.Conn, raddr string, backends []string, replay []byte) (net.Conn, string, error) {
+	network := opts.ForceNetwork
+	if network == "" {
+		network = "tcp"
+	}
+
+	var dialer Dialer
+	if opts.ConnectionPool != nil {
+		dialer = opts.ConnectionPool
+	} else if opts.MakeDialer != nil {
+		dialer = opts.MakeDialer(conn, ctx)
+	} else {
+		dialer = DefaultDialer
+	}
+	if opts.PreferIPv6 {
+		dialer = &PreferIPv6Dialer{Dialer: dialer}
+	}
+
+	var rconn net.Conn
+	var err error
+	var daddr string
+	for _, daddr = range backends {
+		if opts.CircuitBreaker != nil && !opts.CircuitBreaker.Allow(daddr) {
+			err = ErrCircuitOpen
+			continue
+		}
+		rconn, err = DialAndReplay(ctx, dialer, network, daddr, replay)
+		if opts.CircuitBreaker != nil {
+			if err == nil {
+				opts.CircuitBreaker.Success(daddr)
+			} else if ctx.Err() == nil {
+				// A dial cut short by EstablishTimeout or shutdown says nothing about the backend.
+				opts.CircuitBreaker.Failure(daddr)
+			}
+		}
+		if err == nil {
+			break
+		}
+		if daddr != raddr {
+			Logf(opts.Name, "[%s] connect %s via %s: %v", conn.RemoteAddr(), raddr, daddr, err)
+		} else {
+			Logf(opts.Name, "[%s] connect %s: %v", conn.RemoteAddr(), raddr, err)
+		}
+	}
+	if err != nil {
+		s.events.Emit(ConnEvent{Type: ConnDialFailed, Client: conn.RemoteAddr(), Backend: raddr, Err: err})
+		return nil, "", err
+	}
+
+	s.events.Emit(ConnEvent{Type: ConnDialed, Client: conn.RemoteAddr(), Backend: daddr})
+	if daddr != raddr {
+		Logf(opts.Name, "[%s] connected to %s via %s from %s", conn.RemoteAddr(), raddr, daddr, rconn.LocalAddr())
+	} else {
+		Logf(opts.Name, "[%s] connected to %s from %s", conn.RemoteAddr(), raddr, rconn.LocalAddr())
+	}
+	var zero time.Time
+	conn.SetDeadline(zero)
+
+	if opts.NoDelay != nil {
+		for _, c := range []net.Conn{conn, rconn} {
+			if tc, ok := c.(*net.TCPConn); ok {
+				tc.SetNoDelay(*opts.NoDelay)
+			}
+		}
+	}
+	return rconn, daddr, nil
+}
+
+// Relay copies data between conn and rconn, connected to daddr at dialedAt, until both sides are
+// done, the connection idles, or ctx is cancelled. It returns the bytes relayed each way.
+func (s *Server) Relay(ctx context.Context, opts *HandlerOptions, conn, rconn net.Conn, daddr string, dialedAt time.Time) (toBackend, toClient int64) {
+	relay := Relay{
+		BufferSize:  opts.RelayBufferSize,
+		DialedAt:    dialedAt,
+		IdleTimeout: opts.IdleTimeout,
+		Quota:       opts.PerClientByteQuota,
+	}
+	if opts.Metrics != nil {
+		relay.OnFirstByte = opts.Metrics.BackendFirstByte
+	}
+
+	Logf(opts.Name, "[%s] gluing connections together", conn.RemoteAddr())
+	toBackend, toClient = relay.Run(ctx, conn, rconn)
+	if stats, ok := ctx.Value(connStatsKey{}).(*connStats); ok {
+		stats.backend, stats.toBackend, stats.toClient = daddr, toBackend, toClient
+	}
+	Logf(opts.Name, "[%s] closing connection", conn.RemoteAddr())
+	return toBackend, toClient
+}
+
+// EstablishContext returns ctx, expiring timeout after start if timeout is positive.
+func EstablishContext(ctx context.Context, start time.Time, timeout time.Duration) (context.Context, context.CancelFunc) {
+	if timeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithDeadline(ctx, start.Add(timeout))
+}
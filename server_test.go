@@ -0,0 +1,158 @@
+package fourtosix
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestServerServeRecoversPanics(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var s Server
+	served := make(chan struct{}, 2)
+	done := make(chan error)
+	go func() {
+		done <- s.Serve(l, &HandlerOptions{}, func(conn net.Conn) error {
+			served <- struct{}{}
+			panic("boom")
+		})
+	}()
+
+	for i := 0; i < 2; i++ {
+		c, err := net.Dial("tcp", l.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer c.Close()
+		select {
+		case <-served:
+		case <-time.After(time.Second):
+			t.Fatalf("connection %d was never served", i)
+		}
+		// The panicking connection is closed rather than leaked.
+		c.SetReadDeadline(time.Now().Add(time.Second))
+		if _, err := c.Read(make([]byte, 1)); err == nil {
+			t.Errorf("connection %d: read data, want it closed", i)
+		}
+	}
+
+	s.Shutdown()
+	if err := <-done; !errors.Is(err, ErrHandlerClosed) {
+		t.Errorf("Serve after Shutdown = %v, want %v", err, ErrHandlerClosed)
+	}
+}
+
+func TestServerRejected(t *testing.T) {
+	var s Server
+	var audit bytes.Buffer
+	opts := &HandlerOptions{Name: "test", AuditLog: &audit}
+	conn, peer := net.Pipe()
+	defer conn.Close()
+	defer peer.Close()
+
+	s.Rejected(opts, conn, "example.com", RejectPolicy)
+
+	var rec AuditRecord
+	if err := json.Unmarshal(audit.Bytes(), &rec); err != nil {
+		t.Fatalf("audit log %q: %v", audit.String(), err)
+	}
+	if rec.Handler != "test" || rec.Hostname != "example.com" || rec.Reason != RejectPolicy {
+		t.Errorf("audit record = %+v", rec)
+	}
+}
+
+func TestServerDrain(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var s Server
+	accepted := make(chan context.Context)
+	done := make(chan error)
+	go func() {
+		done <- s.Serve(l, &HandlerOptions{}, func(conn net.Conn) error {
+			ctx, finish := s.Accept("test", conn)
+			defer finish()
+			accepted <- ctx
+			<-ctx.Done()
+			return nil
+		})
+	}()
+
+	c, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	ctx := <-accepted
+
+	s.Drain()
+	if err := <-done; !errors.Is(err, ErrHandlerClosed) {
+		t.Errorf("Serve after Drain = %v, want %v", err, ErrHandlerClosed)
+	}
+	if c, err := net.Dial("tcp", l.Addr().String()); err == nil {
+		c.Close()
+		t.Error("listener still accepting connections after Drain")
+	}
+	if ctx.Err() != nil {
+		t.Errorf("in-flight connection's context cancelled by Drain: %v", ctx.Err())
+	}
+
+	s.Shutdown()
+	select {
+	case <-ctx.Done():
+	case <-time.After(time.Second):
+		t.Error("in-flight connection's context not cancelled by Shutdown")
+	}
+}
+
+func TestServerServeAppliesMiddleware(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	calls := make(chan string, 3)
+	tag := func(name string) Middleware {
+		return func(next ConnHandler) ConnHandler {
+			return func(conn net.Conn) error {
+				calls <- name
+				return next(conn)
+			}
+		}
+	}
+	var s Server
+	opts := &HandlerOptions{Middleware: []Middleware{tag("outer"), tag("inner")}}
+	done := make(chan error)
+	go func() {
+		done <- s.Serve(l, opts, func(conn net.Conn) error {
+			calls <- "handler"
+			return conn.Close()
+		})
+	}()
+
+	c, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	for _, want := range []string{"outer", "inner", "handler"} {
+		select {
+		case got := <-calls:
+			if got != want {
+				t.Errorf("called %s, want %s", got, want)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("%s never called", want)
+		}
+	}
+
+	s.Shutdown()
+	<-done
+}
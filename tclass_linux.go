@@ -0,0 +1,19 @@
+//go:build linux
+
+package fourtosix
+
+import "syscall"
+
+// setTrafficClass returns a net.Dialer Control function which sets IPV6_TCLASS on the socket to tclass.
+func setTrafficClass(tclass int) func(network, address string, c syscall.RawConn) error {
+	return func(network, address string, c syscall.RawConn) error {
+		var serr error
+		err := c.Control(func(fd uintptr) {
+			serr = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IPV6, syscall.IPV6_TCLASS, tclass)
+		})
+		if err != nil {
+			return err
+		}
+		return serr
+	}
+}
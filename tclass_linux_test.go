@@ -0,0 +1,45 @@
+//go:build linux
+
+package fourtosix
+
+import (
+	"context"
+	"net"
+	"syscall"
+	"testing"
+)
+
+func TestSubnetDialerTrafficClass(t *testing.T) {
+	l := listenLoopback6(t)
+	// ::/96 embeds the client 0.0.0.1 as ::1, which can be bound.
+	sd, err := NewSubnetDialer("::/96")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sd.TrafficClass = 0xb8 // DSCP EF
+
+	client := remoteConn{remote: &net.TCPAddr{IP: net.IPv4(0, 0, 0, 1), Port: 1234}}
+	conn, err := sd.MakeDialer(client, nil).DialContext(context.Background(), "tcp6", l.Addr().String())
+	if err != nil {
+		t.Fatalf("DialContext: %v", err)
+	}
+	defer conn.Close()
+
+	raw, err := conn.(*net.TCPConn).SyscallConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var tclass int
+	var serr error
+	if err := raw.Control(func(fd uintptr) {
+		tclass, serr = syscall.GetsockoptInt(int(fd), syscall.IPPROTO_IPV6, syscall.IPV6_TCLASS)
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if serr != nil {
+		t.Fatalf("reading IPV6_TCLASS: %v", serr)
+	}
+	if tclass != sd.TrafficClass {
+		t.Errorf("IPV6_TCLASS = %#x, want %#x", tclass, sd.TrafficClass)
+	}
+}
@@ -0,0 +1,16 @@
+//go:build !linux
+
+package fourtosix
+
+import (
+	"errors"
+	"syscall"
+)
+
+// setTrafficClass returns a net.Dialer Control function which fails, since setting the traffic class
+// is only supported on Linux.
+func setTrafficClass(tclass int) func(network, address string, c syscall.RawConn) error {
+	return func(network, address string, c syscall.RawConn) error {
+		return errors.New("setting the traffic class is only supported on Linux")
+	}
+}
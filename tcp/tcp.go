@@ -0,0 +1,245 @@
+package tcp
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"time"
+
+	"github.com/lukegb/fourtosix"
+)
+
+type Handler struct {
+	// Name, if set, identifies this handler in its log lines and, through fourtosix.HandlerName, in the context
+	// passed to DialContext. To tell handlers apart in metrics, give each its own Metrics.
+	Name string
+
+	// Backend is the address (host:port) every connection is sent to.
+	Backend string
+
+	MakeDialer func(net.Conn, fourtosix.Context) fourtosix.Dialer
+
+	// ConnectionPool, if set, supplies backend connections in place of MakeDialer, which is then not used.
+	ConnectionPool *fourtosix.ConnectionPool
+
+	ForceNetwork string
+
+	// Middleware wraps the handling of each connection accepted by Serve, with the first entry outermost.
+	// It is not applied to direct calls to ServeConn.
+	Middleware []fourtosix.Middleware
+
+	// OnAccept, if set, is called with each connection before anything is read from it.
+	// The connection it returns is used in place of the original; if it returns an error, the connection is closed.
+	OnAccept func(net.Conn) (net.Conn, error)
+
+	// AuditLog, if set, receives a line of JSON (see fourtosix.AuditRecord) for each rejected connection.
+	AuditLog io.Writer
+
+	// ResetOnReject closes rejected connections with a TCP RST rather than a FIN.
+	ResetOnReject bool
+
+	// Metrics, if set, is notified about rejected connections and backend responses.
+	Metrics fourtosix.Metrics
+
+	// MaxConnectionsPerClientIP, if positive, limits the number of concurrent connections from any one client address.
+	MaxConnectionsPerClientIP int
+
+	// PerClientByteQuota, if set, limits the total bytes relayed for each client address over its window.
+	// Connections are closed once their client exceeds it, and new ones are rejected until the window resets.
+	PerClientByteQuota *fourtosix.ByteQuota
+
+	// MaxConnectionsPerHost, if positive, limits the number of concurrent connections to Backend.
+	MaxConnectionsPerHost int
+
+	// CircuitBreaker, if set, stops dials to Backend while it has been failing repeatedly.
+	CircuitBreaker *fourtosix.CircuitBreaker
+
+	// AfterDial, if set, is called with each newly established backend connection, and returns the connection
+	// to relay to in its place, which may wrap the original. If it returns an error, the client's connection is closed.
+	AfterDial func(ctx fourtosix.Context, rconn net.Conn) (net.Conn, error)
+
+	// PreferIPv6 resolves backend hostnames before dialing, and connects to their IPv6 addresses
+	// in preference to IPv4, which is only used if a backend has no IPv6 addresses.
+	PreferIPv6 bool
+
+	// NoDelay, if set, is passed to SetNoDelay on both sides of each proxied TCP connection. Go already disables
+	// Nagle's algorithm on every TCP connection, so this is only useful set to false, to coalesce small writes.
+	// If nil, Go's default is kept.
+	NoDelay *bool
+
+	// TrustProxyProtocol causes a PROXY protocol header to be read from the start of each connection,
+	// and the client address it carries to be used in place of the connection's own remote address.
+	TrustProxyProtocol bool
+
+	// TrustedProxies limits TrustProxyProtocol to connections from peers in these networks.
+	// Connections from other peers are handled as if they had no PROXY header.
+	// It must be non-empty if TrustProxyProtocol is set; to trust every peer, list 0.0.0.0/0 and ::/0.
+	TrustedProxies []net.IPNet
+
+	// StartupRampDuration, if set, limits the rate at which Serve accepts connections when it starts,
+	// gradually lifting the limit over this period.
+	StartupRampDuration time.Duration
+
+	// IdleTimeout, if positive, closes proxied connections once no data has passed in either direction for this long.
+	IdleTimeout time.Duration
+
+	// RelayBufferSize, if positive, sets the size of the buffers used to copy data once a connection is established.
+	RelayBufferSize int
+
+	srv         fourtosix.Server
+	hostConns   fourtosix.ConnCounter
+	clientConns fourtosix.ConnCounter
+}
+
+// options returns the handler's configuration in the form fourtosix.Server takes it.
+func (h *Handler) options() *fourtosix.HandlerOptions {
+	return &fourtosix.HandlerOptions{
+		Name:                h.Name,
+		Middleware:          h.Middleware,
+		StartupRampDuration: h.StartupRampDuration,
+		ResetOnReject:       h.ResetOnReject,
+		Metrics:             h.Metrics,
+		AuditLog:            h.AuditLog,
+		MakeDialer:          h.MakeDialer,
+		ConnectionPool:      h.ConnectionPool,
+		PreferIPv6:          h.PreferIPv6,
+		CircuitBreaker:      h.CircuitBreaker,
+		ForceNetwork:        h.ForceNetwork,
+		NoDelay:             h.NoDelay,
+		TrustProxyProtocol:  h.TrustProxyProtocol,
+		TrustedProxies:      h.TrustedProxies,
+		IdleTimeout:         h.IdleTimeout,
+		RelayBufferSize:     h.RelayBufferSize,
+		PerClientByteQuota:  h.PerClientByteQuota,
+	}
+}
+
+// ServeConn proxies a single accepted connection, returning once it has been closed.
+// It is safe to call concurrently, and can be used to drive the handler without a net.Listener.
+// The returned error describes why the connection was rejected, if it was.
+func (h *Handler) ServeConn(conn net.Conn) error {
+	defer conn.Close()
+	if h.OnAccept != nil {
+		wrapped, err := h.OnAccept(conn)
+		if err != nil {
+			return fmt.Errorf("OnAccept: %v", err)
+		}
+		conn = wrapped
+		defer conn.Close()
+	}
+	if h.TrustProxyProtocol && fourtosix.PeerIsTrusted(h.TrustedProxies, conn.RemoteAddr()) {
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		pconn, err := h.srv.StripProxyHeader(h.options(), conn)
+		if err != nil {
+			return err
+		}
+		conn = pconn
+		var zero time.Time
+		conn.SetDeadline(zero)
+	}
+	h.logf("[%s] got connection", conn.RemoteAddr())
+	ctx, done := h.srv.Accept(h.Name, conn)
+	defer done()
+
+	clientIP := conn.RemoteAddr().String()
+	if host, _, err := net.SplitHostPort(clientIP); err == nil {
+		clientIP = host
+	}
+	if !h.clientConns.Acquire(clientIP, h.MaxConnectionsPerClientIP) {
+		h.rejected(conn, fourtosix.RejectOverCapacity)
+		return fmt.Errorf("blocked: too many connections from %s", clientIP)
+	}
+	defer h.clientConns.Release(clientIP)
+
+	if h.PerClientByteQuota != nil && h.PerClientByteQuota.Exceeded(clientIP) {
+		h.rejected(conn, fourtosix.RejectOverCapacity)
+		return fmt.Errorf("blocked: %s has exceeded its byte quota", clientIP)
+	}
+
+	if h.Backend == "" {
+		h.rejected(conn, fourtosix.RejectNoHostname)
+		return fmt.Errorf("no backend configured")
+	}
+
+	if !h.hostConns.Acquire(h.Backend, h.MaxConnectionsPerHost) {
+		h.rejected(conn, fourtosix.RejectOverCapacity)
+		return fmt.Errorf("connect %s blocked: too many connections", h.Backend)
+	}
+	defer h.hostConns.Release(h.Backend)
+
+	cctx := &fourtosix.ConnContext{Context: ctx}
+	opts := h.options()
+	rconn, _, err := h.srv.Connect(cctx, opts, conn, h.Backend, []string{h.Backend}, nil)
+	if err != nil {
+		h.rejected(conn, fourtosix.RejectDialFailed)
+		return fmt.Errorf("connect %s: %v", h.Backend, err)
+	}
+	defer rconn.Close()
+	dialedAt := time.Now()
+
+	if h.AfterDial != nil {
+		wrapped, err := h.AfterDial(cctx, rconn)
+		if err != nil {
+			h.rejected(conn, fourtosix.RejectDialFailed)
+			return fmt.Errorf("AfterDial for %s: %v", h.Backend, err)
+		}
+		rconn = wrapped
+		defer rconn.Close()
+	}
+
+	h.srv.Relay(ctx, opts, conn, rconn, h.Backend, dialedAt)
+	return nil
+}
+
+// logf logs a message, prefixed with the handler's Name if it has one.
+func (h *Handler) logf(format string, args ...interface{}) {
+	fourtosix.Logf(h.Name, format, args...)
+}
+
+func (h *Handler) rejected(conn net.Conn, reason fourtosix.RejectReason) {
+	h.srv.Rejected(h.options(), conn, "", reason)
+}
+
+// Validate checks the handler's configuration for mistakes which would otherwise only show up as connections fail.
+// Serve calls it before accepting any connections.
+func (h *Handler) Validate() error {
+	if h.Backend == "" {
+		return errors.New("no Backend configured")
+	}
+	if err := fourtosix.ValidateAddress(h.Backend); err != nil {
+		return fmt.Errorf("Backend: %v", err)
+	}
+	return h.options().Validate()
+}
+
+// Serve accepts connections from l and proxies them, until l fails or the handler is shut down.
+// After Shutdown or Drain, Serve returns fourtosix.ErrHandlerClosed.
+func (h *Handler) Serve(l net.Listener) error {
+	if err := h.Validate(); err != nil {
+		return fmt.Errorf("invalid configuration: %v", err)
+	}
+	return h.srv.Serve(l, h.options(), h.ServeConn)
+}
+
+// ListenAndServe listens on the given network address and then calls Serve to handle its connections.
+func (h *Handler) ListenAndServe(network, addr string) error {
+	return fourtosix.ListenAndServe(network, addr, h.Serve)
+}
+
+// Shutdown stops all Serve calls from accepting new connections, and forcibly closes any in-flight connections.
+func (h *Handler) Shutdown() error {
+	return h.srv.Shutdown()
+}
+
+// Drain stops all Serve calls from accepting new connections, but lets in-flight connections run to completion.
+// Shutdown may still be called afterwards to close them.
+func (h *Handler) Drain() error {
+	return h.srv.Drain()
+}
+
+// Events returns a channel on which events are delivered as connections progress.
+// Events are dropped if the channel is full; until Events is first called, none are delivered.
+func (h *Handler) Events() <-chan fourtosix.ConnEvent {
+	return h.srv.Events()
+}
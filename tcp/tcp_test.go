@@ -0,0 +1,385 @@
+package tcp
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"os"
+	"reflect"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/lukegb/fourtosix"
+	"github.com/lukegb/fourtosix/internal/fakeconn"
+)
+
+func TestServeConnProxies(t *testing.T) {
+	d := &fakeconn.Dialer{Backend: func(conn net.Conn, _ string) {
+		got := make([]byte, 4)
+		if _, err := io.ReadFull(conn, got); err != nil {
+			t.Errorf("backend reading: %v", err)
+			return
+		}
+		if string(got) != "ping" {
+			t.Errorf("backend got %q, want %q", got, "ping")
+		}
+		conn.Write([]byte("pong"))
+	}}
+	h := &Handler{Backend: "backend.example:5000", MakeDialer: d.MakeDialer}
+
+	conn := fakeconn.New(fakeconn.ClientAddr, []byte("ping"))
+	conn.CloseInput()
+	if err := h.ServeConn(conn); err != nil {
+		t.Fatalf("ServeConn: %v", err)
+	}
+	if dialed := d.Dialed(); len(dialed) != 1 || dialed[0] != h.Backend {
+		t.Errorf("dialed %q, want [%s]", dialed, h.Backend)
+	}
+	if got := string(conn.Written()); got != "pong" {
+		t.Errorf("client got %q, want %q", got, "pong")
+	}
+}
+
+func TestServeConnDialFailure(t *testing.T) {
+	d := &fakeconn.Dialer{Err: errors.New("unreachable")}
+	cb := &fourtosix.CircuitBreaker{Threshold: 1, Cooldown: 1 << 40}
+	h := &Handler{Backend: "backend.example:5000", MakeDialer: d.MakeDialer, CircuitBreaker: cb}
+	events := h.Events()
+
+	conn := fakeconn.New(fakeconn.ClientAddr, nil)
+	conn.CloseInput()
+	if err := h.ServeConn(conn); err == nil {
+		t.Fatal("ServeConn succeeded with an unreachable backend")
+	}
+	if cb.Allow(h.Backend) {
+		t.Error("dial failure wasn't reported to the circuit breaker")
+	}
+
+	var rejected, closed bool
+	for len(events) > 0 {
+		switch ev := <-events; ev.Type {
+		case fourtosix.ConnRejected:
+			rejected = ev.Reason == fourtosix.RejectDialFailed
+		case fourtosix.ConnClosed:
+			closed = true
+		}
+	}
+	if !rejected || !closed {
+		t.Errorf("got ConnRejected for a failed dial: %v; got ConnClosed: %v; want both", rejected, closed)
+	}
+}
+
+func TestValidateTrustProxyProtocolNeedsTrustedProxies(t *testing.T) {
+	h := &Handler{Backend: "backend.example:5000", TrustProxyProtocol: true}
+	if err := h.Validate(); err == nil {
+		t.Error("Validate accepted TrustProxyProtocol with no TrustedProxies")
+	}
+	_, all, _ := net.ParseCIDR("0.0.0.0/0")
+	h.TrustedProxies = []net.IPNet{*all}
+	if err := h.Validate(); err != nil {
+		t.Errorf("Validate: %v", err)
+	}
+}
+
+func TestServeConnBadProxyHeaderEmitsClosed(t *testing.T) {
+	h := &Handler{
+		Backend:            "backend.example:5000",
+		MakeDialer:         (&fakeconn.Dialer{}).MakeDialer,
+		TrustProxyProtocol: true,
+		TrustedProxies:     []net.IPNet{{IP: fakeconn.ClientAddr.IP, Mask: net.CIDRMask(32, 32)}},
+	}
+	events := h.Events()
+	conn := fakeconn.New(fakeconn.ClientAddr, []byte("ping"))
+	conn.CloseInput()
+	if err := h.ServeConn(conn); err == nil {
+		t.Fatal("ServeConn without a PROXY header succeeded")
+	}
+
+	var got []fourtosix.ConnEventType
+	for len(events) > 0 {
+		got = append(got, (<-events).Type)
+	}
+	if want := []fourtosix.ConnEventType{fourtosix.ConnAccepted, fourtosix.ConnRejected, fourtosix.ConnClosed}; !reflect.DeepEqual(got, want) {
+		t.Errorf("events %v, want %v", got, want)
+	}
+}
+
+func TestServeConnOnAccept(t *testing.T) {
+	d := &fakeconn.Dialer{Backend: func(conn net.Conn, _ string) {
+		got := make([]byte, len("wrapped"))
+		io.ReadFull(conn, got)
+		conn.Write(got)
+	}}
+	var wrapped *fakeconn.Conn
+	h := &Handler{
+		Backend:    "backend.example:5000",
+		MakeDialer: d.MakeDialer,
+		OnAccept: func(conn net.Conn) (net.Conn, error) {
+			// The wrapping connection replaces the original, so its input is what gets relayed.
+			wrapped = fakeconn.New(conn.RemoteAddr().(*net.TCPAddr), []byte("wrapped"))
+			wrapped.CloseInput()
+			return wrapped, nil
+		},
+	}
+	conn := fakeconn.New(fakeconn.ClientAddr, []byte("original"))
+	conn.CloseInput()
+	if err := h.ServeConn(conn); err != nil {
+		t.Fatalf("ServeConn: %v", err)
+	}
+	if got := string(wrapped.Written()); got != "wrapped" {
+		t.Errorf("wrapped connection got %q, want %q", got, "wrapped")
+	}
+	if len(conn.Written()) != 0 {
+		t.Errorf("original connection got %q, want nothing", conn.Written())
+	}
+	if !conn.Closed() || !wrapped.Closed() {
+		t.Errorf("original closed: %v; wrapped closed: %v; want both", conn.Closed(), wrapped.Closed())
+	}
+
+	h.OnAccept = func(net.Conn) (net.Conn, error) { return nil, errors.New("not today") }
+	conn = fakeconn.New(fakeconn.ClientAddr, []byte("original"))
+	conn.CloseInput()
+	if err := h.ServeConn(conn); err == nil {
+		t.Error("ServeConn succeeded when OnAccept failed")
+	}
+	if !conn.Closed() {
+		t.Error("connection left open after OnAccept failed")
+	}
+	if dialed := d.Dialed(); len(dialed) != 1 {
+		t.Errorf("dialed %q, want only the first connection's backend", dialed)
+	}
+}
+
+// nameRecordingDialer records the handler name carried by the context of each dial.
+type nameRecordingDialer struct {
+	fourtosix.Dialer
+	names *[]string
+}
+
+func (d nameRecordingDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	*d.names = append(*d.names, fourtosix.HandlerName(ctx))
+	return d.Dialer.DialContext(ctx, network, address)
+}
+
+func TestServeConnName(t *testing.T) {
+	d := &fakeconn.Dialer{}
+	var names []string
+	h := &Handler{
+		Name:    "edge",
+		Backend: "backend.example:5000",
+		MakeDialer: func(conn net.Conn, ctx fourtosix.Context) fourtosix.Dialer {
+			return nameRecordingDialer{d.MakeDialer(conn, ctx), &names}
+		},
+	}
+
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	defer log.SetOutput(os.Stderr)
+	conn := fakeconn.New(fakeconn.ClientAddr, nil)
+	conn.CloseInput()
+	if err := h.ServeConn(conn); err != nil {
+		t.Fatalf("ServeConn: %v", err)
+	}
+	log.SetOutput(os.Stderr)
+
+	if len(names) != 1 || names[0] != "edge" {
+		t.Errorf("dialed with handler names %q, want [edge]", names)
+	}
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	for _, line := range lines {
+		if !strings.Contains(line, "[edge] [192.0.2.1:1234] ") {
+			t.Errorf("log line %q isn't tagged with the handler name", line)
+		}
+	}
+}
+
+func TestServeConnMaxConnectionsPerClientIP(t *testing.T) {
+	// The first backend connection stays open until released; later ones close straight away.
+	dialed := make(chan struct{})
+	release := make(chan struct{})
+	var dials int32
+	d := &fakeconn.Dialer{Backend: func(net.Conn, string) {
+		if atomic.AddInt32(&dials, 1) == 1 {
+			close(dialed)
+			<-release
+		}
+	}}
+	h := &Handler{Backend: "backend.example:5000", MakeDialer: d.MakeDialer, MaxConnectionsPerClientIP: 1}
+	events := h.Events()
+
+	first := fakeconn.New(fakeconn.ClientAddr, nil)
+	errc := make(chan error, 1)
+	go func() { errc <- h.ServeConn(first) }()
+	<-dialed
+
+	// Another port on the same address counts against the same limit.
+	sameIP := fakeconn.New(&net.TCPAddr{IP: fakeconn.ClientAddr.IP, Port: 4321}, nil)
+	sameIP.CloseInput()
+	if err := h.ServeConn(sameIP); err == nil {
+		t.Error("ServeConn accepted a second connection from the same client")
+	}
+	var rejected []fourtosix.RejectReason
+	for len(events) > 0 {
+		if ev := <-events; ev.Type == fourtosix.ConnRejected {
+			rejected = append(rejected, ev.Reason)
+		}
+	}
+	if want := []fourtosix.RejectReason{fourtosix.RejectOverCapacity}; !reflect.DeepEqual(rejected, want) {
+		t.Errorf("rejections %v, want %v", rejected, want)
+	}
+
+	other := fakeconn.New(&net.TCPAddr{IP: net.IPv4(192, 0, 2, 2), Port: 1234}, nil)
+	other.CloseInput()
+	if err := h.ServeConn(other); err != nil {
+		t.Errorf("ServeConn from another client: %v", err)
+	}
+
+	close(release)
+	first.CloseInput()
+	if err := <-errc; err != nil {
+		t.Fatalf("ServeConn: %v", err)
+	}
+	// Once the first connection has closed, its client can connect again.
+	again := fakeconn.New(fakeconn.ClientAddr, nil)
+	again.CloseInput()
+	if err := h.ServeConn(again); err != nil {
+		t.Errorf("ServeConn after the first connection closed: %v", err)
+	}
+}
+
+func TestServeConnAfterDial(t *testing.T) {
+	d := &fakeconn.Dialer{Backend: func(conn net.Conn, _ string) {
+		got, _ := io.ReadAll(io.LimitReader(conn, int64(len("hello ping"))))
+		if string(got) != "hello ping" {
+			t.Errorf("backend got %q, want the AfterDial greeting then the client's data", got)
+		}
+	}}
+	h := &Handler{
+		Backend:    "backend.example:5000",
+		MakeDialer: d.MakeDialer,
+		AfterDial: func(ctx fourtosix.Context, rconn net.Conn) (net.Conn, error) {
+			if _, ok := ctx.(*fourtosix.ConnContext); !ok {
+				t.Errorf("AfterDial got context %T, want *fourtosix.ConnContext", ctx)
+			}
+			_, err := rconn.Write([]byte("hello "))
+			return rconn, err
+		},
+	}
+	conn := fakeconn.New(fakeconn.ClientAddr, []byte("ping"))
+	conn.CloseInput()
+	if err := h.ServeConn(conn); err != nil {
+		t.Fatalf("ServeConn: %v", err)
+	}
+
+	backendRead := make(chan error, 1)
+	d.Backend = func(conn net.Conn, _ string) {
+		_, err := conn.Read(make([]byte, 1))
+		backendRead <- err
+	}
+	h.AfterDial = func(fourtosix.Context, net.Conn) (net.Conn, error) { return nil, errors.New("handshake failed") }
+	events := h.Events()
+	conn = fakeconn.New(fakeconn.ClientAddr, []byte("ping"))
+	conn.CloseInput()
+	if err := h.ServeConn(conn); err == nil {
+		t.Fatal("ServeConn succeeded when AfterDial failed")
+	}
+	if !conn.Closed() {
+		t.Error("client connection left open after AfterDial failed")
+	}
+	var rejected []fourtosix.RejectReason
+	for len(events) > 0 {
+		if ev := <-events; ev.Type == fourtosix.ConnRejected {
+			rejected = append(rejected, ev.Reason)
+		}
+	}
+	if want := []fourtosix.RejectReason{fourtosix.RejectDialFailed}; !reflect.DeepEqual(rejected, want) {
+		t.Errorf("rejections %v, want %v", rejected, want)
+	}
+	select {
+	case err := <-backendRead:
+		if err == nil {
+			t.Error("backend received data after AfterDial failed")
+		}
+	case <-time.After(time.Second):
+		t.Error("backend connection left open after AfterDial failed")
+	}
+}
+
+func TestServeConnResetOnReject(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	for _, reset := range []bool{false, true} {
+		// With no Backend configured, every connection is rejected.
+		h := &Handler{ResetOnReject: reset}
+		client, err := net.Dial("tcp", l.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer client.Close()
+		conn, err := l.Accept()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := h.ServeConn(conn); err == nil {
+			t.Fatal("ServeConn with no Backend succeeded")
+		}
+
+		client.SetReadDeadline(time.Now().Add(time.Second))
+		_, err = client.Read(make([]byte, 1))
+		if got := errors.Is(err, syscall.ECONNRESET); got != reset {
+			t.Errorf("ResetOnReject=%v: client read got %v, want a reset: %v", reset, err, reset)
+		}
+	}
+}
+
+func TestServeValidatesConfiguration(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	for i, h := range []*Handler{
+		{},
+		{Backend: "backend.example"},
+		{Backend: ":5000"},
+		{Backend: "backend.example:0"},
+		{Backend: "backend.example:5000", ForceNetwork: "udp"},
+		{Backend: "backend.example:5000", MakeDialer: (&fakeconn.Dialer{}).MakeDialer, ConnectionPool: &fourtosix.ConnectionPool{}},
+	} {
+		done := make(chan error, 1)
+		go func() { done <- h.Serve(l) }()
+		select {
+		case err := <-done:
+			if err == nil || !strings.Contains(err.Error(), "invalid configuration") {
+				t.Errorf("case %d: Serve = %v, want an invalid configuration error", i, err)
+			}
+		case <-time.After(time.Second):
+			h.Shutdown()
+			t.Errorf("case %d: Serve accepted connections with an invalid configuration", i)
+		}
+	}
+
+	h := &Handler{Backend: "backend.example:5000"}
+	done := make(chan error, 1)
+	go func() { done <- h.Serve(l) }()
+	select {
+	case err := <-done:
+		t.Fatalf("Serve with a valid configuration returned %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+	h.Shutdown()
+	if err := <-done; !errors.Is(err, fourtosix.ErrHandlerClosed) {
+		t.Errorf("Serve after Shutdown = %v, want %v", err, fourtosix.ErrHandlerClosed)
+	}
+}
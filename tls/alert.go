@@ -0,0 +1,19 @@
+package tls
+
+// Alert is a TLS alert description, sent to a client to explain why its connection is being closed.
+type Alert uint8
+
+// Alerts which are useful for rejecting a connection. See RFC 8446 section 6.2 for the full list.
+const (
+	AlertRecordOverflow     Alert = 22
+	AlertHandshakeFailure   Alert = 40
+	AlertCertificateExpired Alert = 45
+	AlertAccessDenied       Alert = 49
+	AlertDecodeError        Alert = 50
+	AlertProtocolVersion    Alert = 70
+	AlertInternalError      Alert = 80
+	AlertUnrecognizedName   Alert = 112
+
+	// NoAlert can be used in place of an alert to close a connection without sending anything.
+	NoAlert Alert = 255
+)
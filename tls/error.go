@@ -4,14 +4,18 @@ import "fmt"
 
 type tlsError struct {
 	err   error
-	alert uint8
+	alert Alert
 }
 
 func (err *tlsError) Error() string {
 	return err.err.Error()
 }
 
-func tlsErrorf(alert uint8, msgf string, params ...interface{}) *tlsError {
+func (err *tlsError) Unwrap() error {
+	return err.err
+}
+
+func tlsErrorf(alert Alert, msgf string, params ...interface{}) *tlsError {
 	return &tlsError{
 		err:   fmt.Errorf(msgf, params...),
 		alert: alert,
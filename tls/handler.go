@@ -1,132 +1,578 @@
 package tls
 
 import (
+	"bytes"
 	"context"
+	cryptotls "crypto/tls"
+	"errors"
 	"fmt"
 	"io"
-	"log"
 	"net"
 	"strings"
-	"sync"
 	"time"
 
 	"github.com/lukegb/fourtosix"
 )
 
 type Handler struct {
+	// Name, if set, tags this handler's logs and, via fourtosix.HandlerName, its dial contexts.
+	Name string
+
 	RemotePort int
 
+	// PortForALPN maps ALPN protocols to the backend port used in place of RemotePort. The first
+	// offered protocol with an entry wins.
+	PortForALPN map[string]int
+
 	AllowedHostSuffixes []string
 
 	HostnameIsAllowed func(string) bool
 
 	MakeDialer func(net.Conn, fourtosix.Context) fourtosix.Dialer
 
+	// ConnectionPool, if set, supplies backend connections in place of MakeDialer.
+	ConnectionPool *fourtosix.ConnectionPool
+
 	ForceNetwork string
+
+	// BlockedAlert is sent to clients whose hostname is not allowed. If zero, AlertUnrecognizedName
+	// is sent; NoAlert sends nothing.
+	BlockedAlert Alert
+
+	// DialFailureAlert is sent to clients whose backend couldn't be reached. If zero,
+	// AlertInternalError is sent; NoAlert sends nothing.
+	DialFailureAlert Alert
+
+	// SilentDrop closes connections with a missing or disallowed server_name without an alert, so
+	// scanners learn nothing. It overrides BlockedAlert.
+	SilentDrop bool
+
+	// ResetOnReject closes rejected connections with a TCP RST rather than a FIN. Any alert
+	// is still sent first, but may not arrive.
+	ResetOnReject bool
+
+	// RejectHosts maps normalized hostnames to the alert sent instead of proxying them, such as
+	// AlertCertificateExpired, or NoAlert.
+	RejectHosts map[string]Alert
+
+	// LocalTLS maps normalized hostnames to a configuration for terminating TLS here instead of
+	// proxying, such as for ACME tls-alpn-01. Hostname checks and routing are skipped.
+	LocalTLS map[string]*cryptotls.Config
+
+	// ServeLocal, if set, serves each LocalTLS connection after its handshake; the connection is
+	// closed when it returns. If nil, it is closed straight after the handshake.
+	ServeLocal func(conn *cryptotls.Conn, hostname string)
+
+	// RejectEncryptedClientHello rejects ECH connections instead of routing on the outer name.
+	RejectEncryptedClientHello bool
+
+	// EarlyDataAlert, if set, rejects connections offering 0-RTT early data with this alert.
+	EarlyDataAlert Alert
+
+	// AllowIPLiteralServerName permits IP address server_names, which RFC 6066 forbids.
+	AllowIPLiteralServerName bool
+
+	// DefaultBackend, if set, is the address (host:port) for connections with a missing or
+	// disallowed server_name. If unset, they are rejected.
+	DefaultBackend string
+
+	// Middleware wraps each connection Serve accepts, first entry outermost. ServeConn skips it.
+	Middleware []fourtosix.Middleware
+
+	// OnAccept, if set, may replace each connection before anything is read from it. If it returns
+	// an error, the connection is closed.
+	OnAccept func(net.Conn) (net.Conn, error)
+
+	// AuditLog, if set, receives a fourtosix.AuditRecord JSON line per rejected connection.
+	AuditLog io.Writer
+
+	// Metrics, if set, is notified about rejected connections and backend responses.
+	Metrics fourtosix.Metrics
+
+	// MinVersion, if set, is the lowest TLS version (e.g. VersionTLS13) a client must offer.
+	// Other clients get a protocol_version alert.
+	MinVersion uint16
+
+	// AllowedRecordVersions, if set, lists the record versions a ClientHello may use, such as
+	// 0x0301 and 0x0303. Others get a protocol_version alert, a crude filter for scanners.
+	AllowedRecordVersions []uint16
+
+	// LogClientHellos logs each ClientHello's server_name, version and cipher and extension counts.
+	LogClientHellos bool
+
+	// FingerprintIsAllowed, if set, is called with the JA4 fingerprint of each ClientHello.
+	// Connections for which it returns false are rejected with an access_denied alert.
+	FingerprintIsAllowed func(ja4 string) bool
+
+	// RewriteClientHello, if set, returns the bytes to replay to the backend in place of raw.
+	// The result must parse as a ClientHello.
+	RewriteClientHello func(hello *ClientHello, raw []byte) ([]byte, error)
+
+	// StrictRouting only allows hostnames matching AllowedHostSuffixes or BackendsForHost, so an
+	// empty allowlist denies everything. It has no effect if HostnameIsAllowed is set.
+	StrictRouting bool
+
+	// MaxConnectionsPerClientIP, if positive, limits concurrent connections per client address.
+	MaxConnectionsPerClientIP int
+
+	// PerClientByteQuota, if set, limits the bytes relayed per client address in each window.
+	// Over it, connections are closed and new ones rejected until the window resets.
+	PerClientByteQuota *fourtosix.ByteQuota
+
+	// MaxConnectionsPerHost, if positive, limits concurrent connections per backend.
+	MaxConnectionsPerHost int
+
+	// NextHop, if set, is the address (host:port) every connection not for DefaultBackend is sent
+	// to. The ClientHello is still replayed unchanged.
+	NextHop string
+
+	// BackendsForHost, if set, returns the addresses (host:port) to try in order for a hostname.
+	// If it returns nothing, the usual backend is used.
+	BackendsForHost func(hostname string) []string
+
+	// CircuitBreaker, if set, stops dials to backends which have been failing repeatedly.
+	CircuitBreaker *fourtosix.CircuitBreaker
+
+	// AfterDial, if set, may replace each new backend connection. If it returns an error, the
+	// client's connection is closed.
+	AfterDial func(ctx fourtosix.Context, rconn net.Conn) (net.Conn, error)
+
+	// PreferIPv6 resolves backend hostnames before dialing, and connects to their IPv6 addresses
+	// in preference to IPv4, which is only used if a backend has no IPv6 addresses.
+	PreferIPv6 bool
+
+	// NoDelay, if set, is passed to SetNoDelay on both sides of each connection. Go defaults to
+	// true, so only false, to coalesce small writes, changes anything.
+	NoDelay *bool
+
+	// TrustProxyProtocol reads a PROXY header from each connection and uses its client address.
+	TrustProxyProtocol bool
+
+	// TrustedProxies limits TrustProxyProtocol to peers in these networks, and must be set with it.
+	// To trust every peer, list 0.0.0.0/0 and ::/0.
+	TrustedProxies []net.IPNet
+
+	// StartupRampDuration, if set, ramps up Serve's accept rate over this period.
+	StartupRampDuration time.Duration
+
+	// TransparentMode sends each connection, unread, to its destination before netfilter
+	// redirected it. Linux only.
+	TransparentMode bool
+
+	// HandshakeProgressTimeout, if set, is how long a client may stall mid-ClientHello. Each read
+	// pushes it back, up to the 5 second absolute limit.
+	HandshakeProgressTimeout time.Duration
+
+	// EstablishTimeout, if positive, limits the time from accept to backend connection, covering
+	// both the ClientHello and the dial.
+	EstablishTimeout time.Duration
+
+	// MaxConcurrentHandshakes, if positive, limits how many ClientHellos are read at once. Others
+	// wait, until their handshake deadline.
+	MaxConcurrentHandshakes int
+
+	// IdleTimeout, if positive, closes connections after this long with no data either way.
+	IdleTimeout time.Duration
+
+	// MaxHandshakeRecords limits the records a ClientHello may span. If zero, 16 is used.
+	MaxHandshakeRecords int
+
+	// RelayBufferSize, if positive, is the relay's copy buffer size.
+	RelayBufferSize int
+
+	srv         fourtosix.Server
+	hostConns   fourtosix.ConnCounter
+	clientConns fourtosix.ConnCounter
+	handshakes  fourtosix.Semaphore
+}
+
+// options returns the handler's configuration in the form fourtosix.Server takes it.
+func (h *Handler) options() *fourtosix.HandlerOptions {
+	return &fourtosix.HandlerOptions{
+		Name:                h.Name,
+		Middleware:          h.Middleware,
+		StartupRampDuration: h.StartupRampDuration,
+		ResetOnReject:       h.ResetOnReject,
+		Metrics:             h.Metrics,
+		AuditLog:            h.AuditLog,
+		MakeDialer:          h.MakeDialer,
+		ConnectionPool:      h.ConnectionPool,
+		PreferIPv6:          h.PreferIPv6,
+		CircuitBreaker:      h.CircuitBreaker,
+		ForceNetwork:        h.ForceNetwork,
+		NoDelay:             h.NoDelay,
+		TrustProxyProtocol:  h.TrustProxyProtocol,
+		TrustedProxies:      h.TrustedProxies,
+		IdleTimeout:         h.IdleTimeout,
+		RelayBufferSize:     h.RelayBufferSize,
+		PerClientByteQuota:  h.PerClientByteQuota,
+	}
+}
+
+// routing returns the handler's routing configuration.
+func (h *Handler) routing() *fourtosix.Routing {
+	return &fourtosix.Routing{
+		HostnameIsAllowed:   h.HostnameIsAllowed,
+		AllowedHostSuffixes: h.AllowedHostSuffixes,
+		StrictRouting:       h.StrictRouting,
+		DefaultBackend:      h.DefaultBackend,
+		NextHop:             h.NextHop,
+		BackendsForHost:     h.BackendsForHost,
+	}
 }
 
-func (h *Handler) handle(conn net.Conn) {
+// ServeConn proxies a single accepted connection, returning once it has been closed.
+// It is safe to call concurrently, and can be used to drive the handler without a net.Listener.
+// The returned error describes why the connection was rejected, if it was.
+func (h *Handler) ServeConn(conn net.Conn) error {
 	defer conn.Close()
-	conn.SetDeadline(time.Now().Add(5 * time.Second))
-	log.Printf("[%s] got connection", conn.RemoteAddr())
+	if h.OnAccept != nil {
+		wrapped, err := h.OnAccept(conn)
+		if err != nil {
+			return fmt.Errorf("OnAccept: %v", err)
+		}
+		conn = wrapped
+		defer conn.Close()
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	conn.SetDeadline(deadline)
+	conn, err := h.srv.StripProxyHeader(h.options(), conn)
+	if err != nil {
+		return err
+	}
+	start := time.Now()
+	h.logf("[%s] got connection", conn.RemoteAddr())
+	ctx, done := h.srv.Accept(h.Name, conn)
+	defer done()
 
-	ctx, cancel := context.WithCancel(context.Background())
-	defer cancel()
+	clientIP := conn.RemoteAddr().String()
+	if host, _, err := net.SplitHostPort(clientIP); err == nil {
+		clientIP = host
+	}
+	if !h.clientConns.Acquire(clientIP, h.MaxConnectionsPerClientIP) {
+		sendTLSAlert(conn, AlertInternalError)
+		h.rejected(conn, "", fourtosix.RejectOverCapacity)
+		return fmt.Errorf("blocked: too many connections from %s", clientIP)
+	}
+	defer h.clientConns.Release(clientIP)
+
+	if h.PerClientByteQuota != nil && h.PerClientByteQuota.Exceeded(clientIP) {
+		sendTLSAlert(conn, AlertInternalError)
+		h.rejected(conn, "", fourtosix.RejectOverCapacity)
+		return fmt.Errorf("blocked: %s has exceeded its byte quota", clientIP)
+	}
 
-	mr := &fourtosix.MemorizingReader{Reader: conn}
-	hi, err := readClientHello(mr)
+	establishCtx, cancelEstablish := fourtosix.EstablishContext(ctx, start, h.EstablishTimeout)
+	defer cancelEstablish()
+
+	if h.TransparentMode {
+		dst, err := fourtosix.OriginalDestination(conn)
+		if err != nil {
+			h.rejected(conn, "", fourtosix.RejectNoHostname)
+			return fmt.Errorf("transparent mode: %v", err)
+		}
+		return h.proxy(&fourtosix.ConnContext{Context: ctx, OriginalDestination: dst}, conn, dst.String(), []string{dst.String()}, nil, start)
+	}
+
+	waitCtx, cancelWait := context.WithDeadline(establishCtx, deadline)
+	releaseHandshake, err := h.handshakes.Acquire(waitCtx, h.MaxConcurrentHandshakes)
+	cancelWait()
+	if err != nil {
+		if establishCtx.Err() != nil {
+			return fmt.Errorf("handshake interrupted: %v", establishCtx.Err())
+		}
+		sendTLSAlert(conn, AlertInternalError)
+		h.rejected(conn, "", fourtosix.RejectOverCapacity)
+		return fmt.Errorf("blocked: too many handshakes in progress")
+	}
+
+	mr := &fourtosix.MemorizingReader{Reader: fourtosix.NewProgressReader(conn, h.HandshakeProgressTimeout, deadline)}
+	// Shutdown closes the connection to abort a handshake still being read.
+	stop := context.AfterFunc(establishCtx, func() { conn.Close() })
+	maxRecords := h.MaxHandshakeRecords
+	if maxRecords == 0 {
+		maxRecords = defaultMaxHandshakeRecords
+	}
+	hi, err := readClientHello(mr, maxRecords)
+	stop()
+	releaseHandshake()
+	if err != nil && establishCtx.Err() != nil {
+		return fmt.Errorf("handshake interrupted: %v", establishCtx.Err())
+	}
 	if err != nil {
-		log.Printf("[%s] readClientHello: %v", conn.RemoteAddr(), err)
-		alert := alertInternalError
+		alert := AlertInternalError
 		if tlsErr, ok := err.(*tlsError); ok {
 			alert = tlsErr.alert
 		}
 		sendTLSAlert(conn, alert)
-		return
+		if errors.Is(err, errMessageTooLarge) || errors.Is(err, errRecordTooLarge) || errors.Is(err, errTooManyRecords) {
+			h.rejected(conn, "", fourtosix.RejectOversized)
+		} else {
+			h.rejected(conn, "", fourtosix.RejectMalformed)
+		}
+		return fmt.Errorf("readClientHello: %v", err)
+	}
+	if h.LogClientHellos {
+		v := hi.Version()
+		h.logf("[%s] ClientHello sni=%s version=%d.%d ciphers=%d ext=%d", conn.RemoteAddr(), hi.ServerName, v>>8, v&0xff, len(hi.CipherSuites), len(hi.Extensions))
+	}
+	hostname := hi.ServerName
+	if hostname != "" {
+		if hostname, err = fourtosix.NormalizeHostname(hostname); err != nil {
+			sendTLSAlert(conn, AlertUnrecognizedName)
+			h.rejected(conn, hi.ServerName, fourtosix.RejectMalformed)
+			return fmt.Errorf("server_name %q could not be normalized: %v", hi.ServerName, err)
+		}
+
+		if net.ParseIP(strings.Trim(hostname, "[]")) != nil {
+			if !h.AllowIPLiteralServerName {
+				sendTLSAlert(conn, AlertUnrecognizedName)
+				h.rejected(conn, hostname, fourtosix.RejectPolicy)
+				return fmt.Errorf("connect %s blocked: server_name is an IP literal", hi.ServerName)
+			}
+		} else if !fourtosix.ValidHostname(hostname) {
+			sendTLSAlert(conn, AlertUnrecognizedName)
+			h.rejected(conn, hostname, fourtosix.RejectMalformed)
+			return fmt.Errorf("server_name %q is not a valid hostname", hi.ServerName)
+		}
+	}
+
+	h.srv.Emit(fourtosix.ConnEvent{Type: fourtosix.ConnParsedHostname, Client: conn.RemoteAddr(), Hostname: hostname})
+
+	if alert, ok := h.RejectHosts[hostname]; ok && hostname != "" {
+		sendTLSAlert(conn, alert)
+		h.rejected(conn, hostname, fourtosix.RejectPolicy)
+		return fmt.Errorf("connect %s blocked: hostname rejected with alert %d", hostname, alert)
+	}
+
+	if hi.EncryptedClientHello && h.RejectEncryptedClientHello {
+		sendTLSAlert(conn, AlertUnrecognizedName)
+		h.rejected(conn, hostname, fourtosix.RejectPolicy)
+		return fmt.Errorf("connect %s blocked: encrypted_client_hello not permitted", hi.ServerName)
+	}
+
+	if hi.EarlyData && h.EarlyDataAlert != 0 {
+		sendTLSAlert(conn, h.EarlyDataAlert)
+		h.rejected(conn, hostname, fourtosix.RejectPolicy)
+		return fmt.Errorf("connect %s blocked: early_data not permitted", hi.ServerName)
+	}
+
+	if h.MinVersion != 0 && hi.Version() < h.MinVersion {
+		sendTLSAlert(conn, AlertProtocolVersion)
+		h.rejected(conn, hostname, fourtosix.RejectPolicy)
+		return fmt.Errorf("client's highest version %#04x is below the minimum of %#04x", hi.Version(), h.MinVersion)
+	}
+
+	if len(h.AllowedRecordVersions) > 0 {
+		rv := uint16(hi.RecordVersion.Major)<<8 | uint16(hi.RecordVersion.Minor)
+		if !containsVersion(h.AllowedRecordVersions, rv) {
+			sendTLSAlert(conn, AlertProtocolVersion)
+			h.rejected(conn, hostname, fourtosix.RejectPolicy)
+			return fmt.Errorf("record version %#04x is not allowed", rv)
+		}
 	}
-	if hi.ServerName == "" {
-		log.Printf("[%s] no server_name", conn.RemoteAddr())
-		sendTLSAlert(conn, alertUnrecognizedName)
-		return
+
+	if h.FingerprintIsAllowed != nil {
+		if ja4 := hi.JA4(); !h.FingerprintIsAllowed(ja4) {
+			sendTLSAlert(conn, AlertAccessDenied)
+			h.rejected(conn, hostname, fourtosix.RejectPolicy)
+			return fmt.Errorf("connect %s blocked: fingerprint %s not allowed", hi.ServerName, ja4)
+		}
+	}
+
+	if config, ok := h.LocalTLS[hostname]; ok && hostname != "" {
+		return h.serveLocal(ctx, conn, hostname, config, mr.Buffer())
 	}
 
 	rport := h.RemotePort
 	if rport == 0 {
 		rport = 443
 	}
+	for _, proto := range hi.ALPNProtocols {
+		if p, ok := h.PortForALPN[proto]; ok {
+			rport = p
+			break
+		}
+	}
 
-	rnet := h.ForceNetwork
-	if rnet == "" {
-		rnet = "tcp"
+	usingDefault := false
+	raddr := net.JoinHostPort(hostname, fmt.Sprintf("%d", rport))
+	if hostname == "" {
+		if h.DefaultBackend == "" {
+			sendTLSAlert(conn, h.dropAlert(AlertUnrecognizedName))
+			h.rejected(conn, hostname, fourtosix.RejectNoHostname)
+			return fmt.Errorf("no server_name")
+		}
+		h.logf("[%s] no server_name, using default backend", conn.RemoteAddr())
+		raddr = h.DefaultBackend
+		usingDefault = true
+	} else if !h.routing().Allowed(hostname) {
+		if h.DefaultBackend == "" {
+			sendTLSAlert(conn, h.blockedAlert())
+			h.rejected(conn, hostname, fourtosix.RejectHostnameNotAllowed)
+			return fmt.Errorf("connect %s blocked: hostname not allowed", hostname)
+		}
+		h.logf("[%s] hostname %s not allowed, using default backend", conn.RemoteAddr(), hostname)
+		raddr = h.DefaultBackend
+		usingDefault = true
 	}
 
-	if h.HostnameIsAllowed != nil && !h.HostnameIsAllowed(hi.ServerName) {
-		log.Printf("[%s] connect %s blocked: hostname not allowed", conn.RemoteAddr(), hi.ServerName)
-		sendTLSAlert(conn, alertUnrecognizedName)
-		return
+	backends := h.routing().Backends(hostname, raddr, usingDefault)
+
+	replay := mr.Buffer()
+	if h.RewriteClientHello != nil {
+		rewritten, err := h.RewriteClientHello(hi, replay)
+		if err != nil {
+			sendTLSAlert(conn, AlertInternalError)
+			h.rejected(conn, hostname, fourtosix.RejectPolicy)
+			return fmt.Errorf("RewriteClientHello: %v", err)
+		}
+		if _, err := readClientHello(bytes.NewReader(rewritten), defaultMaxHandshakeRecords); err != nil {
+			sendTLSAlert(conn, AlertInternalError)
+			h.rejected(conn, hostname, fourtosix.RejectPolicy)
+			return fmt.Errorf("RewriteClientHello returned an invalid ClientHello: %v", err)
+		}
+		replay = rewritten
 	}
 
-	var dialer fourtosix.Dialer
-	if h.MakeDialer != nil {
-		dialer = h.MakeDialer(conn, *hi)
-	} else {
-		dialer = fourtosix.DefaultDialer
+	return h.proxy(&fourtosix.ConnContext{Context: ctx, Hostname: hostname, Details: hi}, conn, raddr, backends, replay, start)
+}
+
+// proxy connects conn to the first of backends to accept it and replay, then relays until both
+// sides are done. raddr, the backend asked for, is used for per-host limits; start is when conn
+// was accepted.
+func (h *Handler) proxy(ctx *fourtosix.ConnContext, conn net.Conn, raddr string, backends []string, replay []byte, start time.Time) error {
+	if !h.hostConns.Acquire(raddr, h.MaxConnectionsPerHost) {
+		sendTLSAlert(conn, AlertInternalError)
+		h.rejected(conn, ctx.Hostname, fourtosix.RejectOverCapacity)
+		return fmt.Errorf("connect %s blocked: too many connections", raddr)
 	}
+	defer h.hostConns.Release(raddr)
 
-	rconn, err := dialer.DialContext(ctx, rnet, net.JoinHostPort(hi.ServerName, fmt.Sprintf("%d", rport)))
-	if err != nil {
-		log.Printf("[%s] connect %s: %v", conn.RemoteAddr(), hi.ServerName, err)
-		sendTLSAlert(conn, alertUnrecognizedName)
-		return
+	// The dial is made under a copy of ctx which also expires at the end of EstablishTimeout.
+	establishCtx, cancelEstablish := fourtosix.EstablishContext(ctx.Context, start, h.EstablishTimeout)
+	defer cancelEstablish()
+	dctx := *ctx
+	dctx.Context = establishCtx
+
+	opts := h.options()
+	rconn, daddr, err := h.srv.Connect(&dctx, opts, conn, raddr, backends, replay)
+	if errors.Is(err, fourtosix.ErrReplayFailed) {
+		sendTLSAlert(conn, AlertInternalError)
+		h.rejected(conn, ctx.Hostname, fourtosix.RejectReplayFailed)
+		return fmt.Errorf("connect %s: %v", raddr, err)
+	} else if err != nil {
+		sendTLSAlert(conn, h.dialFailureAlert())
+		h.rejected(conn, ctx.Hostname, fourtosix.RejectDialFailed)
+		return fmt.Errorf("connect %s: %v", raddr, err)
 	}
 	defer rconn.Close()
-	log.Printf("[%s] connected to %s", conn.RemoteAddr(), hi.ServerName)
-	if _, err := rconn.Write(mr.Buffer()); err != nil {
-		log.Printf("[%s] write ClientHello to rconn %s: %v", conn.RemoteAddr(), hi.ServerName, err)
-		sendTLSAlert(conn, alertInternalError)
-		return
-	}
-
-	// unset deadline
-	var zero time.Time
-	conn.SetDeadline(zero)
-
-	log.Printf("[%s] gluing connections together", conn.RemoteAddr())
-	var wg sync.WaitGroup
-	wg.Add(2)
-	go func() {
-		io.Copy(conn, rconn)
-		wg.Done()
-	}()
-	go func() {
-		io.Copy(rconn, conn)
-		wg.Done()
-	}()
-
-	wg.Wait()
-	log.Printf("[%s] closing connection", conn.RemoteAddr())
-}
-
-func (h *Handler) checkHostname(hostname string) bool {
-	// TODO(lukegb): maybe use a trie of reversed hostname prefixes
-	for _, s := range h.AllowedHostSuffixes {
-		if strings.HasSuffix(hostname, s) {
+	dialedAt := time.Now()
+
+	if h.AfterDial != nil {
+		wrapped, err := h.AfterDial(ctx, rconn)
+		if err != nil {
+			sendTLSAlert(conn, h.dialFailureAlert())
+			h.rejected(conn, ctx.Hostname, fourtosix.RejectDialFailed)
+			return fmt.Errorf("AfterDial for %s: %v", raddr, err)
+		}
+		rconn = wrapped
+		defer rconn.Close()
+	}
+
+	h.srv.Relay(ctx, opts, conn, rconn, daddr, dialedAt)
+	return nil
+}
+
+func (h *Handler) blockedAlert() Alert {
+	if h.BlockedAlert == 0 {
+		return h.dropAlert(AlertUnrecognizedName)
+	}
+	return h.dropAlert(h.BlockedAlert)
+}
+
+func (h *Handler) dialFailureAlert() Alert {
+	if h.DialFailureAlert == 0 {
+		return AlertInternalError
+	}
+	return h.DialFailureAlert
+}
+
+func containsVersion(versions []uint16, v uint16) bool {
+	for _, w := range versions {
+		if w == v {
 			return true
 		}
 	}
 	return false
 }
 
-func (h *Handler) Serve(l net.Listener) error {
-	if h.HostnameIsAllowed == nil && h.AllowedHostSuffixes != nil {
-		h.HostnameIsAllowed = h.checkHostname
+// dropAlert returns alert, or NoAlert if SilentDrop is set.
+func (h *Handler) dropAlert(alert Alert) Alert {
+	if h.SilentDrop {
+		return NoAlert
 	}
+	return alert
+}
 
-	for {
-		conn, err := l.Accept()
-		if err != nil {
-			return fmt.Errorf("failed to accept: %v", err)
+// logf logs a message, prefixed with the handler's Name if it has one.
+func (h *Handler) logf(format string, args ...interface{}) {
+	fourtosix.Logf(h.Name, format, args...)
+}
+
+func (h *Handler) rejected(conn net.Conn, hostname string, reason fourtosix.RejectReason) {
+	h.srv.Rejected(h.options(), conn, hostname, reason)
+}
+
+// Validate checks the handler's configuration. Serve calls it before accepting connections.
+func (h *Handler) Validate() error {
+	if h.RemotePort != 0 {
+		if err := fourtosix.ValidatePort(h.RemotePort); err != nil {
+			return fmt.Errorf("RemotePort: %v", err)
 		}
-		go h.handle(conn)
 	}
+	for proto, port := range h.PortForALPN {
+		if err := fourtosix.ValidatePort(port); err != nil {
+			return fmt.Errorf("PortForALPN[%q]: %v", proto, err)
+		}
+	}
+	for hostname, config := range h.LocalTLS {
+		if config == nil {
+			return fmt.Errorf("LocalTLS[%q] has no configuration", hostname)
+		}
+	}
+	if err := h.options().Validate(); err != nil {
+		return err
+	}
+	return h.routing().Validate()
+}
+
+// Serve accepts connections from l and proxies them, until l fails or the handler is shut down.
+// After Shutdown or Drain, Serve returns fourtosix.ErrHandlerClosed.
+func (h *Handler) Serve(l net.Listener) error {
+	if err := h.Validate(); err != nil {
+		return fmt.Errorf("invalid configuration: %v", err)
+	}
+	return h.srv.Serve(l, h.options(), h.ServeConn)
+}
+
+// ListenAndServe listens on network and addr, then calls Serve.
+func (h *Handler) ListenAndServe(network, addr string) error {
+	return fourtosix.ListenAndServe(network, addr, h.Serve)
+}
+
+// Shutdown stops all Serve calls and closes in-flight connections.
+func (h *Handler) Shutdown() error {
+	return h.srv.Shutdown()
+}
+
+// Drain stops all Serve calls, but lets in-flight connections finish. Shutdown still closes them.
+func (h *Handler) Drain() error {
+	return h.srv.Drain()
+}
+
+// Events returns a channel on which events are delivered as connections progress.
+// Events are dropped if the channel is full; until Events is first called, none are delivered.
+func (h *Handler) Events() <-chan fourtosix.ConnEvent {
+	return h.srv.Events()
 }
@@ -0,0 +1,1150 @@
+package tls
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	cryptotls "crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math/big"
+	"net"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/lukegb/fourtosix"
+	"github.com/lukegb/fourtosix/internal/fakeconn"
+	"github.com/lukegb/fourtosix/tls/tlstest"
+)
+
+// expectThenReply returns a fakeconn Backend which checks that it receives want, then replies with reply.
+func expectThenReply(t *testing.T, want []byte, reply string) func(net.Conn, string) {
+	return func(conn net.Conn, _ string) {
+		got := make([]byte, len(want))
+		if _, err := io.ReadFull(conn, got); err != nil {
+			t.Errorf("backend reading ClientHello: %v", err)
+			return
+		}
+		if !bytes.Equal(got, want) {
+			t.Errorf("backend got %x, want the client's ClientHello %x", got, want)
+		}
+		conn.Write([]byte(reply))
+	}
+}
+
+// serveHello has h serve a connection which sends hello, returning ServeConn's error.
+func serveHello(h *Handler, hello []byte) error {
+	conn := fakeconn.New(fakeconn.ClientAddr, hello)
+	conn.CloseInput()
+	return h.ServeConn(conn)
+}
+
+func TestServeConnProxies(t *testing.T) {
+	hello := tlstest.BuildClientHello(tlstest.Options{ServerName: "example.com"})
+	d := &fakeconn.Dialer{Backend: expectThenReply(t, hello, "ServerHello")}
+	h := &Handler{MakeDialer: d.MakeDialer}
+
+	conn := fakeconn.New(fakeconn.ClientAddr, hello)
+	conn.CloseInput()
+	if err := h.ServeConn(conn); err != nil {
+		t.Fatalf("ServeConn: %v", err)
+	}
+	if dialed := d.Dialed(); len(dialed) != 1 || dialed[0] != "example.com:443" {
+		t.Errorf("dialed %q, want [example.com:443]", dialed)
+	}
+	if got := string(conn.Written()); got != "ServerHello" {
+		t.Errorf("client got %q, want the backend's reply", got)
+	}
+	if !conn.Closed() {
+		t.Error("client connection left open")
+	}
+}
+
+func TestServeConnForwardsDataReadAhead(t *testing.T) {
+	hello := tlstest.BuildClientHello(tlstest.Options{ServerName: "example.com"})
+	payload := bytes.Repeat([]byte{0x17}, 100)
+	all := append(append([]byte(nil), hello...), payload...)
+	d := &fakeconn.Dialer{Backend: expectThenReply(t, all, "")}
+	h := &Handler{MakeDialer: d.MakeDialer}
+
+	// The ClientHello and what follows it arrive in a single write.
+	conn := fakeconn.New(fakeconn.ClientAddr, all)
+	conn.CloseInput()
+	if err := h.ServeConn(conn); err != nil {
+		t.Fatalf("ServeConn: %v", err)
+	}
+}
+
+func TestServeConnBlockedHostname(t *testing.T) {
+	d := &fakeconn.Dialer{}
+	h := &Handler{MakeDialer: d.MakeDialer, AllowedHostSuffixes: []string{".example.org"}}
+
+	conn := fakeconn.New(fakeconn.ClientAddr, tlstest.BuildClientHello(tlstest.Options{ServerName: "example.com"}))
+	conn.CloseInput()
+	if err := h.ServeConn(conn); err == nil {
+		t.Fatal("ServeConn proxied a hostname which isn't allowed")
+	}
+	if dialed := d.Dialed(); len(dialed) != 0 {
+		t.Errorf("dialed %q for a blocked hostname", dialed)
+	}
+	want := []byte{contentTypeAlert, 3, 1, 0, 2, alertLevelFatal, byte(AlertUnrecognizedName)}
+	if got := conn.Written(); !bytes.Equal(got, want) {
+		t.Errorf("client got %x, want unrecognized_name alert %x", got, want)
+	}
+}
+
+func TestServeConnDialFailure(t *testing.T) {
+	d := &fakeconn.Dialer{Err: errors.New("unreachable")}
+	h := &Handler{MakeDialer: d.MakeDialer, DialFailureAlert: AlertAccessDenied}
+
+	conn := fakeconn.New(fakeconn.ClientAddr, tlstest.BuildClientHello(tlstest.Options{ServerName: "example.com"}))
+	conn.CloseInput()
+	if err := h.ServeConn(conn); err == nil {
+		t.Fatal("ServeConn succeeded with an unreachable backend")
+	}
+	want := []byte{contentTypeAlert, 3, 1, 0, 2, alertLevelFatal, byte(AlertAccessDenied)}
+	if got := conn.Written(); !bytes.Equal(got, want) {
+		t.Errorf("client got %x, want DialFailureAlert %x", got, want)
+	}
+}
+
+func TestServeConnDialFailureAlertDefaults(t *testing.T) {
+	for _, tc := range []struct {
+		alert Alert
+		want  []byte
+	}{
+		// A dial failure isn't the client's fault, so by default it isn't told the name is unrecognized.
+		{0, fatalAlert(AlertInternalError)},
+		{NoAlert, nil},
+	} {
+		d := &fakeconn.Dialer{Err: errors.New("unreachable")}
+		h := &Handler{MakeDialer: d.MakeDialer, DialFailureAlert: tc.alert}
+		conn := fakeconn.New(fakeconn.ClientAddr, tlstest.BuildClientHello(tlstest.Options{ServerName: "example.com"}))
+		conn.CloseInput()
+		if err := h.ServeConn(conn); err == nil {
+			t.Fatal("ServeConn succeeded with an unreachable backend")
+		}
+		if got := conn.Written(); !bytes.Equal(got, tc.want) {
+			t.Errorf("DialFailureAlert=%d: client got %x, want %x", tc.alert, got, tc.want)
+		}
+	}
+}
+
+func TestServeConnEncryptedClientHello(t *testing.T) {
+	hello := tlstest.BuildClientHello(tlstest.Options{
+		ServerName: "public.example.com",
+		Extensions: []tlstest.Extension{{Type: extensionEncryptedClientHello, Data: bytes.Repeat([]byte{0xec}, 32)}},
+	})
+
+	// By default, ECH connections are routed on their outer server_name.
+	d := &fakeconn.Dialer{Backend: expectThenReply(t, hello, "ServerHello")}
+	conn := fakeconn.New(fakeconn.ClientAddr, hello)
+	conn.CloseInput()
+	if err := (&Handler{MakeDialer: d.MakeDialer}).ServeConn(conn); err != nil {
+		t.Fatalf("ServeConn: %v", err)
+	}
+	if dialed := d.Dialed(); len(dialed) != 1 || dialed[0] != "public.example.com:443" {
+		t.Errorf("dialed %q, want [public.example.com:443]", dialed)
+	}
+
+	d = &fakeconn.Dialer{}
+	conn = fakeconn.New(fakeconn.ClientAddr, hello)
+	conn.CloseInput()
+	if err := (&Handler{MakeDialer: d.MakeDialer, RejectEncryptedClientHello: true}).ServeConn(conn); err == nil {
+		t.Fatal("ServeConn proxied an ECH connection with RejectEncryptedClientHello set")
+	}
+	if dialed := d.Dialed(); len(dialed) != 0 {
+		t.Errorf("dialed %q for a rejected ECH connection", dialed)
+	}
+	want := []byte{contentTypeAlert, 3, 1, 0, 2, alertLevelFatal, byte(AlertUnrecognizedName)}
+	if got := conn.Written(); !bytes.Equal(got, want) {
+		t.Errorf("client got %x, want unrecognized_name alert %x", got, want)
+	}
+}
+
+func TestServeConnMaxHandshakeRecords(t *testing.T) {
+	records := splitHello(tlstest.BuildClientHello(tlstest.Options{ServerName: "example.com"}), 3)
+	hello := bytes.Join(records, nil)
+
+	d := &fakeconn.Dialer{Backend: expectThenReply(t, hello, "ServerHello")}
+	conn := fakeconn.New(fakeconn.ClientAddr, hello)
+	conn.CloseInput()
+	if err := (&Handler{MakeDialer: d.MakeDialer, MaxHandshakeRecords: 3}).ServeConn(conn); err != nil {
+		t.Fatalf("ServeConn of a ClientHello in as many records as the cap: %v", err)
+	}
+
+	d = &fakeconn.Dialer{}
+	h := &Handler{MakeDialer: d.MakeDialer, MaxHandshakeRecords: 2}
+	events := h.Events()
+	conn = fakeconn.New(fakeconn.ClientAddr, hello)
+	conn.CloseInput()
+	if err := h.ServeConn(conn); err == nil {
+		t.Error("ServeConn accepted a ClientHello in more records than the cap")
+	}
+	if dialed := d.Dialed(); len(dialed) != 0 {
+		t.Errorf("dialed %q for a ClientHello in too many records", dialed)
+	}
+	want := []byte{contentTypeAlert, 3, 1, 0, 2, alertLevelFatal, byte(AlertInternalError)}
+	if got := conn.Written(); !bytes.Equal(got, want) {
+		t.Errorf("client got %x, want internal_error alert %x", got, want)
+	}
+	var reasons []fourtosix.RejectReason
+	for len(events) > 0 {
+		if ev := <-events; ev.Type == fourtosix.ConnRejected {
+			reasons = append(reasons, ev.Reason)
+		}
+	}
+	if len(reasons) != 1 || reasons[0] != fourtosix.RejectOversized {
+		t.Errorf("rejected with reasons %v, want [%v]", reasons, fourtosix.RejectOversized)
+	}
+}
+
+func TestServeConnDefaultBackend(t *testing.T) {
+	for _, tc := range []struct {
+		name  string
+		hello []byte
+		want  string
+	}{
+		{"no server_name", tlstest.BuildClientHello(tlstest.Options{}), "default.example:8443"},
+		{"not allowed", tlstest.BuildClientHello(tlstest.Options{ServerName: "example.com"}), "default.example:8443"},
+		{"allowed", tlstest.BuildClientHello(tlstest.Options{ServerName: "www.example.org"}), "www.example.org:443"},
+	} {
+		d := &fakeconn.Dialer{Backend: expectThenReply(t, tc.hello, "ServerHello")}
+		h := &Handler{MakeDialer: d.MakeDialer, AllowedHostSuffixes: []string{".example.org"}, DefaultBackend: "default.example:8443"}
+		if err := serveHello(h, tc.hello); err != nil {
+			t.Errorf("%s: ServeConn: %v", tc.name, err)
+		}
+		if dialed := d.Dialed(); len(dialed) != 1 || dialed[0] != tc.want {
+			t.Errorf("%s: dialed %q, want [%s]", tc.name, dialed, tc.want)
+		}
+	}
+}
+
+func TestServeConnMaxConnectionsPerHost(t *testing.T) {
+	hello := tlstest.BuildClientHello(tlstest.Options{ServerName: "example.com"})
+	other := tlstest.BuildClientHello(tlstest.Options{ServerName: "example.org"})
+	connected, release := make(chan struct{}), make(chan struct{})
+	d := &fakeconn.Dialer{Backend: func(conn net.Conn, addr string) {
+		if addr == "example.com:443" {
+			connected <- struct{}{}
+			<-release
+		}
+		io.ReadFull(conn, make([]byte, len(hello)))
+	}}
+	h := &Handler{MakeDialer: d.MakeDialer, MaxConnectionsPerHost: 1}
+
+	first := make(chan error)
+	go func() { first <- serveHello(h, hello) }()
+	<-connected
+
+	conn := fakeconn.New(fakeconn.ClientAddr, hello)
+	conn.CloseInput()
+	if err := h.ServeConn(conn); err == nil {
+		t.Error("ServeConn proxied a second connection to a host at its limit")
+	}
+	want := []byte{contentTypeAlert, 3, 1, 0, 2, alertLevelFatal, byte(AlertInternalError)}
+	if got := conn.Written(); !bytes.Equal(got, want) {
+		t.Errorf("client got %x, want internal_error alert %x", got, want)
+	}
+	if err := serveHello(h, other); err != nil {
+		t.Errorf("ServeConn to another host while the first is at its limit: %v", err)
+	}
+
+	close(release)
+	if err := <-first; err != nil {
+		t.Errorf("first ServeConn: %v", err)
+	}
+	go func() { <-connected }()
+	if err := serveHello(h, hello); err != nil {
+		t.Errorf("ServeConn once the first connection finished: %v", err)
+	}
+}
+
+func TestServeConnIPLiteralServerName(t *testing.T) {
+	for _, tc := range []struct {
+		serverName, want string
+	}{
+		{"192.0.2.10", "192.0.2.10:443"},
+		{"2001:DB8::10", "[2001:db8::10]:443"},
+	} {
+		hello := tlstest.BuildClientHello(tlstest.Options{ServerName: tc.serverName})
+
+		d := &fakeconn.Dialer{}
+		if err := serveHello(&Handler{MakeDialer: d.MakeDialer}, hello); err == nil {
+			t.Errorf("ServeConn proxied IP literal server_name %s", tc.serverName)
+		}
+		if dialed := d.Dialed(); len(dialed) != 0 {
+			t.Errorf("dialed %q for IP literal server_name %s", dialed, tc.serverName)
+		}
+
+		d = &fakeconn.Dialer{Backend: expectThenReply(t, hello, "ServerHello")}
+		if err := serveHello(&Handler{MakeDialer: d.MakeDialer, AllowIPLiteralServerName: true}, hello); err != nil {
+			t.Errorf("ServeConn with AllowIPLiteralServerName for %s: %v", tc.serverName, err)
+		}
+		if dialed := d.Dialed(); len(dialed) != 1 || dialed[0] != tc.want {
+			t.Errorf("dialed %q for server_name %s, want [%s]", dialed, tc.serverName, tc.want)
+		}
+	}
+}
+
+func TestServeConnInvalidServerName(t *testing.T) {
+	for _, serverName := range []string{"-example.com", "example..com", strings.Repeat("a", 64) + ".example", "exa mple.com"} {
+		d := &fakeconn.Dialer{}
+		conn := fakeconn.New(fakeconn.ClientAddr, tlstest.BuildClientHello(tlstest.Options{ServerName: serverName}))
+		conn.CloseInput()
+		if err := (&Handler{MakeDialer: d.MakeDialer}).ServeConn(conn); err == nil {
+			t.Errorf("ServeConn proxied invalid server_name %q", serverName)
+		}
+		if dialed := d.Dialed(); len(dialed) != 0 {
+			t.Errorf("dialed %q for invalid server_name %q", dialed, serverName)
+		}
+		want := []byte{contentTypeAlert, 3, 1, 0, 2, alertLevelFatal, byte(AlertUnrecognizedName)}
+		if got := conn.Written(); !bytes.Equal(got, want) {
+			t.Errorf("server_name %q: client got %x, want unrecognized_name alert %x", serverName, got, want)
+		}
+	}
+}
+
+func TestServeConnNormalizesServerName(t *testing.T) {
+	hello := tlstest.BuildClientHello(tlstest.Options{ServerName: "WWW.Example.COM."})
+	d := &fakeconn.Dialer{Backend: expectThenReply(t, hello, "ServerHello")}
+	h := &Handler{MakeDialer: d.MakeDialer, AllowedHostSuffixes: []string{".example.com"}}
+	if err := serveHello(h, hello); err != nil {
+		t.Fatalf("ServeConn: %v", err)
+	}
+	if dialed := d.Dialed(); len(dialed) != 1 || dialed[0] != "www.example.com:443" {
+		t.Errorf("dialed %q, want [www.example.com:443]", dialed)
+	}
+}
+
+func TestServeConnBackendsForHostFailover(t *testing.T) {
+	hello := tlstest.BuildClientHello(tlstest.Options{ServerName: "example.com"})
+	d := &fakeconn.Dialer{Backend: expectThenReply(t, hello, "ServerHello"), Refused: []string{"a.example:443"}}
+	h := &Handler{
+		MakeDialer: d.MakeDialer,
+		BackendsForHost: func(hostname string) []string {
+			return []string{"a.example:443", "b.example:443", "c.example:443"}
+		},
+	}
+	if err := serveHello(h, hello); err != nil {
+		t.Fatalf("ServeConn: %v", err)
+	}
+	if dialed := d.Dialed(); !reflect.DeepEqual(dialed, []string{"a.example:443", "b.example:443"}) {
+		t.Errorf("dialed %q, want [a.example:443 b.example:443]", dialed)
+	}
+}
+
+func TestServeConnStrictRouting(t *testing.T) {
+	backends := func(hostname string) []string {
+		if hostname == "routed.example" {
+			return []string{"backend.example:8443"}
+		}
+		return nil
+	}
+	for _, tc := range []struct {
+		serverName string
+		want       []string
+	}{
+		{"routed.example", []string{"backend.example:8443"}},
+		{"unrouted.example", nil},
+	} {
+		hello := tlstest.BuildClientHello(tlstest.Options{ServerName: tc.serverName})
+		d := &fakeconn.Dialer{Backend: expectThenReply(t, hello, "ServerHello")}
+		h := &Handler{MakeDialer: d.MakeDialer, StrictRouting: true, BackendsForHost: backends}
+		if err := serveHello(h, hello); (err == nil) != (tc.want != nil) {
+			t.Errorf("%s: ServeConn returned %v", tc.serverName, err)
+		}
+		if dialed := d.Dialed(); !reflect.DeepEqual(dialed, tc.want) {
+			t.Errorf("%s: dialed %q, want %q", tc.serverName, dialed, tc.want)
+		}
+	}
+}
+
+func TestShutdownClosesRelayedConnections(t *testing.T) {
+	hello := tlstest.BuildClientHello(tlstest.Options{ServerName: "example.com"})
+	relaying := make(chan struct{})
+	d := &fakeconn.Dialer{Backend: func(conn net.Conn, _ string) {
+		io.ReadFull(conn, make([]byte, len(hello)))
+		close(relaying)
+		// Neither side sends anything more, so only Shutdown ends the relay.
+		io.Copy(io.Discard, conn)
+	}}
+	h := &Handler{MakeDialer: d.MakeDialer}
+
+	conn := fakeconn.New(fakeconn.ClientAddr, hello)
+	done := make(chan error)
+	go func() { done <- h.ServeConn(conn) }()
+	<-relaying
+
+	h.Shutdown()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("ServeConn still relaying a second after Shutdown")
+	}
+	if !conn.Closed() {
+		t.Error("client connection left open after Shutdown")
+	}
+}
+
+func TestShutdownAbortsHandshake(t *testing.T) {
+	hello := tlstest.BuildClientHello(tlstest.Options{ServerName: "example.com"})
+	d := &fakeconn.Dialer{}
+	h := &Handler{MakeDialer: d.MakeDialer}
+
+	// The rest of the ClientHello never arrives, so only Shutdown ends the read.
+	conn := fakeconn.New(fakeconn.ClientAddr, hello[:len(hello)/2])
+	done := make(chan error)
+	go func() { done <- h.ServeConn(conn) }()
+	time.Sleep(20 * time.Millisecond)
+
+	h.Shutdown()
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Error("ServeConn succeeded with half a ClientHello")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("ServeConn still reading the handshake a second after Shutdown")
+	}
+	if !conn.Closed() {
+		t.Error("client connection left open after Shutdown")
+	}
+	if dialed := d.Dialed(); len(dialed) != 0 {
+		t.Errorf("dialed %q after Shutdown", dialed)
+	}
+}
+
+func TestServeConnTransparentModeWithoutDestination(t *testing.T) {
+	d := &fakeconn.Dialer{}
+	h := &Handler{MakeDialer: d.MakeDialer, TransparentMode: true}
+	events := h.Events()
+	if err := serveHello(h, tlstest.BuildClientHello(tlstest.Options{ServerName: "example.com"})); err == nil {
+		t.Fatal("ServeConn in TransparentMode proxied a connection with no original destination")
+	}
+	// The server_name isn't consulted in TransparentMode.
+	if dialed := d.Dialed(); len(dialed) != 0 {
+		t.Errorf("dialed %q without an original destination", dialed)
+	}
+	for len(events) > 0 {
+		if ev := <-events; ev.Type == fourtosix.ConnRejected && ev.Reason != fourtosix.RejectNoHostname {
+			t.Errorf("rejected with reason %v, want %v", ev.Reason, fourtosix.RejectNoHostname)
+		}
+	}
+}
+
+func TestServeConnMalformed(t *testing.T) {
+	d := &fakeconn.Dialer{}
+	h := &Handler{MakeDialer: d.MakeDialer}
+
+	conn := fakeconn.New(fakeconn.ClientAddr, []byte("GET / HTTP/1.1\r\n\r\n"))
+	conn.CloseInput()
+	if err := h.ServeConn(conn); err == nil {
+		t.Fatal("ServeConn accepted an HTTP request as a ClientHello")
+	}
+	if dialed := d.Dialed(); len(dialed) != 0 {
+		t.Errorf("dialed %q for a malformed ClientHello", dialed)
+	}
+}
+
+func TestServeConnEstablishTimeoutSparesBreaker(t *testing.T) {
+	d := &fakeconn.Dialer{Hang: true}
+	cb := &fourtosix.CircuitBreaker{Threshold: 1, Cooldown: time.Hour}
+	h := &Handler{MakeDialer: d.MakeDialer, EstablishTimeout: 50 * time.Millisecond, CircuitBreaker: cb}
+
+	conn := fakeconn.New(fakeconn.ClientAddr, tlstest.BuildClientHello(tlstest.Options{ServerName: "example.com"}))
+	conn.CloseInput()
+	if err := h.ServeConn(conn); err == nil {
+		t.Fatal("ServeConn succeeded with a dial which never completed")
+	}
+	if !cb.Allow("example.com:443") {
+		t.Error("a dial cut short by EstablishTimeout tripped the circuit breaker")
+	}
+}
+
+func TestServeConnEstablishTimeoutCoversHandshakeAndDial(t *testing.T) {
+	const timeout = 300 * time.Millisecond
+	hello := tlstest.BuildClientHello(tlstest.Options{ServerName: "example.com"})
+	d := &fakeconn.Dialer{Hang: true}
+	h := &Handler{MakeDialer: d.MakeDialer, EstablishTimeout: timeout}
+
+	// A handshake which never completes is abandoned well before the 5s handshake deadline.
+	start := time.Now()
+	if err := h.ServeConn(fakeconn.New(fakeconn.ClientAddr, hello[:len(hello)/2])); err == nil {
+		t.Fatal("ServeConn succeeded with half a ClientHello")
+	}
+	if elapsed := time.Since(start); elapsed > 2*timeout {
+		t.Errorf("incomplete handshake abandoned after %v, want about %v", elapsed, timeout)
+	}
+
+	// A slow handshake leaves the dial only what remains of the timeout.
+	conn := fakeconn.New(fakeconn.ClientAddr, hello[:len(hello)/2])
+	go func() {
+		time.Sleep(timeout * 5 / 6)
+		conn.Feed(hello[len(hello)/2:])
+		conn.CloseInput()
+	}()
+	start = time.Now()
+	if err := h.ServeConn(conn); err == nil {
+		t.Fatal("ServeConn succeeded with a dial which never completed")
+	}
+	if elapsed := time.Since(start); elapsed > timeout*3/2 {
+		t.Errorf("connection abandoned after %v, want about %v", elapsed, timeout)
+	}
+	if dialed := d.Dialed(); len(dialed) != 1 {
+		t.Errorf("dialed %q, want one dial after the slow handshake", dialed)
+	}
+}
+
+// drainEvents returns the types of the events h has delivered so far.
+func drainEvents(h *Handler) []fourtosix.ConnEventType {
+	var types []fourtosix.ConnEventType
+	for {
+		select {
+		case ev := <-h.Events():
+			types = append(types, ev.Type)
+		default:
+			return types
+		}
+	}
+}
+
+func TestServeConnEventsEndWithClosed(t *testing.T) {
+	clientNet := net.IPNet{IP: fakeconn.ClientAddr.IP, Mask: net.CIDRMask(32, 32)}
+	hello := tlstest.BuildClientHello(tlstest.Options{ServerName: "example.com"})
+	for _, tc := range []struct {
+		name    string
+		handler *Handler
+		want    []fourtosix.ConnEventType
+	}{{
+		name:    "proxied",
+		handler: &Handler{MakeDialer: (&fakeconn.Dialer{Backend: expectThenReply(t, hello, "ServerHello")}).MakeDialer},
+		want:    []fourtosix.ConnEventType{fourtosix.ConnAccepted, fourtosix.ConnParsedHostname, fourtosix.ConnDialed, fourtosix.ConnClosed},
+	}, {
+		name:    "rejected",
+		handler: &Handler{MakeDialer: (&fakeconn.Dialer{}).MakeDialer, AllowedHostSuffixes: []string{".example.org"}},
+		want:    []fourtosix.ConnEventType{fourtosix.ConnAccepted, fourtosix.ConnParsedHostname, fourtosix.ConnRejected, fourtosix.ConnClosed},
+	}, {
+		name:    "no PROXY header",
+		handler: &Handler{MakeDialer: (&fakeconn.Dialer{}).MakeDialer, TrustProxyProtocol: true, TrustedProxies: []net.IPNet{clientNet}},
+		want:    []fourtosix.ConnEventType{fourtosix.ConnAccepted, fourtosix.ConnRejected, fourtosix.ConnClosed},
+	}} {
+		tc.handler.Events()
+		conn := fakeconn.New(fakeconn.ClientAddr, hello)
+		conn.CloseInput()
+		tc.handler.ServeConn(conn)
+		if got := drainEvents(tc.handler); !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("%s: events %v, want %v", tc.name, got, tc.want)
+		}
+	}
+}
+
+// captureOutput runs f, returning what it wrote to the standard logger, without timestamps, and to os.Stdout.
+func captureOutput(t *testing.T, f func()) (logged, stdout string) {
+	t.Helper()
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	var buf bytes.Buffer
+	oldStdout, oldFlags := os.Stdout, log.Flags()
+	os.Stdout = w
+	log.SetOutput(&buf)
+	log.SetFlags(0)
+	func() {
+		defer func() {
+			os.Stdout = oldStdout
+			log.SetOutput(os.Stderr)
+			log.SetFlags(oldFlags)
+			w.Close()
+		}()
+		f()
+	}()
+	out, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return buf.String(), string(out)
+}
+
+func TestServeConnWritesOnlyLogLines(t *testing.T) {
+	hello := tlstest.BuildClientHello(tlstest.Options{ServerName: "example.com"})
+	d := &fakeconn.Dialer{Backend: expectThenReply(t, hello, "ServerHello")}
+	h := &Handler{MakeDialer: d.MakeDialer}
+
+	conn := fakeconn.New(fakeconn.ClientAddr, hello)
+	conn.CloseInput()
+	logged, stdout := captureOutput(t, func() {
+		if err := h.ServeConn(conn); err != nil {
+			t.Errorf("ServeConn: %v", err)
+		}
+	})
+	if stdout != "" {
+		t.Errorf("ServeConn wrote %q to stdout", stdout)
+	}
+	prefix := "[" + fakeconn.ClientAddr.String() + "] "
+	for _, line := range strings.Split(strings.TrimSuffix(logged, "\n"), "\n") {
+		if !strings.HasPrefix(line, prefix) {
+			t.Errorf("log line %q isn't about the connection", line)
+		}
+	}
+}
+
+func TestServeConnLogsSource(t *testing.T) {
+	_, prefix, _ := net.ParseCIDR("2001:db8:64::/96")
+	source, err := fourtosix.SynthesizeSource(prefix, fakeconn.ClientAddr.IP)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hello := tlstest.BuildClientHello(tlstest.Options{ServerName: "example.com"})
+	d := &fakeconn.Dialer{Backend: expectThenReply(t, hello, ""), Local: &net.TCPAddr{IP: source, Port: 40000}}
+	h := &Handler{MakeDialer: d.MakeDialer}
+
+	conn := fakeconn.New(fakeconn.ClientAddr, hello)
+	conn.CloseInput()
+	logged, _ := captureOutput(t, func() { h.ServeConn(conn) })
+	if want := "connected to example.com:443 from [2001:db8:64::c000:201]:40000"; !strings.Contains(logged, want) {
+		t.Errorf("log %q doesn't contain %q", logged, want)
+	}
+}
+
+func TestServeConnLogClientHellos(t *testing.T) {
+	hello := tlstest.BuildClientHello(tlstest.Options{
+		ServerName:   "example.com",
+		CipherSuites: []uint16{0x1301, 0x1302, 0x1303},
+		Extensions: []tlstest.Extension{
+			{Type: 43, Data: []byte{4, 0x03, 0x04, 0x03, 0x03}}, // supported_versions: TLS 1.3, TLS 1.2
+			{Type: 16, Data: []byte{0, 3, 2, 'h', '2'}},         // application_layer_protocol_negotiation
+		},
+	})
+	want := "ClientHello sni=example.com version=3.4 ciphers=3 ext=3"
+	for _, enabled := range []bool{false, true} {
+		d := &fakeconn.Dialer{Backend: expectThenReply(t, hello, "")}
+		h := &Handler{MakeDialer: d.MakeDialer, LogClientHellos: enabled}
+		logged, _ := captureOutput(t, func() {
+			if err := serveHello(h, hello); err != nil {
+				t.Errorf("ServeConn: %v", err)
+			}
+		})
+		if got := strings.Contains(logged, want); got != enabled {
+			t.Errorf("LogClientHellos=%v: log %q contains %q: %v", enabled, logged, want, got)
+		}
+	}
+}
+
+func TestServeConnAuditLog(t *testing.T) {
+	var audit bytes.Buffer
+	allowed := tlstest.BuildClientHello(tlstest.Options{ServerName: "www.example.org"})
+	d := &fakeconn.Dialer{Backend: expectThenReply(t, allowed, "")}
+	h := &Handler{Name: "edge", MakeDialer: d.MakeDialer, AllowedHostSuffixes: []string{".example.org"}, AuditLog: &audit}
+
+	if err := serveHello(h, tlstest.BuildClientHello(tlstest.Options{ServerName: "example.com"})); err == nil {
+		t.Fatal("ServeConn proxied a hostname which isn't allowed")
+	}
+	if err := serveHello(h, allowed); err != nil {
+		t.Fatalf("ServeConn: %v", err)
+	}
+
+	// Only the rejected connection is recorded.
+	lines := strings.Split(strings.TrimSuffix(audit.String(), "\n"), "\n")
+	if len(lines) != 1 {
+		t.Fatalf("audit log has %d lines, want 1: %q", len(lines), audit.String())
+	}
+	var rec fourtosix.AuditRecord
+	if err := json.Unmarshal([]byte(lines[0]), &rec); err != nil {
+		t.Fatalf("audit log line %q: %v", lines[0], err)
+	}
+	want := fourtosix.AuditRecord{
+		Time:     rec.Time,
+		Handler:  "edge",
+		Client:   fakeconn.ClientAddr.String(),
+		Hostname: "example.com",
+		Reason:   fourtosix.RejectHostnameNotAllowed,
+	}
+	if rec != want || rec.Time.IsZero() {
+		t.Errorf("audit record %+v, want %+v with a time", rec, want)
+	}
+}
+
+func TestServeConnMaxConcurrentHandshakes(t *testing.T) {
+	hello := tlstest.BuildClientHello(tlstest.Options{ServerName: "example.com"})
+	d := &fakeconn.Dialer{}
+	h := &Handler{MakeDialer: d.MakeDialer, MaxConcurrentHandshakes: 1}
+
+	slow := fakeconn.New(fakeconn.ClientAddr, hello[:len(hello)/2])
+	slowDone := make(chan error, 1)
+	go func() { slowDone <- h.ServeConn(slow) }()
+	time.Sleep(20 * time.Millisecond)
+
+	// The second handshake waits for the first to finish before it is read.
+	fast := fakeconn.New(&net.TCPAddr{IP: net.IPv4(192, 0, 2, 2), Port: 1234}, hello)
+	fast.CloseInput()
+	fastDone := make(chan error, 1)
+	go func() { fastDone <- h.ServeConn(fast) }()
+	time.Sleep(50 * time.Millisecond)
+	if dialed := d.Dialed(); len(dialed) != 0 {
+		t.Fatalf("dialed %q while the first handshake was still being read", dialed)
+	}
+
+	slow.Feed(hello[len(hello)/2:])
+	slow.CloseInput()
+	for _, done := range []chan error{slowDone, fastDone} {
+		select {
+		case <-done:
+		case <-time.After(time.Second):
+			t.Fatal("ServeConn still waiting a second after the first handshake finished")
+		}
+	}
+	if dialed := d.Dialed(); len(dialed) != 2 {
+		t.Errorf("dialed %q, want both connections' backends", dialed)
+	}
+}
+
+// fatalAlert is the record sendTLSAlert writes for a fatal alert with the given description.
+func fatalAlert(desc Alert) []byte {
+	return []byte{contentTypeAlert, 3, 1, 0, 2, alertLevelFatal, byte(desc)}
+}
+
+func TestServeConnFingerprintIsAllowed(t *testing.T) {
+	hello := tlstest.BuildClientHello(tlstest.Options{ServerName: "example.com"})
+	hi, err := ParseClientHello(hello)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, allow := range []bool{true, false} {
+		var got []string
+		d := &fakeconn.Dialer{Backend: expectThenReply(t, hello, "")}
+		h := &Handler{MakeDialer: d.MakeDialer, FingerprintIsAllowed: func(ja4 string) bool {
+			got = append(got, ja4)
+			return allow
+		}}
+		conn := fakeconn.New(fakeconn.ClientAddr, hello)
+		conn.CloseInput()
+		err := h.ServeConn(conn)
+		if (err == nil) != allow {
+			t.Errorf("allow=%v: ServeConn returned %v", allow, err)
+		}
+		if want := []string{hi.JA4()}; !reflect.DeepEqual(got, want) {
+			t.Errorf("allow=%v: FingerprintIsAllowed called with %q, want %q", allow, got, want)
+		}
+		if allow {
+			continue
+		}
+		if dialed := d.Dialed(); len(dialed) != 0 {
+			t.Errorf("dialed %q for a disallowed fingerprint", dialed)
+		}
+		if got, want := conn.Written(), fatalAlert(AlertAccessDenied); !bytes.Equal(got, want) {
+			t.Errorf("client got %x, want access_denied alert %x", got, want)
+		}
+	}
+}
+
+func TestServeConnOversizedRecord(t *testing.T) {
+	d := &fakeconn.Dialer{}
+	h := &Handler{MakeDialer: d.MakeDialer}
+	events := h.Events()
+
+	// Only the header is sent: the length alone is enough to reject the record, without waiting for its fragment.
+	head := []byte{contentTypeHandshake, 3, 1, byte((maxRecordLength + 1) >> 8), byte((maxRecordLength + 1) & 0xff)}
+	conn := fakeconn.New(fakeconn.ClientAddr, head)
+	done := make(chan error, 1)
+	go func() { done <- h.ServeConn(conn) }()
+	select {
+	case err := <-done:
+		if !strings.Contains(fmt.Sprint(err), errRecordTooLarge.Error()) {
+			t.Errorf("ServeConn = %v, want %v", err, errRecordTooLarge)
+		}
+	case <-time.After(time.Second):
+		h.Shutdown()
+		t.Fatal("ServeConn waited for the fragment of an oversized record")
+	}
+	if got, want := conn.Written(), fatalAlert(AlertRecordOverflow); !bytes.Equal(got, want) {
+		t.Errorf("client got %x, want record_overflow alert %x", got, want)
+	}
+	for len(events) > 0 {
+		if ev := <-events; ev.Type == fourtosix.ConnRejected && ev.Reason != fourtosix.RejectOversized {
+			t.Errorf("rejected with reason %v, want %v", ev.Reason, fourtosix.RejectOversized)
+		}
+	}
+
+	// A record of the largest allowed size is read in full, and fails only because it's cut short.
+	head = []byte{contentTypeHandshake, 3, 1, byte(maxRecordLength >> 8), byte(maxRecordLength & 0xff)}
+	if err := serveHello(h, head); err == nil || strings.Contains(err.Error(), errRecordTooLarge.Error()) {
+		t.Errorf("ServeConn of a truncated %d byte record = %v, want a read error", maxRecordLength, err)
+	}
+}
+
+func TestServeConnMinVersion(t *testing.T) {
+	supportedVersions := func(versions ...uint16) tlstest.Extension {
+		data := []byte{byte(2 * len(versions))}
+		for _, v := range versions {
+			data = append(data, byte(v>>8), byte(v))
+		}
+		return tlstest.Extension{Type: 43, Data: data}
+	}
+	for _, tc := range []struct {
+		name  string
+		exts  []tlstest.Extension
+		allow bool
+	}{
+		{"TLS 1.2 only", nil, false},
+		{"TLS 1.3 in supported_versions", []tlstest.Extension{supportedVersions(0x0304, 0x0303)}, true},
+		// A GREASE value sorts above TLS 1.3, but doesn't count as a version.
+		{"GREASE and TLS 1.2", []tlstest.Extension{supportedVersions(0x0a0a, 0x0303)}, false},
+	} {
+		hello := tlstest.BuildClientHello(tlstest.Options{ServerName: "example.com", Extensions: tc.exts})
+		d := &fakeconn.Dialer{Backend: expectThenReply(t, hello, "")}
+		h := &Handler{MakeDialer: d.MakeDialer, MinVersion: 0x0304}
+		conn := fakeconn.New(fakeconn.ClientAddr, hello)
+		conn.CloseInput()
+		if err := h.ServeConn(conn); (err == nil) != tc.allow {
+			t.Errorf("%s: ServeConn = %v, want allowed: %v", tc.name, err, tc.allow)
+		}
+		if tc.allow {
+			continue
+		}
+		if dialed := d.Dialed(); len(dialed) != 0 {
+			t.Errorf("%s: dialed %q below MinVersion", tc.name, dialed)
+		}
+		if got, want := conn.Written(), fatalAlert(AlertProtocolVersion); !bytes.Equal(got, want) {
+			t.Errorf("%s: client got %x, want protocol_version alert %x", tc.name, got, want)
+		}
+	}
+}
+
+func TestServeConnRewriteClientHello(t *testing.T) {
+	hello := tlstest.BuildClientHello(tlstest.Options{ServerName: "example.com"})
+	rewritten := tlstest.BuildClientHello(tlstest.Options{ServerName: "internal.example.com"})
+	d := &fakeconn.Dialer{Backend: expectThenReply(t, rewritten, "ServerHello")}
+	h := &Handler{MakeDialer: d.MakeDialer, RewriteClientHello: func(hi *ClientHello, raw []byte) ([]byte, error) {
+		if hi.ServerName != "example.com" || !bytes.Equal(raw, hello) {
+			t.Errorf("RewriteClientHello called with %q, %x; want the client's ClientHello", hi.ServerName, raw)
+		}
+		return rewritten, nil
+	}}
+	if err := serveHello(h, hello); err != nil {
+		t.Fatalf("ServeConn: %v", err)
+	}
+	// Routing still follows what the client asked for.
+	if dialed := d.Dialed(); len(dialed) != 1 || dialed[0] != "example.com:443" {
+		t.Errorf("dialed %q, want [example.com:443]", dialed)
+	}
+
+	for _, rewrite := range []func(*ClientHello, []byte) ([]byte, error){
+		func(*ClientHello, []byte) ([]byte, error) { return nil, errors.New("no thanks") },
+		func(*ClientHello, []byte) ([]byte, error) { return []byte("GET / HTTP/1.1\r\n\r\n"), nil },
+	} {
+		d := &fakeconn.Dialer{}
+		h := &Handler{MakeDialer: d.MakeDialer, RewriteClientHello: rewrite}
+		conn := fakeconn.New(fakeconn.ClientAddr, hello)
+		conn.CloseInput()
+		if err := h.ServeConn(conn); err == nil {
+			t.Error("ServeConn succeeded when RewriteClientHello failed")
+		}
+		if dialed := d.Dialed(); len(dialed) != 0 {
+			t.Errorf("dialed %q when RewriteClientHello failed", dialed)
+		}
+		if got, want := conn.Written(), fatalAlert(AlertInternalError); !bytes.Equal(got, want) {
+			t.Errorf("client got %x, want internal_error alert %x", got, want)
+		}
+	}
+}
+
+func TestServeConnRejectHosts(t *testing.T) {
+	h := &Handler{RejectHosts: map[string]Alert{
+		"old.example.com":  AlertCertificateExpired,
+		"gone.example.com": NoAlert,
+	}}
+	for _, tc := range []struct {
+		serverName string
+		want       []byte
+	}{
+		// Hostnames are normalized before they are looked up.
+		{"OLD.example.com.", fatalAlert(AlertCertificateExpired)},
+		{"gone.example.com", nil},
+	} {
+		d := &fakeconn.Dialer{}
+		h.MakeDialer = d.MakeDialer
+		conn := fakeconn.New(fakeconn.ClientAddr, tlstest.BuildClientHello(tlstest.Options{ServerName: tc.serverName}))
+		conn.CloseInput()
+		if err := h.ServeConn(conn); err == nil {
+			t.Errorf("%s: ServeConn proxied a rejected hostname", tc.serverName)
+		}
+		if dialed := d.Dialed(); len(dialed) != 0 {
+			t.Errorf("%s: dialed %q", tc.serverName, dialed)
+		}
+		if got := conn.Written(); !bytes.Equal(got, tc.want) {
+			t.Errorf("%s: client got %x, want %x", tc.serverName, got, tc.want)
+		}
+	}
+
+	hello := tlstest.BuildClientHello(tlstest.Options{ServerName: "new.example.com"})
+	d := &fakeconn.Dialer{Backend: expectThenReply(t, hello, "")}
+	h.MakeDialer = d.MakeDialer
+	if err := serveHello(h, hello); err != nil {
+		t.Errorf("ServeConn of a hostname not in RejectHosts: %v", err)
+	}
+}
+
+func TestServeConnBlockedAlert(t *testing.T) {
+	for _, tc := range []struct {
+		alert Alert
+		want  []byte
+	}{
+		{0, fatalAlert(AlertUnrecognizedName)},
+		{AlertAccessDenied, fatalAlert(AlertAccessDenied)},
+		{NoAlert, nil},
+	} {
+		d := &fakeconn.Dialer{}
+		h := &Handler{MakeDialer: d.MakeDialer, AllowedHostSuffixes: []string{".example.org"}, BlockedAlert: tc.alert}
+		conn := fakeconn.New(fakeconn.ClientAddr, tlstest.BuildClientHello(tlstest.Options{ServerName: "example.com"}))
+		conn.CloseInput()
+		if err := h.ServeConn(conn); err == nil {
+			t.Errorf("BlockedAlert=%d: ServeConn proxied a hostname which isn't allowed", tc.alert)
+		}
+		if got := conn.Written(); !bytes.Equal(got, tc.want) {
+			t.Errorf("BlockedAlert=%d: client got %x, want %x", tc.alert, got, tc.want)
+		}
+	}
+}
+
+func TestServeConnSilentDrop(t *testing.T) {
+	for _, serverName := range []string{"", "example.com"} {
+		d := &fakeconn.Dialer{}
+		h := &Handler{MakeDialer: d.MakeDialer, AllowedHostSuffixes: []string{".example.org"}, BlockedAlert: AlertAccessDenied, SilentDrop: true}
+		conn := fakeconn.New(fakeconn.ClientAddr, tlstest.BuildClientHello(tlstest.Options{ServerName: serverName}))
+		conn.CloseInput()
+		if err := h.ServeConn(conn); err == nil {
+			t.Errorf("server_name %q: ServeConn succeeded", serverName)
+		}
+		if got := conn.Written(); len(got) != 0 {
+			t.Errorf("server_name %q: client got %x, want nothing", serverName, got)
+		}
+		if !conn.Closed() {
+			t.Errorf("server_name %q: connection left open", serverName)
+		}
+	}
+}
+
+// alpnExtension is an application_layer_protocol_negotiation extension offering protos.
+func alpnExtension(protos ...string) tlstest.Extension {
+	var list []byte
+	for _, p := range protos {
+		list = append(append(list, byte(len(p))), p...)
+	}
+	return tlstest.Extension{Type: extensionALPN, Data: append([]byte{byte(len(list) >> 8), byte(len(list))}, list...)}
+}
+
+func TestServeConnPortForALPN(t *testing.T) {
+	for _, tc := range []struct {
+		protos []string
+		want   string
+	}{
+		{[]string{"http/1.1", "acme-tls/1", "h2"}, "example.com:9443"},
+		{[]string{"h2"}, "example.com:8443"},
+		{[]string{"http/1.1"}, "example.com:443"},
+		{nil, "example.com:443"},
+	} {
+		var exts []tlstest.Extension
+		if tc.protos != nil {
+			exts = append(exts, alpnExtension(tc.protos...))
+		}
+		hello := tlstest.BuildClientHello(tlstest.Options{ServerName: "example.com", Extensions: exts})
+		d := &fakeconn.Dialer{Backend: expectThenReply(t, hello, "")}
+		var offered []string
+		h := &Handler{
+			PortForALPN: map[string]int{"h2": 8443, "acme-tls/1": 9443},
+			MakeDialer: func(conn net.Conn, ctx fourtosix.Context) fourtosix.Dialer {
+				offered = ctx.(*fourtosix.ConnContext).Details.(*ClientHello).ALPNProtocols
+				return d
+			},
+		}
+		if err := serveHello(h, hello); err != nil {
+			t.Errorf("ALPN %q: ServeConn: %v", tc.protos, err)
+		}
+		if dialed := d.Dialed(); len(dialed) != 1 || dialed[0] != tc.want {
+			t.Errorf("ALPN %q: dialed %q, want [%s]", tc.protos, dialed, tc.want)
+		}
+		if !reflect.DeepEqual(offered, tc.protos) {
+			t.Errorf("ALPN %q: MakeDialer saw %q offered", tc.protos, offered)
+		}
+	}
+}
+
+func TestServeConnEarlyDataAlert(t *testing.T) {
+	earlyData := tlstest.BuildClientHello(tlstest.Options{
+		ServerName: "example.com",
+		Extensions: []tlstest.Extension{{Type: extensionEarlyData}},
+	})
+	hi, err := ParseClientHello(earlyData)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !hi.EarlyData {
+		t.Error("EarlyData not set for a ClientHello with an early_data extension")
+	}
+
+	d := &fakeconn.Dialer{}
+	h := &Handler{MakeDialer: d.MakeDialer, EarlyDataAlert: AlertHandshakeFailure}
+	conn := fakeconn.New(fakeconn.ClientAddr, earlyData)
+	conn.CloseInput()
+	if err := h.ServeConn(conn); err == nil {
+		t.Error("ServeConn proxied a connection offering early data")
+	}
+	if dialed := d.Dialed(); len(dialed) != 0 {
+		t.Errorf("dialed %q for a connection offering early data", dialed)
+	}
+	if got, want := conn.Written(), fatalAlert(AlertHandshakeFailure); !bytes.Equal(got, want) {
+		t.Errorf("client got %x, want handshake_failure alert %x", got, want)
+	}
+
+	// Without early data, or without EarlyDataAlert, connections are proxied as usual.
+	hello := tlstest.BuildClientHello(tlstest.Options{ServerName: "example.com"})
+	for _, tc := range []struct {
+		hello []byte
+		alert Alert
+	}{{hello, AlertHandshakeFailure}, {earlyData, 0}} {
+		d := &fakeconn.Dialer{Backend: expectThenReply(t, tc.hello, "")}
+		h := &Handler{MakeDialer: d.MakeDialer, EarlyDataAlert: tc.alert}
+		if err := serveHello(h, tc.hello); err != nil {
+			t.Errorf("EarlyDataAlert=%d: ServeConn: %v", tc.alert, err)
+		}
+	}
+}
+
+func TestServeConnMultipleServerNames(t *testing.T) {
+	first := tlstest.ServerNameExtension("a.example")
+	second := tlstest.ServerNameExtension("b.example")
+	list := append(append([]byte(nil), first.Data[2:]...), second.Data[2:]...)
+	ext := tlstest.Extension{Type: first.Type, Data: append([]byte{byte(len(list) >> 8), byte(len(list))}, list...)}
+	hello := tlstest.BuildClientHello(tlstest.Options{Extensions: []tlstest.Extension{ext}})
+
+	d := &fakeconn.Dialer{Backend: expectThenReply(t, hello, "")}
+	var names []string
+	h := &Handler{MakeDialer: func(conn net.Conn, ctx fourtosix.Context) fourtosix.Dialer {
+		names = ctx.(*fourtosix.ConnContext).Details.(*ClientHello).ServerNames
+		return d
+	}}
+	if err := serveHello(h, hello); err != nil {
+		t.Fatalf("ServeConn: %v", err)
+	}
+	// Only the first name is used for routing, but MakeDialer can see them all.
+	if dialed := d.Dialed(); len(dialed) != 1 || dialed[0] != "a.example:443" {
+		t.Errorf("dialed %q, want [a.example:443]", dialed)
+	}
+	if want := []string{"a.example", "b.example"}; !reflect.DeepEqual(names, want) {
+		t.Errorf("MakeDialer saw ServerNames %q, want %q", names, want)
+	}
+}
+
+// selfSignedConfig returns a TLS server configuration with a throwaway certificate for hostname.
+func selfSignedConfig(t *testing.T, hostname string) *cryptotls.Config {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		DNSNames:     []string{hostname},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &cryptotls.Config{Certificates: []cryptotls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}}}
+}
+
+func TestServeConnLocalTLS(t *testing.T) {
+	d := &fakeconn.Dialer{}
+	served := make(chan string, 1)
+	h := &Handler{
+		MakeDialer: d.MakeDialer,
+		LocalTLS:   map[string]*cryptotls.Config{"local.example.com": selfSignedConfig(t, "local.example.com")},
+		ServeLocal: func(conn *cryptotls.Conn, hostname string) {
+			served <- hostname
+			conn.Write([]byte("hello from " + hostname))
+		},
+	}
+	conn, peer := net.Pipe()
+	done := make(chan error, 1)
+	go func() { done <- h.ServeConn(conn) }()
+
+	client := cryptotls.Client(peer, &cryptotls.Config{ServerName: "LOCAL.example.com", InsecureSkipVerify: true})
+	defer client.Close()
+	client.SetDeadline(time.Now().Add(5 * time.Second))
+	got, err := io.ReadAll(client)
+	if err != nil {
+		t.Fatalf("reading from locally terminated connection: %v", err)
+	}
+	if string(got) != "hello from local.example.com" {
+		t.Errorf("client got %q, want the ServeLocal greeting", got)
+	}
+	if err := <-done; err != nil {
+		t.Errorf("ServeConn: %v", err)
+	}
+	if hostname := <-served; hostname != "local.example.com" {
+		t.Errorf("ServeLocal called for %q, want the normalized hostname", hostname)
+	}
+	if dialed := d.Dialed(); len(dialed) != 0 {
+		t.Errorf("dialed %q for a locally terminated hostname", dialed)
+	}
+}
+
+// contextRecorder is a Dialer which records the context of each dial before passing it on.
+type contextRecorder struct {
+	fourtosix.Dialer
+	ctxs []context.Context
+}
+
+func (d *contextRecorder) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	d.ctxs = append(d.ctxs, ctx)
+	return d.Dialer.DialContext(ctx, network, address)
+}
+
+func TestServeConnPassesConnContext(t *testing.T) {
+	hello := tlstest.BuildClientHello(tlstest.Options{ServerName: "Example.COM"})
+	var made fourtosix.Context
+	rec := &contextRecorder{Dialer: &fakeconn.Dialer{Backend: expectThenReply(t, hello, "")}}
+	h := &Handler{MakeDialer: func(conn net.Conn, ctx fourtosix.Context) fourtosix.Dialer {
+		made = ctx
+		return rec
+	}}
+	if err := serveHello(h, hello); err != nil {
+		t.Fatalf("ServeConn: %v", err)
+	}
+
+	cctx, ok := made.(*fourtosix.ConnContext)
+	if !ok {
+		t.Fatalf("MakeDialer got context %T, want *fourtosix.ConnContext", made)
+	}
+	if cctx.Hostname != "example.com" {
+		t.Errorf("ConnContext.Hostname = %q, want the normalized server_name", cctx.Hostname)
+	}
+	if hi, ok := cctx.Details.(*ClientHello); !ok || hi.ServerName != "Example.COM" {
+		t.Errorf("ConnContext.Details = %#v, want the client's *ClientHello", cctx.Details)
+	}
+	if len(rec.ctxs) != 1 {
+		t.Fatalf("%d dials, want 1", len(rec.ctxs))
+	}
+	dctx, ok := rec.ctxs[0].(*fourtosix.ConnContext)
+	if !ok || dctx.Hostname != cctx.Hostname || dctx.Details != cctx.Details {
+		t.Errorf("DialContext got context %#v, want a *fourtosix.ConnContext like MakeDialer's", rec.ctxs[0])
+	}
+	// The connection is over, so its context has been cancelled.
+	if dctx != nil && dctx.Err() == nil {
+		t.Error("dial context still live after ServeConn returned")
+	}
+}
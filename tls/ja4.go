@@ -0,0 +1,108 @@
+package tls
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+var ja4Versions = map[uint16]string{
+	0x0304: "13",
+	0x0303: "12",
+	0x0302: "11",
+	0x0301: "10",
+	0x0300: "s3",
+	0x0002: "s2",
+	0xfeff: "d1",
+	0xfefd: "d2",
+	0xfefc: "d3",
+}
+
+// isGREASE reports whether v is one of the reserved GREASE values from RFC 8701.
+func isGREASE(v uint16) bool {
+	return v&0x0f0f == 0x0a0a && v>>8 == v&0xff
+}
+
+func withoutGREASE(vs []uint16) []uint16 {
+	out := make([]uint16, 0, len(vs))
+	for _, v := range vs {
+		if !isGREASE(v) {
+			out = append(out, v)
+		}
+	}
+	return out
+}
+
+func isAlphanumeric(b byte) bool {
+	return (b >= '0' && b <= '9') || (b >= 'a' && b <= 'z') || (b >= 'A' && b <= 'Z')
+}
+
+// ja4Hash returns the truncated SHA-256 of vs rendered as a comma-separated list of hex values.
+func ja4Hash(vs []uint16, suffix string) string {
+	if len(vs) == 0 {
+		return "000000000000"
+	}
+	parts := make([]string, len(vs))
+	for i, v := range vs {
+		parts[i] = fmt.Sprintf("%04x", v)
+	}
+	s := strings.Join(parts, ",") + suffix
+	sum := sha256.Sum256([]byte(s))
+	return hex.EncodeToString(sum[:])[:12]
+}
+
+// JA4 returns the JA4 fingerprint of the ClientHello, as a TCP (rather than QUIC) client.
+// See https://github.com/FoxIO-LLC/ja4 for the specification.
+func (hi *ClientHello) JA4() string {
+	versionStr, ok := ja4Versions[hi.Version()]
+	if !ok {
+		versionStr = "00"
+	}
+
+	sni := "i"
+	extensions := withoutGREASE(hi.Extensions)
+	for _, e := range extensions {
+		if e == extensionServerName {
+			sni = "d"
+		}
+	}
+
+	ciphers := withoutGREASE(hi.CipherSuites)
+
+	alpn := "00"
+	if len(hi.ALPNProtocols) > 0 && hi.ALPNProtocols[0] != "" {
+		p := hi.ALPNProtocols[0]
+		if isAlphanumeric(p[0]) && isAlphanumeric(p[len(p)-1]) {
+			alpn = string([]byte{p[0], p[len(p)-1]})
+		} else {
+			h := hex.EncodeToString([]byte(p))
+			alpn = string([]byte{h[0], h[len(h)-1]})
+		}
+	}
+
+	a := fmt.Sprintf("t%s%s%02d%02d%s", versionStr, sni, min(len(ciphers), 99), min(len(extensions), 99), alpn)
+
+	sort.Slice(ciphers, func(i, j int) bool { return ciphers[i] < ciphers[j] })
+	b := ja4Hash(ciphers, "")
+
+	var hashedExtensions []uint16
+	for _, e := range extensions {
+		if e != extensionServerName && e != extensionALPN {
+			hashedExtensions = append(hashedExtensions, e)
+		}
+	}
+	sort.Slice(hashedExtensions, func(i, j int) bool { return hashedExtensions[i] < hashedExtensions[j] })
+	var sigAlgs string
+	if sa := withoutGREASE(hi.SignatureAlgorithms); len(sa) > 0 {
+		parts := make([]string, len(sa))
+		for i, v := range sa {
+			parts[i] = fmt.Sprintf("%04x", v)
+		}
+		sigAlgs = "_" + strings.Join(parts, ",")
+	}
+	c := ja4Hash(hashedExtensions, sigAlgs)
+
+	return a + "_" + b + "_" + c
+}
@@ -0,0 +1,35 @@
+package tls
+
+import (
+	"testing"
+
+	"github.com/lukegb/fourtosix/tls/tlstest"
+)
+
+// TestJA4 checks the example fingerprint from the JA4 specification, with a GREASE cipher suite and extension
+// added, which must be ignored.
+func TestJA4(t *testing.T) {
+	extensions := []tlstest.Extension{
+		{Type: 0x1a1a},
+		{Type: extensionALPN, Data: []byte{0, 12, 2, 'h', '2', 8, 'h', 't', 't', 'p', '/', '1', '.', '1'}},
+		{Type: extensionSignatureAlgorithms, Data: []byte{0, 16, 4, 3, 8, 4, 4, 1, 5, 3, 8, 5, 5, 1, 8, 6, 6, 1}},
+		{Type: extensionSupportedVersions, Data: []byte{4, 3, 4, 3, 3}},
+	}
+	for _, e := range []uint16{0x0005, 0x000a, 0x000b, 0x0012, 0x0015, 0x0017, 0x001b, 0x0023, 0x002d, 0x0033, 0x4469, 0xff01} {
+		extensions = append(extensions, tlstest.Extension{Type: e})
+	}
+	hi, err := ParseClientHello(tlstest.BuildClientHello(tlstest.Options{
+		ServerName: "example.com",
+		CipherSuites: []uint16{
+			0x0a0a, 0x1301, 0x1302, 0x1303, 0xc02b, 0xc02f, 0xc02c, 0xc030,
+			0xcca9, 0xcca8, 0xc013, 0xc014, 0x009c, 0x009d, 0x002f, 0x0035,
+		},
+		Extensions: extensions,
+	}))
+	if err != nil {
+		t.Fatalf("ParseClientHello: %v", err)
+	}
+	if got, want := hi.JA4(), "t13d1516h2_8daaf6152771_e5627efa2ab1"; got != want {
+		t.Errorf("JA4() = %s, want %s", got, want)
+	}
+}
@@ -0,0 +1,44 @@
+package tls
+
+import (
+	"bytes"
+	"context"
+	cryptotls "crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"time"
+)
+
+// replayConn is a net.Conn whose reads come from r, which replays bytes already read from Conn before reading more.
+type replayConn struct {
+	net.Conn
+	r io.Reader
+}
+
+func (c *replayConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+// serveLocal terminates TLS on conn using config, rather than proxying it, and passes the result to ServeLocal.
+// replay holds the bytes already read from conn, starting with the ClientHello, which are fed to the TLS server first.
+func (h *Handler) serveLocal(ctx context.Context, conn net.Conn, hostname string, config *cryptotls.Config, replay []byte) error {
+	tconn := cryptotls.Server(&replayConn{Conn: conn, r: io.MultiReader(bytes.NewReader(replay), conn)}, config)
+	defer tconn.Close()
+	// Shutdown closes the connection to abort whatever is being served.
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	defer stop()
+
+	if err := tconn.HandshakeContext(ctx); err != nil {
+		return fmt.Errorf("local TLS handshake for %s: %v", hostname, err)
+	}
+	var zero time.Time
+	conn.SetDeadline(zero)
+
+	h.logf("[%s] serving %s locally", conn.RemoteAddr(), hostname)
+	if h.ServeLocal != nil {
+		h.ServeLocal(tconn, hostname)
+	}
+	h.logf("[%s] closing connection", conn.RemoteAddr())
+	return nil
+}
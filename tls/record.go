@@ -1,29 +1,63 @@
 package tls
 
 import (
+	"errors"
 	"fmt"
 	"io"
 )
 
-func readRecord(r io.Reader, contentType uint8) ([]byte, error) {
-	head := make([]byte, 5)
-	if n, err := r.Read(head); err != nil {
-		return nil, err
-	} else if n != 5 {
-		return nil, fmt.Errorf("read %d bytes, wanted %d", n, 5)
-	}
+const (
+	// maxPlaintextLength is the largest fragment a TLSPlaintext record may carry (RFC 8446, section 5.1).
+	maxPlaintextLength = 1 << 14
+	// maxRecordLength allows some slack over maxPlaintextLength, as crypto/tls does for ciphertext.
+	maxRecordLength = maxPlaintextLength + 2048
+)
 
-	if head[0] != contentType {
-		return nil, fmt.Errorf("unexpected content type %d, wanted %d", head[0], contentType)
-	}
+var errRecordTooLarge = errors.New("record too large")
 
-	ln := uint16(head[3])<<8 | uint16(head[4])
-	fragment := make([]byte, ln)
-	if n, err := r.Read(fragment); err != nil {
-		return nil, err
-	} else if n != int(ln) {
-		return nil, fmt.Errorf("read %d bytes of fragment, wanted %d", n, ln)
-	}
+// recordReader reads records from r, failing once more than maxRecords have been read, alerts included.
+type recordReader struct {
+	r          io.Reader
+	maxRecords int
+	records    int
+}
 
-	return fragment, nil
+// next reads the fragment of the next record of type contentType, and the record's legacy_record_version.
+// Warning alerts are skipped over; close_notify or a fatal alert aborts the read.
+func (rr *recordReader) next(contentType uint8) ([]byte, ProtocolVersion, error) {
+	for {
+		if rr.records >= rr.maxRecords {
+			return nil, ProtocolVersion{}, tlsErrorf(AlertInternalError, "%w: ClientHello not complete after %d records", errTooManyRecords, rr.records)
+		}
+		rr.records++
+
+		head := make([]byte, 5)
+		if _, err := io.ReadFull(rr.r, head); err != nil {
+			return nil, ProtocolVersion{}, fmt.Errorf("reading record header: %w", err)
+		}
+
+		if head[0] != contentType && head[0] != contentTypeAlert {
+			return nil, ProtocolVersion{}, fmt.Errorf("unexpected content type %d, wanted %d", head[0], contentType)
+		}
+
+		ln := uint16(head[3])<<8 | uint16(head[4])
+		if ln > maxRecordLength {
+			return nil, ProtocolVersion{}, tlsErrorf(AlertRecordOverflow, "%w: %d bytes exceeds maximum of %d bytes", errRecordTooLarge, ln, maxRecordLength)
+		}
+		fragment := make([]byte, ln)
+		if _, err := io.ReadFull(rr.r, fragment); err != nil {
+			return nil, ProtocolVersion{}, fmt.Errorf("reading %d byte fragment: %w", ln, err)
+		}
+
+		if head[0] == contentType {
+			return fragment, ProtocolVersion{head[1], head[2]}, nil
+		}
+		if len(fragment) != 2 {
+			return nil, ProtocolVersion{}, fmt.Errorf("alert record has length %d, want 2", len(fragment))
+		}
+		if fragment[0] != alertLevelWarning || fragment[1] == alertCloseNotify {
+			// The client has given up; there's no point telling it anything.
+			return nil, ProtocolVersion{}, tlsErrorf(NoAlert, "client sent alert %d", fragment[1])
+		}
+	}
 }
@@ -1,24 +1,47 @@
 package tls
 
 import (
+	"bytes"
+	"errors"
 	"fmt"
 	"io"
+	"net"
+	"time"
 )
 
 const (
 	maxMessageLength = 65536 // same as maxMessageLength from crypto/tls
 
+	maxServerNameLength = 255
+
+	defaultMaxHandshakeRecords = 16
+
+	alertWriteTimeout = 1 * time.Second
+
 	contentTypeAlert     uint8 = 21
 	contentTypeHandshake uint8 = 22
 
-	alertLevelFatal uint8 = 2
+	alertLevelWarning uint8 = 1
+	alertLevelFatal   uint8 = 2
+
+	alertCloseNotify uint8 = 0
 
 	handshakeTypeClientHello uint8 = 1
 
-	alertInternalError    uint8 = 80
-	alertUnrecognizedName uint8 = 112
+	extensionServerName           uint16 = 0
+	extensionMaxFragmentLength    uint16 = 1
+	extensionSignatureAlgorithms  uint16 = 13
+	extensionALPN                 uint16 = 16
+	extensionRecordSizeLimit      uint16 = 28
+	extensionEarlyData            uint16 = 42
+	extensionSupportedVersions    uint16 = 43
+	extensionEncryptedClientHello uint16 = 0xfe0d
+)
 
-	extensionServerName uint16 = 0
+var (
+	errMessageTooLarge = errors.New("handshake message too large")
+	errTooManyRecords  = errors.New("too many handshake records")
+	errEmptyServerName = errors.New("server_name extension contains an empty host_name")
 )
 
 type ProtocolVersion struct {
@@ -28,59 +51,150 @@ type ProtocolVersion struct {
 type ClientHello struct {
 	ProtocolVersion ProtocolVersion
 	ServerName      string
+
+	// RecordVersion is the legacy_record_version of the first record the ClientHello arrived in,
+	// or zero if it was parsed from a bare handshake message.
+	RecordVersion ProtocolVersion
+
+	// ServerNames holds every host_name in the server_name extension, in the order the client sent them.
+	// Clients normally send just one; ServerName is the first.
+	ServerNames []string
+
+	// HasServerName is set if the client sent a server_name extension. A server_name extension containing an
+	// empty host_name is rejected as malformed, so if this is set, ServerName is not empty.
+	HasServerName bool
+
+	// EncryptedClientHello is set if the client sent an encrypted_client_hello extension.
+	// If so, ServerName is the public name from the outer ClientHello, not the real destination.
+	EncryptedClientHello bool
+
+	// EarlyData is set if the client sent an early_data extension, meaning it intends to send 0-RTT data.
+	EarlyData bool
+
+	// The remaining fields are recorded in the order the client sent them, for fingerprinting.
+	CipherSuites        []uint16
+	Extensions          []uint16
+	ALPNProtocols       []string
+	SignatureAlgorithms []uint16
+	SupportedVersions   []uint16
+
+	// MaxFragmentLength is the code from the max_fragment_length extension (RFC 6066), or 0 if it wasn't sent.
+	// Codes 1 to 4 mean 2^9 to 2^12 bytes.
+	MaxFragmentLength uint8
+	// RecordSizeLimit is the value of the record_size_limit extension (RFC 8449), or 0 if it wasn't sent.
+	RecordSizeLimit uint16
+}
+
+// Version returns the highest protocol version the client offered, in the same form as crypto/tls's
+// VersionTLS12 etc., taking the supported_versions extension into account if it was sent.
+func (hi *ClientHello) Version() uint16 {
+	version := uint16(hi.ProtocolVersion.Major)<<8 | uint16(hi.ProtocolVersion.Minor)
+	for _, v := range withoutGREASE(hi.SupportedVersions) {
+		if v > version {
+			version = v
+		}
+	}
+	return version
 }
 
-func readClientHello(r io.Reader) (hi *ClientHello, err error) {
-	buf, err := readRecord(r, contentTypeHandshake)
+// ParseClientHello parses a complete ClientHello from data, which may be either one or more TLS records,
+// as read from the wire, or a bare handshake message.
+func ParseClientHello(data []byte) (*ClientHello, error) {
+	if len(data) > 0 && data[0] == contentTypeHandshake {
+		return readClientHello(bytes.NewReader(data), defaultMaxHandshakeRecords)
+	}
+	msgLen, err := parseHandshakeHeader(data)
 	if err != nil {
 		return nil, err
 	}
-	// read message length
-	if buf[0] != handshakeTypeClientHello {
-		return nil, tlsErrorf(alertInternalError, "expected handshake type ClientHello (%d), got %d", handshakeTypeClientHello, buf[0])
+	if len(data) < 4+msgLen {
+		return nil, fmt.Errorf("handshake message claims %d bytes but only %d are present", msgLen, len(data)-4)
 	}
-	msgLen := int(buf[1])<<16 | int(buf[2])<<8 | int(buf[3])
-	if msgLen > maxMessageLength {
-		return nil, tlsErrorf(alertInternalError, "handshake message of length %d bytes exceeds maximum of %d bytes", msgLen, maxMessageLength)
+	return parseClientHello(data[4 : 4+msgLen])
+}
+
+// readClientHello reads a ClientHello from r, which may be split across at most maxRecords records.
+func readClientHello(r io.Reader, maxRecords int) (hi *ClientHello, err error) {
+	rr := &recordReader{r: r, maxRecords: maxRecords}
+	buf, recordVersion, err := rr.next(contentTypeHandshake)
+	if err != nil {
+		return nil, err
+	}
+	msgLen, err := parseHandshakeHeader(buf)
+	if err != nil {
+		return nil, err
 	}
 
 	for len(buf) < 4+msgLen {
-		fmt.Println(len(buf))
-		nbuf, err := readRecord(r, contentTypeHandshake)
+		nbuf, _, err := rr.next(contentTypeHandshake)
 		if err != nil {
 			return nil, err
 		}
 		buf = append(buf, nbuf...)
 	}
 
-	hi = &ClientHello{}
-	hi.ProtocolVersion.Major = buf[4]
-	hi.ProtocolVersion.Minor = buf[5]
+	hi, err = parseClientHello(buf[4 : 4+msgLen])
+	if err != nil {
+		return nil, err
+	}
+	hi.RecordVersion = recordVersion
+	return hi, nil
+}
+
+// parseHandshakeHeader checks that buf starts with a ClientHello handshake header, and returns the length of the message.
+func parseHandshakeHeader(buf []byte) (int, error) {
+	if len(buf) < 4 {
+		return 0, fmt.Errorf("handshake header truncated, have %d bytes", len(buf))
+	}
+	if buf[0] != handshakeTypeClientHello {
+		return 0, tlsErrorf(AlertInternalError, "expected handshake type ClientHello (%d), got %d", handshakeTypeClientHello, buf[0])
+	}
+	msgLen := int(buf[1])<<16 | int(buf[2])<<8 | int(buf[3])
+	if msgLen > maxMessageLength {
+		return 0, tlsErrorf(AlertInternalError, "%w: %d bytes exceeds maximum of %d bytes", errMessageTooLarge, msgLen, maxMessageLength)
+	}
+	return msgLen, nil
+}
+
+// parseClientHello parses the body of a ClientHello handshake message.
+func parseClientHello(buf []byte) (*ClientHello, error) {
+	if len(buf) < 35 {
+		return nil, fmt.Errorf("ClientHello truncated, have %d bytes", len(buf))
+	}
+	hi := &ClientHello{}
+	hi.ProtocolVersion.Major = buf[0]
+	hi.ProtocolVersion.Minor = buf[1]
 	if hi.ProtocolVersion.Major < 3 || (hi.ProtocolVersion.Major == 3 && hi.ProtocolVersion.Minor < 3) {
-		return nil, fmt.Errorf("client offered version %d, %d which is less than our minimum of 3, 3", hi.ProtocolVersion.Major, hi.ProtocolVersion.Minor)
+		return nil, tlsErrorf(AlertProtocolVersion, "client offered version %d, %d which is less than our minimum of 3, 3", hi.ProtocolVersion.Major, hi.ProtocolVersion.Minor)
 	}
 
 	// skip session ID
-	sessionIdLen := int(buf[38])
-	if sessionIdLen < 0 || sessionIdLen > 32 || len(buf) < 39+sessionIdLen {
-		return nil, fmt.Errorf("sessionIdLen was %d, out of range! min=0, max=32, datamax=%d", sessionIdLen, len(buf)-39)
+	sessionIdLen := int(buf[34])
+	if sessionIdLen < 0 || sessionIdLen > 32 || len(buf) < 35+sessionIdLen {
+		return nil, fmt.Errorf("sessionIdLen was %d, out of range! min=0, max=32, datamax=%d", sessionIdLen, len(buf)-35)
 	}
-	buf = buf[39+sessionIdLen:]
+	buf = buf[35+sessionIdLen:]
 	if len(buf) < 2 {
 		return nil, fmt.Errorf("insufficient data in buffer after trimming session ID, have %d bytes", len(buf))
 	}
 
 	// skip cipher suites
-	cipherSuiteLen := int(buf[0])<<16 | int(buf[1])
+	cipherSuiteLen := int(buf[0])<<8 | int(buf[1])
 	if cipherSuiteLen%2 == 1 || len(buf) < 2+cipherSuiteLen {
 		return nil, fmt.Errorf("cipherSuiteLen was %d; either not even or buffer too short", cipherSuiteLen)
 	}
+	for i := 0; i < cipherSuiteLen; i += 2 {
+		hi.CipherSuites = append(hi.CipherSuites, uint16(buf[2+i])<<8|uint16(buf[3+i]))
+	}
 	buf = buf[2+cipherSuiteLen:]
 
 	// skip compression methods
+	if len(buf) < 1 {
+		return nil, fmt.Errorf("insufficient data in buffer to read compression methods")
+	}
 	compressionMethodsLen := int(buf[0])
-	if len(buf) < 1+compressionMethodsLen {
-		return nil, fmt.Errorf("compressionMethodsLen was %d; buffer too short", compressionMethodsLen)
+	if compressionMethodsLen == 0 || len(buf) < 1+compressionMethodsLen {
+		return nil, fmt.Errorf("compressionMethodsLen was %d; either empty or buffer too short", compressionMethodsLen)
 	}
 	buf = buf[1+compressionMethodsLen:]
 
@@ -111,40 +225,144 @@ func readClientHello(r io.Reader) (hi *ClientHello, err error) {
 
 		extbuf := buf[:length]
 		buf = buf[length:]
-		if extension != extensionServerName {
-			// ignore
-			continue
+		hi.Extensions = append(hi.Extensions, extension)
+		var err error
+		switch extension {
+		case extensionServerName:
+			err = hi.parseServerName(extbuf)
+		case extensionEncryptedClientHello:
+			// the inner ClientHello is opaque to us; just note that it's there
+			hi.EncryptedClientHello = true
+		case extensionEarlyData:
+			hi.EarlyData = true
+		case extensionALPN:
+			err = hi.parseALPN(extbuf)
+		case extensionSignatureAlgorithms:
+			err = hi.parseSignatureAlgorithms(extbuf)
+		case extensionSupportedVersions:
+			err = hi.parseSupportedVersions(extbuf)
+		case extensionMaxFragmentLength:
+			if len(extbuf) != 1 {
+				err = fmt.Errorf("max_fragment_length extension has length %d, want 1", len(extbuf))
+			} else {
+				hi.MaxFragmentLength = extbuf[0]
+			}
+		case extensionRecordSizeLimit:
+			if len(extbuf) != 2 {
+				err = fmt.Errorf("record_size_limit extension has length %d, want 2", len(extbuf))
+			} else {
+				hi.RecordSizeLimit = uint16(extbuf[0])<<8 | uint16(extbuf[1])
+			}
 		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return hi, nil
+}
 
-		// server name indication!
-		serverNameCount := uint16(extbuf[0])<<8 | uint16(extbuf[1])
-		extbuf = extbuf[2:]
-		if len(extbuf) != int(serverNameCount) {
-			return nil, fmt.Errorf("serverNameCount (%d) doesn't match extension length (%d)", serverNameCount, len(extbuf))
+func (hi *ClientHello) parseServerName(extbuf []byte) error {
+	if len(extbuf) < 2 {
+		return fmt.Errorf("serverName, not enough bytes to read list length")
+	}
+	hi.HasServerName = true
+	hi.ServerNames = nil
+	serverNameCount := uint16(extbuf[0])<<8 | uint16(extbuf[1])
+	extbuf = extbuf[2:]
+	if len(extbuf) != int(serverNameCount) {
+		return fmt.Errorf("serverNameCount (%d) doesn't match extension length (%d)", serverNameCount, len(extbuf))
+	}
+	if serverNameCount == 0 {
+		return tlsErrorf(AlertDecodeError, "server_name extension contains an empty server_name_list")
+	}
+	for len(extbuf) > 0 {
+		if len(extbuf) < 3 {
+			return fmt.Errorf("serverName, not enough bytes to read name")
+		}
+		nameType := int(extbuf[0])
+		if nameType != 0 {
+			return tlsErrorf(AlertUnrecognizedName, "unsupported name_type %d", nameType)
 		}
-		for len(extbuf) > 0 {
-			if len(extbuf) < 3 {
-				return nil, fmt.Errorf("serverName, not enough bytes to read name")
-			}
-			nameType := int(extbuf[0])
-			if nameType != 0 {
-				return nil, tlsErrorf(alertUnrecognizedName, "unsupported name_type %d", nameType)
-			}
 
-			nameLen := uint16(extbuf[1])<<8 | uint16(extbuf[2])
-			extbuf = extbuf[3:]
-			hi.ServerName = string(extbuf[:nameLen])
-			if len(extbuf) < int(nameLen) {
-				return nil, fmt.Errorf("not enough bytes (buffer has %d) to read server_name of %d bytes", len(extbuf), nameLen)
-			}
-			extbuf = extbuf[nameLen:]
+		nameLen := uint16(extbuf[1])<<8 | uint16(extbuf[2])
+		extbuf = extbuf[3:]
+		if nameLen > maxServerNameLength {
+			return tlsErrorf(AlertUnrecognizedName, "server_name of %d bytes exceeds maximum of %d bytes", nameLen, maxServerNameLength)
+		}
+		if nameLen == 0 {
+			return tlsErrorf(AlertDecodeError, "%w", errEmptyServerName)
 		}
+		if len(extbuf) < int(nameLen) {
+			return fmt.Errorf("not enough bytes (buffer has %d) to read server_name of %d bytes", len(extbuf), nameLen)
+		}
+		hi.ServerNames = append(hi.ServerNames, string(extbuf[:nameLen]))
+		extbuf = extbuf[nameLen:]
+	}
+	if len(hi.ServerNames) > 0 {
+		hi.ServerName = hi.ServerNames[0]
 	}
+	return nil
+}
 
-	return hi, nil
+func (hi *ClientHello) parseALPN(extbuf []byte) error {
+	if len(extbuf) < 2 {
+		return fmt.Errorf("alpn, not enough bytes to read list length")
+	}
+	listLen := int(extbuf[0])<<8 | int(extbuf[1])
+	extbuf = extbuf[2:]
+	if len(extbuf) != listLen {
+		return fmt.Errorf("alpn list length (%d) doesn't match extension length (%d)", listLen, len(extbuf))
+	}
+	for len(extbuf) > 0 {
+		protoLen := int(extbuf[0])
+		extbuf = extbuf[1:]
+		if protoLen == 0 || len(extbuf) < protoLen {
+			return fmt.Errorf("alpn protocol length %d is empty or exceeds remaining buffer (%d)", protoLen, len(extbuf))
+		}
+		hi.ALPNProtocols = append(hi.ALPNProtocols, string(extbuf[:protoLen]))
+		extbuf = extbuf[protoLen:]
+	}
+	return nil
+}
+
+func (hi *ClientHello) parseSignatureAlgorithms(extbuf []byte) error {
+	if len(extbuf) < 2 {
+		return fmt.Errorf("signature_algorithms, not enough bytes to read list length")
+	}
+	listLen := int(extbuf[0])<<8 | int(extbuf[1])
+	extbuf = extbuf[2:]
+	if len(extbuf) != listLen || listLen%2 == 1 {
+		return fmt.Errorf("signature_algorithms list length (%d) is odd or doesn't match extension length (%d)", listLen, len(extbuf))
+	}
+	for ; len(extbuf) > 0; extbuf = extbuf[2:] {
+		hi.SignatureAlgorithms = append(hi.SignatureAlgorithms, uint16(extbuf[0])<<8|uint16(extbuf[1]))
+	}
+	return nil
+}
+
+func (hi *ClientHello) parseSupportedVersions(extbuf []byte) error {
+	if len(extbuf) < 1 {
+		return fmt.Errorf("supported_versions, not enough bytes to read list length")
+	}
+	listLen := int(extbuf[0])
+	extbuf = extbuf[1:]
+	if len(extbuf) != listLen || listLen%2 == 1 {
+		return fmt.Errorf("supported_versions list length (%d) is odd or doesn't match extension length (%d)", listLen, len(extbuf))
+	}
+	for ; len(extbuf) > 0; extbuf = extbuf[2:] {
+		hi.SupportedVersions = append(hi.SupportedVersions, uint16(extbuf[0])<<8|uint16(extbuf[1]))
+	}
+	return nil
 }
 
-func sendTLSAlert(w io.Writer, alert uint8) error {
+// sendTLSAlert sends a fatal alert to conn, unless alert is NoAlert, giving up if it can't be sent within alertWriteTimeout.
+func sendTLSAlert(conn net.Conn, alert Alert) error {
+	if alert == NoAlert {
+		return nil
+	}
+	conn.SetWriteDeadline(time.Now().Add(alertWriteTimeout))
+
 	abuf := make([]byte, 7)
 	abuf[0] = contentTypeAlert
 
@@ -157,8 +375,8 @@ func sendTLSAlert(w io.Writer, alert uint8) error {
 	abuf[4] = 2
 
 	abuf[5] = alertLevelFatal
-	abuf[6] = alert
+	abuf[6] = uint8(alert)
 
-	_, err := w.Write(abuf)
+	_, err := conn.Write(abuf)
 	return err
 }
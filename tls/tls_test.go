@@ -0,0 +1,274 @@
+package tls
+
+import (
+	"bytes"
+	"errors"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/lukegb/fourtosix/tls/tlstest"
+)
+
+// handshakeBody strips the record and handshake headers from a single-record ClientHello built by tlstest.
+func handshakeBody(raw []byte) []byte {
+	return raw[5+4:]
+}
+
+// record frames fragment as a TLS record of type contentType.
+func record(contentType uint8, fragment ...byte) []byte {
+	return append([]byte{contentType, 3, 1, byte(len(fragment) >> 8), byte(len(fragment))}, fragment...)
+}
+
+// splitHello reframes the single-record ClientHello raw as n handshake records.
+func splitHello(raw []byte, n int) [][]byte {
+	msg := raw[5:]
+	var records [][]byte
+	for i := 0; i < n; i++ {
+		records = append(records, record(contentTypeHandshake, msg[i*len(msg)/n:(i+1)*len(msg)/n]...))
+	}
+	return records
+}
+
+func TestParseManyCipherSuites(t *testing.T) {
+	// A 40-byte list fits in the low byte of the length; more than 127 suites need the high byte too.
+	for _, n := range []int{20, 200} {
+		var suites []uint16
+		for i := 0; i < n; i++ {
+			suites = append(suites, uint16(0x1000+i))
+		}
+		hi, err := ParseClientHello(tlstest.BuildClientHello(tlstest.Options{ServerName: "example.com", CipherSuites: suites}))
+		if err != nil {
+			t.Fatalf("%d suites: ParseClientHello: %v", n, err)
+		}
+		if !reflect.DeepEqual(hi.CipherSuites, suites) {
+			t.Errorf("%d suites: got %#04x", n, hi.CipherSuites)
+		}
+		if hi.ServerName != "example.com" {
+			t.Errorf("%d suites: ServerName = %q, want %q", n, hi.ServerName, "example.com")
+		}
+	}
+}
+
+func TestParseTruncated(t *testing.T) {
+	body := handshakeBody(tlstest.BuildClientHello(tlstest.Options{CipherSuites: []uint16{0x1301, 0x1302}}))
+	const (
+		cipherLenAt   = 2 + 32 + 1
+		compressionAt = cipherLenAt + 2 + 4
+	)
+	for _, tc := range []struct {
+		name string
+		body []byte
+	}{
+		{"before session ID", body[:34]},
+		{"cipher suite length", body[:cipherLenAt+1]},
+		{"within cipher suites", body[:cipherLenAt+3]},
+		{"before compression methods", body[:compressionAt]},
+		{"within compression methods", append(append([]byte(nil), body[:compressionAt]...), 2, 0)},
+	} {
+		if _, err := parseClientHello(tc.body); err == nil {
+			t.Errorf("%s: parsed a truncated ClientHello", tc.name)
+		}
+	}
+}
+
+func TestParseOddCipherSuiteLength(t *testing.T) {
+	body := append([]byte(nil), handshakeBody(tlstest.BuildClientHello(tlstest.Options{}))...)
+	body[2+32+1+1] = 3
+	if _, err := parseClientHello(body); err == nil {
+		t.Error("parsed a cipher suite list with an odd length")
+	}
+}
+
+func TestParseEmptyServerName(t *testing.T) {
+	_, err := ParseClientHello(tlstest.BuildClientHello(tlstest.Options{
+		Extensions: []tlstest.Extension{tlstest.ServerNameExtension("")},
+	}))
+	if !errors.Is(err, errEmptyServerName) {
+		t.Fatalf("got %v, want %v", err, errEmptyServerName)
+	}
+	var tlsErr *tlsError
+	if !errors.As(err, &tlsErr) || tlsErr.alert != AlertDecodeError {
+		t.Errorf("got %v, want a decode_error alert", err)
+	}
+
+	hi, err := ParseClientHello(tlstest.BuildClientHello(tlstest.Options{}))
+	if err != nil {
+		t.Fatalf("ParseClientHello without server_name: %v", err)
+	}
+	if hi.HasServerName || hi.ServerName != "" {
+		t.Errorf("HasServerName = %v, ServerName = %q without a server_name extension", hi.HasServerName, hi.ServerName)
+	}
+}
+
+func TestParseEmptyServerNameList(t *testing.T) {
+	_, err := ParseClientHello(tlstest.BuildClientHello(tlstest.Options{
+		Extensions: []tlstest.Extension{{Type: 0, Data: []byte{0, 0}}},
+	}))
+	var tlsErr *tlsError
+	if !errors.As(err, &tlsErr) || tlsErr.alert != AlertDecodeError {
+		t.Errorf("got %v, want a decode_error alert", err)
+	}
+}
+
+func TestParseOldVersion(t *testing.T) {
+	for _, version := range []uint16{0x0200, 0x0300, 0x0301, 0x0302} {
+		_, err := ParseClientHello(tlstest.BuildClientHello(tlstest.Options{ServerName: "example.com", Version: version}))
+		var tlsErr *tlsError
+		if !errors.As(err, &tlsErr) || tlsErr.alert != AlertProtocolVersion {
+			t.Errorf("version %#04x: got %v, want a protocol_version alert", version, err)
+		}
+	}
+	if _, err := ParseClientHello(tlstest.BuildClientHello(tlstest.Options{ServerName: "example.com", Version: 0x0303})); err != nil {
+		t.Errorf("version 0x0303: %v", err)
+	}
+}
+
+func TestParseServerNameLength(t *testing.T) {
+	longest := strings.Repeat("a", maxServerNameLength-len(".com")) + ".com"
+	hi, err := ParseClientHello(tlstest.BuildClientHello(tlstest.Options{ServerName: longest}))
+	if err != nil {
+		t.Fatalf("ParseClientHello with a %d byte server_name: %v", len(longest), err)
+	}
+	if hi.ServerName != longest {
+		t.Errorf("ServerName = %q, want %q", hi.ServerName, longest)
+	}
+
+	_, err = ParseClientHello(tlstest.BuildClientHello(tlstest.Options{ServerName: "a" + longest}))
+	var tlsErr *tlsError
+	if !errors.As(err, &tlsErr) || tlsErr.alert != AlertUnrecognizedName {
+		t.Errorf("ParseClientHello with a %d byte server_name: got %v, want an unrecognized_name alert", len(longest)+1, err)
+	}
+}
+
+func TestParseMultipleServerNames(t *testing.T) {
+	first := tlstest.ServerNameExtension("a.example")
+	second := tlstest.ServerNameExtension("b.example")
+	list := append(append([]byte(nil), first.Data[2:]...), second.Data[2:]...)
+	ext := tlstest.Extension{Type: first.Type, Data: append([]byte{byte(len(list) >> 8), byte(len(list))}, list...)}
+
+	hi, err := ParseClientHello(tlstest.BuildClientHello(tlstest.Options{Extensions: []tlstest.Extension{ext}}))
+	if err != nil {
+		t.Fatalf("ParseClientHello: %v", err)
+	}
+	if hi.ServerName != "a.example" {
+		t.Errorf("ServerName = %q, want the first name", hi.ServerName)
+	}
+	if len(hi.ServerNames) != 2 || hi.ServerNames[0] != "a.example" || hi.ServerNames[1] != "b.example" {
+		t.Errorf("ServerNames = %q, want [a.example b.example]", hi.ServerNames)
+	}
+}
+
+func TestParseFragmentLimits(t *testing.T) {
+	hi, err := ParseClientHello(tlstest.BuildClientHello(tlstest.Options{Extensions: []tlstest.Extension{
+		{Type: extensionMaxFragmentLength, Data: []byte{2}},
+		{Type: extensionRecordSizeLimit, Data: []byte{0x40, 0x01}},
+	}}))
+	if err != nil {
+		t.Fatalf("ParseClientHello: %v", err)
+	}
+	if hi.MaxFragmentLength != 2 || hi.RecordSizeLimit != 0x4001 {
+		t.Errorf("MaxFragmentLength = %d, RecordSizeLimit = %d; want 2, %d", hi.MaxFragmentLength, hi.RecordSizeLimit, 0x4001)
+	}
+
+	hi, err = ParseClientHello(tlstest.BuildClientHello(tlstest.Options{}))
+	if err != nil {
+		t.Fatalf("ParseClientHello without either extension: %v", err)
+	}
+	if hi.MaxFragmentLength != 0 || hi.RecordSizeLimit != 0 {
+		t.Errorf("MaxFragmentLength = %d, RecordSizeLimit = %d without the extensions, want 0", hi.MaxFragmentLength, hi.RecordSizeLimit)
+	}
+
+	for _, ext := range []tlstest.Extension{
+		{Type: extensionMaxFragmentLength, Data: []byte{2, 0}},
+		{Type: extensionRecordSizeLimit, Data: []byte{0x40}},
+	} {
+		if _, err := ParseClientHello(tlstest.BuildClientHello(tlstest.Options{Extensions: []tlstest.Extension{ext}})); err == nil {
+			t.Errorf("parsed extension %d with %d bytes of data", ext.Type, len(ext.Data))
+		}
+	}
+}
+
+func TestParseRecordVersion(t *testing.T) {
+	raw := tlstest.BuildClientHello(tlstest.Options{ServerName: "example.com"})
+	raw[1], raw[2] = 3, 7
+	hi, err := ParseClientHello(raw)
+	if err != nil {
+		t.Fatalf("ParseClientHello: %v", err)
+	}
+	if hi.RecordVersion != (ProtocolVersion{3, 7}) {
+		t.Errorf("RecordVersion = %v, want 3.7", hi.RecordVersion)
+	}
+
+	hi, err = ParseClientHello(raw[5:])
+	if err != nil {
+		t.Fatalf("ParseClientHello of bare message: %v", err)
+	}
+	if hi.RecordVersion != (ProtocolVersion{}) {
+		t.Errorf("RecordVersion = %v for a bare handshake message, want zero", hi.RecordVersion)
+	}
+}
+
+func TestParseSkipsWarningAlerts(t *testing.T) {
+	records := splitHello(tlstest.BuildClientHello(tlstest.Options{ServerName: "example.com"}), 2)
+	userCanceled := record(contentTypeAlert, alertLevelWarning, 90)
+	hi, err := ParseClientHello(bytes.Join([][]byte{records[0], userCanceled, records[1]}, nil))
+	if err != nil {
+		t.Fatalf("ParseClientHello with a warning alert between fragments: %v", err)
+	}
+	if hi.ServerName != "example.com" {
+		t.Errorf("ServerName = %q, want %q", hi.ServerName, "example.com")
+	}
+}
+
+func TestParseAbortsOnAlert(t *testing.T) {
+	records := splitHello(tlstest.BuildClientHello(tlstest.Options{ServerName: "example.com"}), 2)
+	for _, tc := range []struct {
+		name  string
+		alert []byte
+	}{
+		{"fatal", record(contentTypeAlert, alertLevelFatal, byte(AlertHandshakeFailure))},
+		{"close_notify", record(contentTypeAlert, alertLevelWarning, alertCloseNotify)},
+	} {
+		_, err := ParseClientHello(bytes.Join([][]byte{records[0], tc.alert, records[1]}, nil))
+		var tlsErr *tlsError
+		if !errors.As(err, &tlsErr) || tlsErr.alert != NoAlert {
+			t.Errorf("%s: got %v, want an error closing without an alert", tc.name, err)
+		}
+	}
+}
+
+func TestParseCountsAlertRecords(t *testing.T) {
+	records := splitHello(tlstest.BuildClientHello(tlstest.Options{ServerName: "example.com"}), 2)
+	withAlerts := func(n int) []byte {
+		b := append([]byte(nil), records[0]...)
+		for i := 0; i < n; i++ {
+			b = append(b, record(contentTypeAlert, alertLevelWarning, 90)...)
+		}
+		return append(b, records[1]...)
+	}
+
+	if _, err := ParseClientHello(withAlerts(defaultMaxHandshakeRecords - 2)); err != nil {
+		t.Errorf("ParseClientHello of %d records: %v", defaultMaxHandshakeRecords, err)
+	}
+	if _, err := ParseClientHello(withAlerts(defaultMaxHandshakeRecords - 1)); !errors.Is(err, errTooManyRecords) {
+		t.Errorf("ParseClientHello of %d records, mostly alerts: got %v, want %v", defaultMaxHandshakeRecords+1, err, errTooManyRecords)
+	}
+}
+
+func TestSendTLSAlertGivesUp(t *testing.T) {
+	// Nothing reads from peer, so the write can never complete.
+	conn, peer := net.Pipe()
+	defer conn.Close()
+	defer peer.Close()
+
+	start := time.Now()
+	if err := sendTLSAlert(conn, AlertInternalError); err == nil {
+		t.Error("sendTLSAlert to a client which never reads succeeded")
+	}
+	if elapsed := time.Since(start); elapsed > alertWriteTimeout+time.Second {
+		t.Errorf("sendTLSAlert blocked for %v, want about %v", elapsed, alertWriteTimeout)
+	}
+}
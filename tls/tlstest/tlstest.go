@@ -0,0 +1,93 @@
+// Package tlstest builds TLS handshake messages for exercising ClientHello parsers.
+package tlstest
+
+const (
+	contentTypeHandshake     = 22
+	handshakeTypeClientHello = 1
+	extensionServerName      = 0
+	maxPlaintextLength       = 1 << 14
+)
+
+// Extension is a raw TLS extension to include in a ClientHello.
+type Extension struct {
+	Type uint16
+	Data []byte
+}
+
+// Options describe the ClientHello built by BuildClientHello.
+type Options struct {
+	// ServerName, if set, is sent in a server_name extension, ahead of Extensions.
+	ServerName string
+
+	// Version is the legacy_version field of the ClientHello. If zero, TLS 1.2 (0x0303) is used.
+	Version uint16
+
+	// CipherSuites are the cipher suites offered. If empty, TLS_AES_128_GCM_SHA256 is offered.
+	CipherSuites []uint16
+
+	// Extensions are sent in order after server_name.
+	Extensions []Extension
+}
+
+// BuildClientHello returns a ClientHello described by opts, framed in as many TLS records as it needs.
+// The random and session ID are left empty, and only the null compression method is offered.
+func BuildClientHello(opts Options) []byte {
+	version := opts.Version
+	if version == 0 {
+		version = 0x0303
+	}
+	suites := opts.CipherSuites
+	if len(suites) == 0 {
+		suites = []uint16{0x1301}
+	}
+	exts := opts.Extensions
+	if opts.ServerName != "" {
+		exts = append([]Extension{ServerNameExtension(opts.ServerName)}, exts...)
+	}
+
+	body := appendUint16(nil, version)
+	body = append(body, make([]byte, 32)...) // random
+	body = append(body, 0)                   // session ID
+	body = appendUint16(body, uint16(2*len(suites)))
+	for _, s := range suites {
+		body = appendUint16(body, s)
+	}
+	body = append(body, 1, 0) // compression methods: null
+
+	var extbuf []byte
+	for _, e := range exts {
+		extbuf = appendUint16(extbuf, e.Type)
+		extbuf = appendUint16(extbuf, uint16(len(e.Data)))
+		extbuf = append(extbuf, e.Data...)
+	}
+	body = appendUint16(body, uint16(len(extbuf)))
+	body = append(body, extbuf...)
+
+	msg := []byte{handshakeTypeClientHello, byte(len(body) >> 16), byte(len(body) >> 8), byte(len(body))}
+	msg = append(msg, body...)
+
+	var out []byte
+	for len(msg) > 0 {
+		n := len(msg)
+		if n > maxPlaintextLength {
+			n = maxPlaintextLength
+		}
+		out = append(out, contentTypeHandshake, 3, 1)
+		out = appendUint16(out, uint16(n))
+		out = append(out, msg[:n]...)
+		msg = msg[n:]
+	}
+	return out
+}
+
+// ServerNameExtension returns a server_name extension carrying a single host_name.
+func ServerNameExtension(name string) Extension {
+	entry := []byte{0} // name_type host_name
+	entry = appendUint16(entry, uint16(len(name)))
+	entry = append(entry, name...)
+	return Extension{Type: extensionServerName, Data: append(appendUint16(nil, uint16(len(entry))), entry...)}
+}
+
+func appendUint16(b []byte, v uint16) []byte {
+	return append(b, byte(v>>8), byte(v))
+}
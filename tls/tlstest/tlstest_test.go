@@ -0,0 +1,62 @@
+package tlstest_test
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/lukegb/fourtosix/tls"
+	"github.com/lukegb/fourtosix/tls/tlstest"
+)
+
+func TestRoundTrip(t *testing.T) {
+	hi, err := tls.ParseClientHello(tlstest.BuildClientHello(tlstest.Options{
+		ServerName:   "example.com",
+		CipherSuites: []uint16{0x1301, 0x1302, 0xc02f},
+		Extensions:   []tlstest.Extension{{Type: 0xff01, Data: []byte{0}}},
+	}))
+	if err != nil {
+		t.Fatalf("ParseClientHello: %v", err)
+	}
+	if hi.ServerName != "example.com" {
+		t.Errorf("ServerName = %q, want %q", hi.ServerName, "example.com")
+	}
+	if hi.Version() != 0x0303 {
+		t.Errorf("Version = %#04x, want 0x0303", hi.Version())
+	}
+	if want := []uint16{0x1301, 0x1302, 0xc02f}; !equalUint16s(hi.CipherSuites, want) {
+		t.Errorf("CipherSuites = %#04x, want %#04x", hi.CipherSuites, want)
+	}
+	if want := []uint16{0, 0xff01}; !equalUint16s(hi.Extensions, want) {
+		t.Errorf("Extensions = %#04x, want %#04x", hi.Extensions, want)
+	}
+}
+
+func TestRoundTripSplitAcrossRecords(t *testing.T) {
+	raw := tlstest.BuildClientHello(tlstest.Options{
+		ServerName: "example.com",
+		Extensions: []tlstest.Extension{{Type: 0xff02, Data: bytes.Repeat([]byte{0xaa}, 20000)}},
+	})
+	// The first record is full, so the message continues into a second.
+	if n := int(raw[3])<<8 | int(raw[4]); n != 1<<14 {
+		t.Fatalf("first record carries %d bytes, want %d", n, 1<<14)
+	}
+	hi, err := tls.ParseClientHello(raw)
+	if err != nil {
+		t.Fatalf("ParseClientHello: %v", err)
+	}
+	if hi.ServerName != "example.com" {
+		t.Errorf("ServerName = %q, want %q", hi.ServerName, "example.com")
+	}
+}
+
+func equalUint16s(a, b []uint16) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
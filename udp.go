@@ -0,0 +1,145 @@
+package fourtosix
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	defaultUDPIdleTimeout = 30 * time.Second
+	maxDatagramSize       = 65535
+)
+
+// errTooManyMappings is returned for datagrams from new clients while a UDPRelay is at its MaxMappings.
+var errTooManyMappings = errors.New("too many active clients; dropping datagram")
+
+// UDPRelay forwards datagrams, such as DNS queries, to a fixed Backend from an address derived from each
+// client's IPv4 address by Dialer. Responses from the backend are sent back to the client for as long as
+// the client's mapping stays active.
+type UDPRelay struct {
+	Dialer  *SubnetDialer
+	Backend string
+
+	// IdleTimeout is how long a client's mapping is kept without any traffic in either direction.
+	// If zero, 30 seconds is used.
+	IdleTimeout time.Duration
+
+	// MaxMappings, if positive, caps the number of clients with an active mapping, each of which holds a socket.
+	// While the cap is reached, datagrams from new clients are dropped.
+	MaxMappings int
+
+	mu       sync.Mutex
+	mappings map[string]*udpMapping
+}
+
+// udpMapping is a client's socket to the backend.
+type udpMapping struct {
+	conn *net.UDPConn
+	// idleUntil is when the mapping expires if there's no more traffic. It is guarded by UDPRelay.mu.
+	idleUntil time.Time
+}
+
+func (r *UDPRelay) idleTimeout() time.Duration {
+	if r.IdleTimeout > 0 {
+		return r.IdleTimeout
+	}
+	return defaultUDPIdleTimeout
+}
+
+// Serve reads datagrams from pc and relays them until pc is closed.
+func (r *UDPRelay) Serve(pc net.PacketConn) error {
+	raddr, err := net.ResolveUDPAddr("udp6", r.Backend)
+	if err != nil {
+		return err
+	}
+
+	buf := make([]byte, maxDatagramSize)
+	for {
+		n, from, err := pc.ReadFrom(buf)
+		if err != nil {
+			return err
+		}
+		m, err := r.mapping(pc, from, raddr)
+		if err != nil {
+			log.Printf("[%s] %v", from, err)
+			continue
+		}
+		if _, err := m.conn.Write(buf[:n]); err != nil {
+			log.Printf("[%s] writing to %s: %v", from, raddr, err)
+		}
+	}
+}
+
+// mapping returns the mapping for the client at from, creating it if needed, and extends its idle timeout.
+func (r *UDPRelay) mapping(pc net.PacketConn, from net.Addr, raddr *net.UDPAddr) (*udpMapping, error) {
+	uaddr, ok := from.(*net.UDPAddr)
+	if !ok || uaddr.IP.To4() == nil {
+		return nil, fmt.Errorf("datagram not from an IPv4 UDP client")
+	}
+
+	key := from.String()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if m, ok := r.mappings[key]; ok {
+		r.touch(m)
+		return m, nil
+	}
+	if r.MaxMappings > 0 && len(r.mappings) >= r.MaxMappings {
+		return nil, errTooManyMappings
+	}
+
+	localIP, err := r.Dialer.sourceFor(uaddr.IP, r.Dialer.VarySource)
+	if err != nil {
+		return nil, err
+	}
+	laddr := &net.UDPAddr{IP: localIP}
+	bconn, err := net.DialUDP("udp6", laddr, raddr)
+	if err != nil {
+		return nil, fmt.Errorf("connecting to %s from %s: %v", raddr, laddr.IP, err)
+	}
+	if r.mappings == nil {
+		r.mappings = make(map[string]*udpMapping)
+	}
+	m := &udpMapping{conn: bconn}
+	r.touch(m)
+	r.mappings[key] = m
+	go r.reply(pc, from, m)
+	return m, nil
+}
+
+// touch extends m's idle timeout. r.mu must be held.
+func (r *UDPRelay) touch(m *udpMapping) {
+	m.idleUntil = time.Now().Add(r.idleTimeout())
+	m.conn.SetReadDeadline(m.idleUntil)
+}
+
+// reply copies responses from m back to the client until the mapping goes idle.
+func (r *UDPRelay) reply(pc net.PacketConn, to net.Addr, m *udpMapping) {
+	buf := make([]byte, maxDatagramSize)
+	for {
+		n, err := m.conn.Read(buf)
+		if err == nil {
+			r.mu.Lock()
+			r.touch(m)
+			r.mu.Unlock()
+			if _, err = pc.WriteTo(buf[:n], to); err == nil {
+				continue
+			}
+		}
+		// Serve may have just fetched the mapping to send a datagram, extending its deadline, after this read timed
+		// out; closing it now would lose that datagram, so only remove the mapping if it is still idle.
+		r.mu.Lock()
+		if ne, ok := err.(net.Error); ok && ne.Timeout() && time.Now().Before(m.idleUntil) {
+			r.mu.Unlock()
+			continue
+		}
+		delete(r.mappings, to.String())
+		r.mu.Unlock()
+		m.conn.Close()
+		return
+	}
+}
@@ -0,0 +1,70 @@
+package fourtosix
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func listenUDP(t *testing.T) *net.UDPConn {
+	c, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Close() })
+	return c
+}
+
+func TestUDPRelayMaxMappings(t *testing.T) {
+	r := &UDPRelay{MaxMappings: 2}
+	r.mappings = map[string]*udpMapping{
+		"192.0.2.1:53": {},
+		"192.0.2.2:53": {},
+	}
+	from := &net.UDPAddr{IP: net.IPv4(192, 0, 2, 3), Port: 53}
+	if _, err := r.mapping(nil, from, nil); err != errTooManyMappings {
+		t.Errorf("mapping for a new client at MaxMappings: got %v, want %v", err, errTooManyMappings)
+	}
+}
+
+func TestUDPRelayReplyUntilIdle(t *testing.T) {
+	backend := listenUDP(t)
+	pc := listenUDP(t)
+	client := listenUDP(t)
+	bconn, err := net.DialUDP("udp", nil, backend.LocalAddr().(*net.UDPAddr))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := &UDPRelay{IdleTimeout: 50 * time.Millisecond}
+	m := &udpMapping{conn: bconn}
+	key := client.LocalAddr().String()
+	r.mu.Lock()
+	r.mappings = map[string]*udpMapping{key: m}
+	r.touch(m)
+	r.mu.Unlock()
+	go r.reply(pc, client.LocalAddr(), m)
+
+	buf := make([]byte, 16)
+	bconn.Write([]byte("query"))
+	_, from, err := backend.ReadFrom(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	backend.WriteTo([]byte("answer"), from)
+	client.SetReadDeadline(time.Now().Add(time.Second))
+	n, err := client.Read(buf)
+	if err != nil || string(buf[:n]) != "answer" {
+		t.Fatalf("client read %q, %v; want the backend's answer", buf[:n], err)
+	}
+
+	for deadline := time.Now().Add(time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		r.mu.Lock()
+		_, ok := r.mappings[key]
+		r.mu.Unlock()
+		if !ok {
+			return
+		}
+	}
+	t.Error("idle mapping was never removed")
+}
@@ -0,0 +1,40 @@
+package fourtosix
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+)
+
+// ValidatePort checks that port is a usable TCP port number, from 1 to 65535.
+func ValidatePort(port int) error {
+	if port < 1 || port > 65535 {
+		return fmt.Errorf("port %d is out of range", port)
+	}
+	return nil
+}
+
+// ValidateAddress checks that addr is a host:port pair with a usable port number, as backends are given.
+func ValidateAddress(addr string) error {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return err
+	}
+	if host == "" {
+		return fmt.Errorf("address %q has no host", addr)
+	}
+	p, err := strconv.Atoi(port)
+	if err != nil {
+		return fmt.Errorf("address %q has a non-numeric port", addr)
+	}
+	return ValidatePort(p)
+}
+
+// ValidateNetwork checks that network, if set, is a TCP network name which a handler's ForceNetwork may be set to.
+func ValidateNetwork(network string) error {
+	switch network {
+	case "", "tcp", "tcp4", "tcp6":
+		return nil
+	}
+	return fmt.Errorf("network %q is not a TCP network", network)
+}